@@ -0,0 +1,250 @@
+package MQTTg
+
+import (
+	"bufio"
+	"errors"
+	"golang.org/x/crypto/bcrypt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// Authenticator decides whether the CONNECT is accepted.
+// Implementations must be safe for concurrent use, Authenticate is called once
+// per CONNECT before the session of the client is looked up.
+type Authenticator interface {
+	// Authenticate returns Accepted, BadUserNameOrPassword or NotAuthorized.
+	// userName and password are empty when they are not in the CONNECT.
+	Authenticate(clientID, userName, password string, addr net.Addr) ConnectReturnCode
+}
+
+// HtpasswdAuthenticator authenticates users by a htpasswd style file,
+// each line is "username:bcrypt-hash" as "htpasswd -B" generates.
+type HtpasswdAuthenticator struct {
+	AllowAnonymous bool
+	users          map[string][]byte
+}
+
+func NewHtpasswdAuthenticator(path string) (*HtpasswdAuthenticator, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	users := make(map[string][]byte)
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		parts := strings.SplitN(line, ":", 2)
+		if len(parts) != 2 || len(parts[0]) == 0 {
+			return nil, errors.New(path + ":" + strconv.Itoa(lineNum) + ": invalid line")
+		}
+		if _, err := bcrypt.Cost([]byte(parts[1])); err != nil {
+			return nil, errors.New(path + ":" + strconv.Itoa(lineNum) + ": only bcrypt hash is supported")
+		}
+		users[parts[0]] = []byte(parts[1])
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return &HtpasswdAuthenticator{
+		AllowAnonymous: false,
+		users:          users,
+	}, nil
+}
+
+func (self *HtpasswdAuthenticator) Authenticate(clientID, userName, password string, addr net.Addr) ConnectReturnCode {
+	if len(userName) == 0 {
+		if self.AllowAnonymous {
+			return Accepted
+		}
+		return NotAuthorized
+	}
+	hash, ok := self.users[userName]
+	if !ok {
+		return BadUserNameOrPassword
+	}
+	if bcrypt.CompareHashAndPassword(hash, []byte(password)) != nil {
+		return BadUserNameOrPassword
+	}
+	return Accepted
+}
+
+// Authorizer decides which topics a client may publish to or subscribe to.
+// userName is empty for anonymous clients.
+type Authorizer interface {
+	CanPublish(clientID, userName, topic string) bool
+	CanSubscribe(clientID, userName, filter string) bool
+}
+
+type ACLAccess uint8
+
+const (
+	ACLRead ACLAccess = 1 << iota
+	ACLWrite
+	ACLReadWrite = ACLRead | ACLWrite
+)
+
+type aclEntry struct {
+	Access ACLAccess
+	Filter string
+}
+
+// ACLAuthorizer is loaded from a mosquitto like ACL file.
+//
+//	# topic lines before any user line are for anonymous clients
+//	topic read public/#
+//	user daiki
+//	topic readwrite sensors/#
+//	# pattern lines are for every client, %c is client ID and %u is username
+//	pattern write devices/%c/#
+//	pattern read users/%u/#
+//
+// The access is readwrite when it is omitted.
+type ACLAuthorizer struct {
+	users    map[string][]*aclEntry // "" is anonymous
+	patterns []*aclEntry
+}
+
+func NewACLAuthorizer(path string) (*ACLAuthorizer, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	acl := &ACLAuthorizer{
+		users:    make(map[string][]*aclEntry),
+		patterns: make([]*aclEntry, 0),
+	}
+	user := ""
+	scanner := bufio.NewScanner(f)
+	for lineNum := 1; scanner.Scan(); lineNum++ {
+		line := strings.TrimSpace(scanner.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		fields := strings.Fields(line)
+		invalid := errors.New(path + ":" + strconv.Itoa(lineNum) + ": invalid line")
+		switch fields[0] {
+		case "user":
+			if len(fields) != 2 {
+				return nil, invalid
+			}
+			user = fields[1]
+		case "topic", "pattern":
+			entry, err := parseACLEntry(fields[1:])
+			if err != nil {
+				return nil, invalid
+			}
+			if fields[0] == "topic" {
+				acl.users[user] = append(acl.users[user], entry)
+			} else {
+				acl.patterns = append(acl.patterns, entry)
+			}
+		default:
+			return nil, invalid
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return acl, nil
+}
+
+func parseACLEntry(fields []string) (*aclEntry, error) {
+	entry := &aclEntry{Access: ACLReadWrite}
+	switch len(fields) {
+	case 1:
+		entry.Filter = fields[0]
+	case 2:
+		switch fields[0] {
+		case "read":
+			entry.Access = ACLRead
+		case "write":
+			entry.Access = ACLWrite
+		case "readwrite":
+			entry.Access = ACLReadWrite
+		default:
+			return nil, PROTOCOL_VIOLATION
+		}
+		entry.Filter = fields[1]
+	default:
+		return nil, PROTOCOL_VIOLATION
+	}
+	if err := ValidateFilter(entry.Filter); err != nil {
+		return nil, err
+	}
+	return entry, nil
+}
+
+func (self *ACLAuthorizer) CanPublish(clientID, userName, topic string) bool {
+	if strings.ContainsAny(topic, "+#") {
+		return false
+	}
+	return self.check(clientID, userName, topic, ACLWrite)
+}
+
+func (self *ACLAuthorizer) CanSubscribe(clientID, userName, filter string) bool {
+	return self.check(clientID, userName, filter, ACLRead)
+}
+
+func (self *ACLAuthorizer) check(clientID, userName, filter string, access ACLAccess) bool {
+	for _, entry := range self.users[userName] {
+		if entry.Access&access == access && FilterCovers(entry.Filter, filter) {
+			return true
+		}
+	}
+	for _, entry := range self.patterns {
+		pattern, ok := substituteACLPattern(entry.Filter, clientID, userName)
+		if ok && entry.Access&access == access && FilterCovers(pattern, filter) {
+			return true
+		}
+	}
+	return false
+}
+
+func substituteACLPattern(pattern, clientID, userName string) (string, bool) {
+	// the values must not widen the pattern
+	if strings.Contains(pattern, "%c") && strings.ContainsAny(clientID, "/+#") {
+		return "", false
+	}
+	if strings.Contains(pattern, "%u") && (len(userName) == 0 || strings.ContainsAny(userName, "/+#")) {
+		return "", false
+	}
+	pattern = strings.Replace(pattern, "%c", clientID, -1)
+	pattern = strings.Replace(pattern, "%u", userName, -1)
+	return pattern, true
+}
+
+// FilterCovers reports whether every topic matched by filter is also matched by acl.
+// filter can be a topic name without wildcards.
+func FilterCovers(acl, filter string) bool {
+	aParts, fParts := strings.Split(acl, "/"), strings.Split(filter, "/")
+	for i, a := range aParts {
+		if a == "#" {
+			// wildcards on the first level must not match topics beginning with '$'
+			return !(i == 0 && strings.HasPrefix(fParts[0], "$"))
+		}
+		if i >= len(fParts) {
+			return false
+		}
+		f := fParts[i]
+		switch {
+		case f == "#":
+			return false
+		case a == "+":
+			if i == 0 && strings.HasPrefix(f, "$") {
+				return false
+			}
+		case a != f:
+			return false
+		}
+	}
+	return len(aParts) == len(fParts)
+}
@@ -0,0 +1,271 @@
+package MQTTg
+
+import (
+	"golang.org/x/crypto/bcrypt"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"testing"
+)
+
+func writeTestHtpasswd(t *testing.T, users map[string]string) string {
+	data := "# test users\n\n"
+	for name, passwd := range users {
+		hash, err := bcrypt.GenerateFromPassword([]byte(passwd), bcrypt.MinCost)
+		if err != nil {
+			t.Fatal(err)
+		}
+		data += name + ":" + string(hash) + "\n"
+	}
+	path := filepath.Join(t.TempDir(), "htpasswd")
+	if err := ioutil.WriteFile(path, []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestHtpasswdAuthenticator(t *testing.T) {
+	path := writeTestHtpasswd(t, map[string]string{"daiki": "pass", "sensor": "secret"})
+	auth, err := NewHtpasswdAuthenticator(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name     string
+		passwd   string
+		anon     bool
+		expected ConnectReturnCode
+	}{
+		{"daiki", "pass", false, Accepted},
+		{"sensor", "secret", false, Accepted},
+		{"daiki", "secret", false, BadUserNameOrPassword},
+		{"unknown", "pass", false, BadUserNameOrPassword},
+		{"", "", false, NotAuthorized},
+		{"", "", true, Accepted},
+	}
+	for _, test := range tests {
+		auth.AllowAnonymous = test.anon
+		actual := auth.Authenticate("id", test.name, test.passwd, nil)
+		if actual != test.expected {
+			t.Errorf("%s:%s got %v\nwant %v", test.name, test.passwd, actual, test.expected)
+		}
+	}
+
+	invalid := filepath.Join(t.TempDir(), "htpasswd")
+	ioutil.WriteFile(invalid, []byte("daiki:{SHA}W6ph5Mm5Pz8GgiULbPgzG37mj9g=\n"), 0600)
+	if _, err := NewHtpasswdAuthenticator(invalid); err == nil {
+		t.Errorf("got nil\nwant error for non bcrypt hash")
+	}
+}
+
+func TestBrokerAuthenticate(t *testing.T) {
+	b, addr := startTestBroker(t)
+	auth, err := NewHtpasswdAuthenticator(writeTestHtpasswd(t, map[string]string{"daiki": "pass"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Authenticator = auth
+
+	tests := []struct {
+		user      *User
+		connected bool
+	}{
+		{NewUser("daiki", "pass"), true},
+		{NewUser("daiki", "wrong"), false},
+		{nil, false},
+	}
+	for i, test := range tests {
+		c := NewClient("auth-client", test.user, 0, nil)
+		if err := c.Connect(addr, true); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.IsConnecting || c.disconnected
+		})
+		if connected := c.isConnecting(); connected != test.connected {
+			t.Errorf("%d: got %v\nwant %v", i, connected, test.connected)
+		}
+		c.disconnectProcessing()
+		waitFor(func() bool {
+			_, ok := b.GetClient("auth-client")
+			return !ok
+		})
+	}
+}
+
+type codeAuthenticator ConnectReturnCode
+
+func (self codeAuthenticator) Authenticate(clientID, userName, password string, addr net.Addr) ConnectReturnCode {
+	return ConnectReturnCode(self)
+}
+
+func TestBrokerAuthenticateUnknownCode(t *testing.T) {
+	if code := ConnectReturnCode(6).ReasonCode(); code != ReasonUnspecifiedError {
+		t.Errorf("got %v\nwant %v", code, ReasonUnspecifiedError)
+	}
+	b, addr := startTestBroker(t)
+	b.Authenticator = codeAuthenticator(6)
+	for _, level := range []uint8{MQTT_3_1_1.Level, MQTT_5_0.Level} {
+		c := NewClient("unknown-code", nil, 0, nil)
+		if level == MQTT_5_0.Level {
+			c.Protocol = MQTT_5_0
+		}
+		if err := c.Connect(addr, true); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.disconnected
+		})
+		if c.isConnecting() {
+			t.Errorf("level %d: got connected\nwant refused", level)
+		}
+		c.disconnectProcessing()
+	}
+	if n := b.stats.connectDenied.Load(); n != 2 {
+		t.Errorf("got %v\nwant %v", n, 2)
+	}
+}
+
+func TestFilterCovers(t *testing.T) {
+	tests := []struct {
+		acl      string
+		filter   string
+		expected bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/+", true},
+		{"a/+", "a/#", false},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/+/c", true},
+		{"a/#", "a/#", true},
+		{"a/b", "a/+", false},
+		{"#", "$SYS/uptime", false},
+		{"+/uptime", "$SYS/uptime", false},
+		{"$SYS/#", "$SYS/uptime", true},
+	}
+	for _, test := range tests {
+		actual := FilterCovers(test.acl, test.filter)
+		if actual != test.expected {
+			t.Errorf("%s covers %s: got %v\nwant %v", test.acl, test.filter, actual, test.expected)
+		}
+	}
+}
+
+func TestACLAuthorizer(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "acl")
+	ioutil.WriteFile(path, []byte(`# anonymous
+topic read public/#
+
+user daiki
+topic sensors/#
+topic read $SYS/#
+
+pattern write devices/%c/#
+pattern read users/%u/+
+`), 0600)
+	acl, err := NewACLAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		clientID  string
+		userName  string
+		topic     string
+		publish   bool
+		subscribe bool
+	}{
+		{"anon", "", "public/news", false, true},
+		{"anon", "", "sensors/temp", false, false},
+		{"id", "daiki", "sensors/temp", true, true},
+		{"id", "daiki", "sensors/#", false, true},
+		{"id", "daiki", "public/news", false, false},
+		{"id", "daiki", "$SYS/broker/uptime", false, true},
+		{"dev-1", "", "devices/dev-1/temp", true, false},
+		{"dev-1", "", "devices/dev-2/temp", false, false},
+		{"dev/+", "", "devices/dev/x/temp", false, false},
+		{"id", "daiki", "users/daiki/inbox", false, true},
+		{"id", "other", "users/daiki/inbox", false, false},
+		{"id", "", "users//inbox", false, false},
+	}
+	for _, test := range tests {
+		if actual := acl.CanPublish(test.clientID, test.userName, test.topic); actual != test.publish {
+			t.Errorf("publish %s by %s/%s: got %v\nwant %v", test.topic, test.clientID, test.userName, actual, test.publish)
+		}
+		if actual := acl.CanSubscribe(test.clientID, test.userName, test.topic); actual != test.subscribe {
+			t.Errorf("subscribe %s by %s/%s: got %v\nwant %v", test.topic, test.clientID, test.userName, actual, test.subscribe)
+		}
+	}
+
+	ioutil.WriteFile(path, []byte("topic reed a/b\n"), 0600)
+	if _, err := NewACLAuthorizer(path); err == nil {
+		t.Errorf("got nil\nwant error for invalid access")
+	}
+}
+
+func TestBrokerAuthorize(t *testing.T) {
+	b, addr := startTestBroker(t)
+	path := filepath.Join(t.TempDir(), "acl")
+	ioutil.WriteFile(path, []byte("topic read allowed/#\n"), 0600)
+	acl, err := NewACLAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Authorizer = acl
+
+	c := NewClient("acl-client", nil, 0, nil)
+	if err := c.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("allowed/#", 1), NewSubscribeTopic("denied/#", 1)})
+	// publish is not allowed, but it is acknowledged
+	c.Publish("allowed/retain", "data", 1, true)
+	ok := waitFor(func() bool {
+		c.mu.Lock()
+		defer c.mu.Unlock()
+		return len(c.PacketIDMap) == 0
+	})
+	if !ok {
+		t.Errorf("unauthorized PUBLISH was not acknowledged")
+	}
+	if _, ok := b.TopicRoot.GetSubscribers("allowed/a")["acl-client"]; !ok {
+		t.Errorf("allowed/# should be subscribed")
+	}
+	if _, ok := b.TopicRoot.GetSubscribers("denied/a")["acl-client"]; ok {
+		t.Errorf("denied/# should not be subscribed")
+	}
+	if retained, _ := b.RetainStore.Get("allowed/retain"); retained != nil {
+		t.Errorf("unauthorized retain message is stored")
+	}
+	c.disconnectProcessing()
+}
+
+func TestNewBrokerAllowAnonymous(t *testing.T) {
+	path := writeTestHtpasswd(t, map[string]string{"daiki": "pass"})
+	for _, anon := range []bool{false, true} {
+		config := DefaultBrokerConfig()
+		config.Auth = AuthConfig{PasswordFile: path, AllowAnonymous: anon}
+		b, err := NewBroker(config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := NotAuthorized
+		if anon {
+			expected = Accepted
+		}
+		if actual := b.Authenticator.Authenticate("id", "", "", nil); actual != expected {
+			t.Errorf("allow_anonymous %v: got %v\nwant %v", anon, actual, expected)
+		}
+	}
+}
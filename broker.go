@@ -1,9 +1,14 @@
 package MQTTg
 
 import (
-	"fmt"
+	"context"
+	"crypto/tls"
+	"errors"
+	"io"
+	"log/slog"
 	"net"
 	"strconv"
+	"sync"
 	"time"
 )
 
@@ -12,75 +17,421 @@ type Broker struct {
 	// TODO: check whether not good to use addr as key
 	Clients   map[string]*BrokerSideClient //map[clientID]*BrokerSideClient
 	TopicRoot *TopicNode
+	// Authenticator checks CONNECT, every client is accepted when this is nil
+	Authenticator Authenticator
+	// Authorizer checks PUBLISH and SUBSCRIBE, every topic is allowed when this is nil
+	Authorizer Authorizer
+	// SessionStore keeps CleanSession=false sessions over restarts,
+	// they are lost with the process when this is nil
+	SessionStore SessionStore
+	// OfflineQueue limits the messages queued for each offline CleanSession=false client,
+	// and the ones waiting for the window of MaxInflight
+	OfflineQueue OfflineQueueConfig
+	// RetainStore keeps the retained messages, MemoryRetainStore is used when this is nil
+	RetainStore RetainStore
+	// MaxInflight is the window of the packet identifiers for each client, the messages
+	// over it are queued within OfflineQueue. 0 means DefaultMaxInflight
+	MaxInflight int
+	// Listeners are served by Run
+	Listeners []ListenerConfig
+	// MaxPacketSize closes the connection which sends a larger packet,
+	// 0 means no limit. It is told to MQTT 5.0 clients by CONNACK
+	MaxPacketSize uint32
+	// SysInterval is the interval to publish the statistics under $SYS/broker/,
+	// they are not published when this is 0
+	SysInterval time.Duration
+	// Logger is used for the broker and its connections,
+	// the logger of SetLogger is used when this is nil
+	Logger *slog.Logger
+	// FrameDebug logs the frames of the connections at slog.LevelDebug
+	FrameDebug bool
+	// mu guards Clients, listeners, conns and closed
+	mu       sync.RWMutex
+	initOnce sync.Once
+	initErr  error
+	// listeners and conns are closed by Shutdown
+	listeners map[net.Listener]struct{}
+	conns     map[*BrokerSideClient]struct{}
+	closed    bool
+	// loops are ReadLoop and WriteLoop of every connection
+	loops sync.WaitGroup
+	// closers are the stores opened by NewBroker
+	closers []io.Closer
+	stats   brokerStats
+	// sysRetain keeps the last $SYS messages, sysQuit stops sysLoop
+	sysRetain *MemoryRetainStore
+	sysQuit   chan struct{}
+}
+
+func (self *Broker) GetClient(clientID string) (*BrokerSideClient, bool) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	c, ok := self.Clients[clientID]
+	return c, ok
+}
+
+// deleteClient removes the client only when it is still the registered one,
+// a new connection may have taken over the client ID.
+func (self *Broker) deleteClient(client *BrokerSideClient) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.removeClient(client)
+}
+
+// removeClient needs mu to be held, it returns false when the client is not registered.
+func (self *Broker) removeClient(client *BrokerSideClient) bool {
+	if c, ok := self.Clients[client.ID]; ok && c == client {
+		delete(self.Clients, client.ID)
+		// the session ends with the connection, the next client of the ID
+		// must not inherit the subscriptions
+		client.mu.Lock()
+		for _, t := range client.SubTopics {
+			self.TopicRoot.DeleteSubscriber(client.ID, t.Topic)
+		}
+		client.SubTopics = nil
+		client.mu.Unlock()
+		return true
+	}
+	return false
 }
 
 func (self *Broker) Start() error {
-	addr, err := GetLocalAddr()
-	fmt.Println(addr)
+	listener, err := self.listen(MQTT_PORT)
+	if err != nil {
+		return err
+	}
+	return self.Serve(listener)
+}
+
+// StartTLS serves MQTT over TLS with the certificate and key pair.
+// When clientCAFile is not empty, clients must present a certificate signed by it.
+func (self *Broker) StartTLS(certFile, keyFile, clientCAFile string) error {
+	config, err := NewServerTLSConfig(certFile, keyFile, clientCAFile)
 	if err != nil {
 		return err
 	}
+	listener, err := self.listen(MQTT_TLS_PORT)
+	if err != nil {
+		return err
+	}
+	return self.Serve(tls.NewListener(listener, config))
+}
+
+func (self *Broker) listen(port int) (*net.TCPListener, error) {
+	addr, err := GetLocalAddr(port)
+	if err != nil {
+		return nil, err
+	}
+	self.logger().Info("listening", "addr", addr.String())
 	self.MyAddr = addr
 	listener, err := net.ListenTCP("tcp4", addr)
 	if err != nil {
 		// TODO: use channel to return error
+		return nil, err
+	}
+	return listener, nil
+}
+
+// initialize is called once before the first connection is served.
+func (self *Broker) initialize() error {
+	self.initOnce.Do(func() {
+		if self.RetainStore == nil {
+			self.RetainStore = NewMemoryRetainStore()
+		}
+		self.stats.started = time.Now()
+		self.sysRetain = NewMemoryRetainStore()
+		self.initErr = self.restoreSessions()
+		if self.initErr != nil || self.SysInterval <= 0 {
+			return
+		}
+		self.mu.Lock()
+		defer self.mu.Unlock()
+		if !self.closed {
+			self.sysQuit = make(chan struct{})
+			self.loops.Add(1)
+			go func(quit chan struct{}) {
+				defer self.loops.Done()
+				self.sysLoop(quit)
+			}(self.sysQuit)
+		}
+	})
+	return self.initErr
+}
+
+// restoreSessions registers the stored sessions as offline clients,
+// so that their subscriptions work before they reconnect.
+func (self *Broker) restoreSessions() error {
+	if self.SessionStore == nil {
+		return nil
+	}
+	sessions, err := self.SessionStore.LoadAll()
+	if err != nil {
+		return err
+	}
+	now := time.Now()
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	for _, s := range sessions {
+		if _, ok := self.Clients[s.ClientID]; ok {
+			continue
+		}
+		expiresAt := s.ExpiresAt
+		if expiresAt.IsZero() {
+			// the broker stopped without the disconnect processing of the client
+			expiresAt = sessionExpiresAt(s.ExpiryInterval, now)
+		}
+		if !expiresAt.IsZero() && !expiresAt.After(now) {
+			// expired while the broker was stopped
+			self.emitError(self.SessionStore.Delete(s.ClientID))
+			continue
+		}
+		bc := NewBrokerSideClient(nil, self)
+		bc.ID = s.ClientID
+		bc.SubTopics = s.Subscriptions
+		bc.PacketIDMap = s.Inflight
+		bc.queue = s.Queue
+		for _, pub := range s.Queue {
+			bc.queueBytes += queuedSize(pub)
+		}
+		bc.disconnected = true
+		bc.sessionExpiry = s.ExpiryInterval
+		bc.expireAt(expiresAt)
+		close(bc.LoopQuit)
+		for _, t := range s.Subscriptions {
+			_, _, err := self.TopicRoot.ApplySubscriber(s.ClientID, t.Topic, t.QoS)
+			self.emitError(err)
+		}
+		self.Clients[s.ClientID] = bc
+	}
+	return nil
+}
+
+// retain replaces the retained message of the topic, an empty payload deletes it.
+func (self *Broker) retain(topic string, qos uint8, payload []byte) {
+	if len(payload) == 0 {
+		self.emitError(self.RetainStore.Delete(topic))
+		return
+	}
+	self.emitError(self.RetainStore.Set(NewRetainedMessage(topic, qos, payload)))
+}
+
+// Serve accepts the connections until the listener is closed,
+// it returns BROKER_CLOSED after Shutdown.
+func (self *Broker) Serve(listener net.Listener) error {
+	if err := self.initialize(); err != nil {
 		return err
 	}
+	if !self.trackListener(listener) {
+		listener.Close()
+		return BROKER_CLOSED
+	}
+	defer self.untrackListener(listener)
 	for {
-		conn, err := listener.AcceptTCP()
+		conn, err := listener.Accept()
 		if err != nil {
+			if self.isClosed() {
+				return BROKER_CLOSED
+			}
+			if errors.Is(err, net.ErrClosed) {
+				return err
+			}
 			// TODO: use channel to return error
-			EmitError(err)
+			self.emitError(err)
 			continue
 		}
-		bc := NewBrokerSideClient(&Transport{conn}, self)
-		go bc.ReadLoop(bc) // TODO: use single Loop function
-		go bc.WriteLoop()
+		self.serveConn(conn)
 	}
 }
 
+func (self *Broker) serveConn(conn net.Conn) {
+	conn = &statsConn{Conn: conn, stats: &self.stats}
+	t := &Transport{
+		conn:          conn,
+		MaxPacketSize: self.MaxPacketSize,
+		FrameDebug:    self.FrameDebug,
+		logger:        self.Logger,
+		stats:         &self.stats,
+	}
+	bc := NewBrokerSideClient(t, self)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		// accepted while Shutdown was closing the listeners
+		conn.Close()
+		return
+	}
+	if self.conns == nil {
+		self.conns = make(map[*BrokerSideClient]struct{})
+	}
+	self.conns[bc] = struct{}{}
+	// Add is under mu, so that it does not race with Wait of Shutdown
+	self.loops.Add(2)
+	go func() { // TODO: use single Loop function
+		defer self.loops.Done()
+		bc.ReadLoop(bc)
+		self.mu.Lock()
+		delete(self.conns, bc)
+		self.mu.Unlock()
+	}()
+	go func() {
+		defer self.loops.Done()
+		bc.WriteLoop(bc)
+	}()
+}
+
+func (self *Broker) trackListener(listener net.Listener) bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.closed {
+		return false
+	}
+	if self.listeners == nil {
+		self.listeners = make(map[net.Listener]struct{})
+	}
+	self.listeners[listener] = struct{}{}
+	return true
+}
+
+func (self *Broker) untrackListener(listener net.Listener) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.listeners, listener)
+}
+
+func (self *Broker) isClosed() bool {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.closed
+}
+
+// Shutdown stops accepting, closes every connection and waits for their loops.
+// The connections are closed without DISCONNECT from the clients, so their wills
+// are published, and CleanSession=false sessions are saved to SessionStore.
+// The stores opened by NewBroker are closed at last. When ctx is done first,
+// Shutdown returns its error and the stores are left open.
+func (self *Broker) Shutdown(ctx context.Context) error {
+	self.mu.Lock()
+	self.closed = true
+	if self.sysQuit != nil {
+		close(self.sysQuit)
+		self.sysQuit = nil
+	}
+	listeners := make([]net.Listener, 0, len(self.listeners))
+	for l := range self.listeners {
+		listeners = append(listeners, l)
+	}
+	conns := make([]*BrokerSideClient, 0, len(self.conns))
+	for bc := range self.conns {
+		conns = append(conns, bc)
+	}
+	self.mu.Unlock()
+
+	for _, l := range listeners {
+		l.Close()
+	}
+	// ReadLoop does the disconnect processing when the connection is closed,
+	// so that it does not race with recvConnectMessage
+	for _, bc := range conns {
+		bc.Ct.conn.Close()
+	}
+
+	done := make(chan struct{})
+	go func() {
+		self.loops.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	var err error
+	for _, c := range self.closers {
+		if cerr := c.Close(); err == nil {
+			err = cerr
+		}
+	}
+	self.closers = nil
+	return err
+}
+
 func (self *BrokerSideClient) disconnectProcessing() (err error) {
-	w := self.Will
+	w, wasConnecting, first := self.beginDisconnect()
+	if !first {
+		// ReadLoop and the keep alive timer can race here
+		return nil
+	}
 	broker := self.Broker
 	if w != nil {
 		if w.Retain {
-			broker.TopicRoot.ApplyRetain(w.Topic, w.QoS, w.Message)
+			broker.retain(w.Topic, w.QoS, []byte(w.Message))
 		}
-		nodes, _ := broker.TopicRoot.GetTopicNodes(w.Topic, true)
-		for subscriberID, reqQoS := range nodes[0].Subscribers {
-			subscriber, _ := broker.Clients[subscriberID]
-			self.Broker.checkQoSAndPublish(subscriber, w.QoS, reqQoS, w.Retain, w.Topic, []uint8(w.Message))
+		for subscriberID, reqQoS := range broker.TopicRoot.GetSubscribers(w.Topic) {
+			subscriber, ok := broker.GetClient(subscriberID)
+			if !ok {
+				continue
+			}
+			noLocal, retainAsPublished := subscriber.deliveryOptions(w.Topic)
+			if noLocal && subscriber.ID == self.ID {
+				continue
+			}
+			self.Broker.checkQoSAndPublish(subscriber, w.QoS, reqQoS, w.Retain && retainAsPublished, w.Topic, []uint8(w.Message))
 		}
 	}
-	if self.IsConnecting {
+	if wasConnecting {
 		self.KeepAliveTimer.Stop()
 		if self.CleanSession {
-			delete(broker.Clients, self.ID)
+			broker.deleteClient(self)
+		} else {
+			self.mu.Lock()
+			self.expireAt(sessionExpiresAt(self.sessionExpiry, time.Now()))
+			self.mu.Unlock()
+			self.saveSession()
 		}
 	}
-	err = self.disconnectBase()
+	err = self.closeTransport()
 	return err
 }
 
 func (self *Broker) checkQoSAndPublish(requestClient *BrokerSideClient, publisherQoS, requestedQoS uint8, retain bool, topic string, message []uint8) {
-	var id uint16 = 0
-	var err error
 	qos := publisherQoS
 	if requestedQoS < publisherQoS {
 		// QoS downgrade
 		qos = requestedQoS
 	}
-	if qos > 0 {
-		id, err = requestClient.getUsablePacketID()
-		if err != nil {
-			panic(err)
+	self.publishTo(requestClient, NewPublishMessage(false, qos, retain, topic, 0, message))
+}
+
+// publishTo sends pub, or keeps it while the client cannot receive it now.
+func (self *Broker) publishTo(requestClient *BrokerSideClient, pub *PublishMessage) {
+	if requestClient.enqueue(pub) {
+		return
+	}
+	if pub.QoS > 0 {
+		// the broker does not wait for the window, a slow subscriber must not block the publisher
+		id, err := requestClient.getUsablePacketID()
+		if err == PACKET_ID_IS_EXHAUSTED && requestClient.queueForPacketID(pub) {
+			return
+		} else if err != nil {
+			requestClient.emitError(err)
+			return
 		}
+		pub.PacketID = id
+	}
+	err := requestClient.Send(pub)
+	if err != nil {
+		requestClient.releasePacketID(pub.PacketID)
+	}
+	if err == NOT_CONNECTED && requestClient.enqueue(pub) {
+		// the client has gone after enqueue was checked
+		return
 	}
-	pub := NewPublishMessage(false, qos, retain, topic, id, message)
-	requestClient.WriteChan <- pub
+	requestClient.emitError(err)
 }
 
 func (self *Broker) ApplyDummyClientID() string {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
 	return "DummyClientID:" + strconv.Itoa(len(self.Clients)+1)
 }
 
@@ -88,6 +439,23 @@ type BrokerSideClient struct {
 	*ClientInfo
 	SubTopics []*SubscribeTopic
 	Broker    *Broker
+	// queue keeps the messages while the CleanSession=false client is offline,
+	// these are guarded by mu
+	queue      []*PublishMessage
+	queueBytes int
+	// draining is kept until the queue is empty, the new messages are queued behind
+	draining bool
+	// drainBusy is set while drainQueue sends, drainAgain asks it to retry
+	// because a packet ID has been released
+	drainBusy  bool
+	drainAgain bool
+	// sessionExpiry is Session Expiry Interval of the connection, the session is
+	// deleted by expiryTimer at expiresAt while the client is offline. These are guarded by mu
+	sessionExpiry uint32
+	expiresAt     time.Time
+	expiryTimer   *time.Timer
+	// replaced is the client which has taken over the session, guarded by mu
+	replaced *BrokerSideClient
 }
 
 func NewBrokerSideClient(ct *Transport, broker *Broker) *BrokerSideClient {
@@ -103,82 +471,257 @@ func NewBrokerSideClient(ct *Transport, broker *Broker) *BrokerSideClient {
 			CleanSession:   false,
 			KeepAliveTimer: time.NewTimer(0),
 			Duration:       0,
+			LoopQuit:       make(chan bool),
 			WriteChan:      make(chan Message),
+			MaxInflight:    broker.MaxInflight,
+			log:            broker.Logger,
 		},
 		SubTopics: make([]*SubscribeTopic, 0),
 		Broker:    broker,
+		queue:     make([]*PublishMessage, 0),
 	}
 }
 
+// RunClientTimer is called by KeepAliveTimer when the client is silent for Duration
 func (self *BrokerSideClient) RunClientTimer() {
-	<-self.KeepAliveTimer.C
-	EmitError(CLIENT_TIMED_OUT)
+	self.emitError(CLIENT_TIMED_OUT)
 	self.disconnectProcessing()
 	// TODO: logging?
 }
 
 func (self *BrokerSideClient) setPreviousSession(prevSession *BrokerSideClient) {
+	prevSession.mu.Lock()
 	self.SubTopics = prevSession.SubTopics
+	for id, m := range prevSession.PacketIDMap {
+		self.PacketIDMap[id] = m
+	}
+	self.receivedIDs = prevSession.receivedIDs
+	self.queue, self.queueBytes = prevSession.queue, prevSession.queueBytes
+	prevSession.queue, prevSession.queueBytes = make([]*PublishMessage, 0), 0
+	prevSession.expireAt(time.Time{})
+	prevSession.replaced = self
+	prevSession.mu.Unlock()
+}
+
+// expireAt needs mu to be held. It replaces the timer deleting the offline session,
+// the session is kept when t is zero.
+func (self *BrokerSideClient) expireAt(t time.Time) {
+	if self.expiryTimer != nil {
+		self.expiryTimer.Stop()
+		self.expiryTimer = nil
+	}
+	self.expiresAt = t
+	if !t.IsZero() {
+		self.expiryTimer = time.AfterFunc(time.Until(t), self.expireSession)
+	}
+}
 
-	self.PacketIDMap = prevSession.PacketIDMap
-	self.CleanSession = prevSession.CleanSession
-	self.Will = prevSession.Will
-	self.Duration = prevSession.Duration
-	self.KeepAliveTimer = time.NewTimer(self.Duration)
-	self.KeepAlive = prevSession.KeepAlive
-	// TODO: authorize here
-	self.User = prevSession.User
+// expireSession deletes the session unless another connection has taken it over.
+func (self *BrokerSideClient) expireSession() {
+	broker := self.Broker
+	broker.mu.Lock()
+	defer broker.mu.Unlock()
+	if !broker.removeClient(self) {
+		return
+	}
+	self.mu.Lock()
+	self.queue, self.queueBytes = nil, 0
+	self.mu.Unlock()
+	if broker.SessionStore != nil {
+		// under the lock of the broker, the session of a new connection is not deleted
+		self.emitError(broker.SessionStore.Delete(self.ID))
+	}
+}
+
+// session returns a snapshot of the subscriptions and the in-flight messages.
+func (self *BrokerSideClient) session() *Session {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return copySession(&Session{
+		ClientID:       self.ID,
+		Subscriptions:  self.SubTopics,
+		Inflight:       self.PacketIDMap,
+		Queue:          self.queue,
+		ExpiryInterval: self.sessionExpiry,
+		ExpiresAt:      self.expiresAt,
+	})
+}
+
+// saveSession stores the session of CleanSession=false client.
+// The in-flight messages are saved when the client disconnects,
+// the queued messages are saved while the client is offline.
+func (self *BrokerSideClient) saveSession() {
+	if self.Broker.SessionStore == nil || self.CleanSession {
+		return
+	}
+	self.emitError(self.Broker.SessionStore.Save(self.session()))
+}
+
+// deliveryOptions combines the options of MQTT 5.0 of the subscriptions matching
+// the topic. The message of the client itself is not sent only when every one has
+// No Local, and RETAIN of the message is kept when any one has Retain As Published.
+func (self *BrokerSideClient) deliveryOptions(topic string) (noLocal, retainAsPublished bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	noLocal = true
+	for _, t := range self.SubTopics {
+		if matchFilter(t.Topic, topic) {
+			noLocal = noLocal && t.NoLocal
+			retainAsPublished = retainAsPublished || t.RetainAsPublished
+		}
+	}
+	return noLocal, retainAsPublished
+}
+
+func (self *BrokerSideClient) authenticate(m *ConnectMessage) ConnectReturnCode {
+	if self.Broker.Authenticator == nil {
+		return Accepted
+	}
+	var name, passwd string
+	if m.User != nil {
+		name, passwd = m.User.Name, m.User.Passwd
+	}
+	code := self.Broker.Authenticator.Authenticate(m.ClientID, name, passwd, self.Ct.conn.RemoteAddr())
+	if code > NotAuthorized {
+		// the code undefined in MQTT 3.1.1 is refused as well
+		return NotAuthorized
+	}
+	return code
+}
+
+func (self *BrokerSideClient) userName() string {
+	if self.User == nil {
+		return ""
+	}
+	return self.User.Name
+}
+
+func (self *BrokerSideClient) canPublish(topic string) bool {
+	if self.Broker.Authorizer == nil {
+		return true
+	}
+	if !self.Broker.Authorizer.CanPublish(self.ID, self.userName(), topic) {
+		self.Broker.stats.publishDenied.Add(1)
+		return false
+	}
+	return true
+}
+
+func (self *BrokerSideClient) canSubscribe(filter string) bool {
+	if self.Broker.Authorizer == nil {
+		return true
+	}
+	if !self.Broker.Authorizer.CanSubscribe(self.ID, self.userName(), filter) {
+		self.Broker.stats.subscribeDenied.Add(1)
+		return false
+	}
+	return true
 }
 
 func (self *BrokerSideClient) recvConnectMessage(m *ConnectMessage) (err error) {
 	// NOTICE: when connection error is sent to client, self.Ct.SendMessage()
 	//         should be used for avoiding Isconnecting validation
-	if m.Protocol.Name != MQTT_3_1_1.Name {
+	if m.Protocol.Name != MQTT_3_1_1.Name && m.Protocol.Name != MQTT_3_1.Name {
 		// server MAY disconnect
 		self.disconnectProcessing()
 		return INVALID_PROTOCOL_NAME
 	}
 
-	if m.Protocol.Level != MQTT_3_1_1.Level {
+	if !m.Protocol.supported() {
 		// CHECK: Is false correct?
 		err = self.Ct.SendMessage(NewConnackMessage(false, UnacceptableProtocolVersion))
 		self.disconnectProcessing()
 		return INVALID_PROTOCOL_LEVEL
 	}
+	// the frames of this connection are read and written in the level of the client
+	self.Ct.Level = m.Protocol.Level
+	v5 := m.Protocol.Level == MQTT_5_0.Level
 
+	if code := self.authenticate(m); code != Accepted {
+		self.Broker.stats.connectDenied.Add(1)
+		err = self.Ct.SendMessage(NewConnackMessage(false, code))
+		self.disconnectProcessing()
+		return code
+	}
+
+	// this is Clean Start in MQTT 5.0
+	cleanSession := m.Flags&CleanSession_Flag == CleanSession_Flag
+	// the session is kept after the disconnection when persistent
+	persistent := !cleanSession
+	expiry := SessionNeverExpires
+	if v5 {
+		expiry = 0
+		if p := m.Properties.Get(SessionExpiryInterval); p != nil {
+			expiry = p.Value.(uint32)
+		}
+		persistent = expiry != 0
+	}
+	if m.Protocol.Level == MQTT_3_1.Level && (len(m.ClientID) == 0 || len(m.ClientID) > MaxClientIDLength_3_1) {
+		err = self.Ct.SendMessage(NewConnackMessage(false, IdentifierRejected))
+		self.disconnectProcessing()
+		return INVALID_CLIENT_ID_LENGTH
+	}
+	if !v5 && !cleanSession && len(m.ClientID) == 0 {
+		err = self.Ct.SendMessage(NewConnackMessage(false, IdentifierRejected))
+		self.disconnectProcessing()
+		return CLEANSESSION_MUST_BE_TRUE
+	}
+	assignedID := len(m.ClientID) == 0
+	if assignedID {
+		m.ClientID = self.Broker.ApplyDummyClientID()
+	}
+
+	// look up and register under the same lock, so that two connections
+	// with the same client ID cannot both be accepted
+	self.Broker.mu.Lock()
 	c, ok := self.Broker.Clients[m.ClientID]
-	if ok && c.IsConnecting {
+	if ok && c.isConnecting() {
+		self.Broker.mu.Unlock()
 		// TODO: this might cause problem
 		// TODO; which should be disconnected, connecting one? or trying to connect one?
 		err = self.Ct.SendMessage(NewConnackMessage(false, IdentifierRejected))
 		self.disconnectProcessing()
 		return CLIENT_ID_IS_USED_ALREADY
 	}
-	cleanSession := m.Flags&CleanSession_Flag == CleanSession_Flag
-	if ok && !cleanSession {
-		self.setPreviousSession(c)
-	} else if !cleanSession && len(m.ClientID) == 0 {
-		err = self.Ct.SendMessage(NewConnackMessage(false, IdentifierRejected))
-		self.disconnectProcessing()
-		return CLEANSESSION_MUST_BE_TRUE
+	if ok && cleanSession {
+		// discard the previous session
+		for _, t := range c.SubTopics {
+			self.Broker.TopicRoot.DeleteSubscriber(c.ID, t.Topic)
+		}
+		c.mu.Lock()
+		c.expireAt(time.Time{})
+		c.mu.Unlock()
+	}
+	if ok && (cleanSession || !persistent) && self.Broker.SessionStore != nil {
+		// the stored session is not resumed, or ends with this connection
+		self.emitError(self.Broker.SessionStore.Delete(m.ClientID))
 	}
 
-	sessionPresent := ok
-	if cleanSession || !ok {
-		// TODO: need to manage QoS base processing
-		self.Duration = time.Duration(float32(m.KeepAlive)*1.5) * time.Second
-		if len(m.ClientID) == 0 {
-			m.ClientID = self.Broker.ApplyDummyClientID()
+	sessionPresent := ok && !cleanSession
+	// keep alive and will belong to the network connection, not to the session
+	// TODO: need to manage QoS base processing
+	self.Duration = time.Duration(float32(m.KeepAlive)*1.5) * time.Second
+	self.KeepAlive = m.KeepAlive
+	self.Will = m.Will
+	self.CleanSession = !persistent
+	self.mu.Lock()
+	self.ID = m.ClientID
+	self.sessionExpiry = expiry
+	// the client of MQTT 5.0 limits the QoS 1 and 2 messages sent at the same time
+	if p := m.Properties.Get(ReceiveMaximum); p != nil {
+		if max := int(p.Value.(uint16)); max > 0 && max < self.maxInflight() {
+			self.MaxInflight = max
 		}
-		self.ID = m.ClientID
-		self.User = m.User
-		self.KeepAlive = m.KeepAlive
-		self.Will = m.Will
-		self.CleanSession = cleanSession
-		self.KeepAliveTimer = time.NewTimer(self.Duration)
-		sessionPresent = false
+	}
+	self.mu.Unlock()
+	// the resumed session is also used by the user authenticated now
+	self.User = m.User
+	if ok && !cleanSession {
+		// the messages enqueued to the previous one after this go to this client
+		self.setPreviousSession(c)
 	}
 	self.Broker.Clients[m.ClientID] = self
+	self.Broker.mu.Unlock()
 
 	if m.Flags&Will_Flag == Will_Flag {
 		self.Will = m.Will
@@ -188,11 +731,18 @@ func (self *BrokerSideClient) recvConnectMessage(m *ConnectMessage) (err error)
 	}
 
 	if m.KeepAlive != 0 {
-		go self.RunClientTimer()
+		self.KeepAliveTimer = time.AfterFunc(self.Duration, self.RunClientTimer)
 	}
-	self.IsConnecting = true
+	self.saveSession()
+	self.setConnecting()
 	connack := NewConnackMessage(sessionPresent, Accepted)
-	self.WriteChan <- connack
+	if v5 && assignedID {
+		connack.Properties = append(connack.Properties, NewProperty(AssignedClientIdentifier, m.ClientID))
+	}
+	if v5 && self.Broker.MaxPacketSize > 0 {
+		connack.Properties = append(connack.Properties, NewProperty(MaximumPacketSize, self.Broker.MaxPacketSize))
+	}
+	err = self.Send(connack)
 	self.Redelivery()
 	return err
 }
@@ -207,28 +757,42 @@ func (self *BrokerSideClient) recvPublishMessage(m *PublishMessage) (err error)
 	} else {
 		// first time delivery
 	}
-
-	if m.Retain {
-		// store tehe application message to designated topic
-		data := string(m.Payload)
-		if m.QoS == 0 && len(data) > 0 {
-			// TODO: warnning, in this case data cannot be stored.
-			// discard retained message
-			data = ""
+	if m.QoS == 2 {
+		if stored := self.receivedPubrec(m.PacketID); stored != nil {
+			// the message was published already, only PUBREC is sent again
+			return self.Send(stored)
 		}
-		self.Broker.TopicRoot.ApplyRetain(m.TopicName, m.QoS, data)
 	}
 
-	nodes, err := self.Broker.TopicRoot.GetTopicNodes(m.TopicName, true)
-	if err != nil {
-		return err
+	// unauthorized message is dropped silently, but it is acknowledged
+	// so that the client does not redeliver it
+	authorized := self.canPublish(m.TopicName)
+	// reason code of MQTT 5.0
+	code := ReasonSuccess
+
+	if m.Retain && authorized {
+		// store the application message to designated topic
+		self.Broker.retain(m.TopicName, m.QoS, m.Payload)
 	}
-	for subscriberID, reqQoS := range nodes[0].Subscribers {
-		subscriber, ok := self.Broker.Clients[subscriberID]
-		if !ok {
-			continue
+
+	if !authorized {
+		code = ReasonNotAuthorized
+	} else {
+		subscribers := self.Broker.TopicRoot.GetSubscribers(m.TopicName)
+		if len(subscribers) == 0 {
+			code = ReasonNoMatchingSubscribers
+		}
+		for subscriberID, reqQoS := range subscribers {
+			subscriber, ok := self.Broker.GetClient(subscriberID)
+			if !ok {
+				continue
+			}
+			noLocal, retainAsPublished := subscriber.deliveryOptions(m.TopicName)
+			if noLocal && subscriberID == self.ID {
+				continue
+			}
+			self.Broker.checkQoSAndPublish(subscriber, m.QoS, reqQoS, m.Retain && retainAsPublished, m.TopicName, m.Payload)
 		}
-		self.Broker.checkQoSAndPublish(subscriber, m.QoS, reqQoS, false, m.TopicName, m.Payload)
 	}
 
 	switch m.QoS {
@@ -239,10 +803,12 @@ func (self *BrokerSideClient) recvPublishMessage(m *PublishMessage) (err error)
 		}
 	case 1:
 		puback := NewPubackMessage(m.PacketID)
-		self.WriteChan <- puback
+		puback.ReasonCode = code
+		err = self.Send(puback)
 	case 2:
 		pubrec := NewPubrecMessage(m.PacketID)
-		self.WriteChan <- pubrec
+		pubrec.ReasonCode = code
+		err = self.Send(pubrec)
 	}
 	return err
 }
@@ -251,6 +817,7 @@ func (self *BrokerSideClient) recvPubackMessage(m *PubackMessage) (err error) {
 	// acknowledge the sent Publish packet
 	if m.PacketID > 0 {
 		err = self.AckMessage(m.PacketID)
+		self.releasePacketID(m.PacketID)
 	}
 	return err
 }
@@ -262,57 +829,87 @@ func (self *BrokerSideClient) recvPubrecMessage(m *PubrecMessage) (err error) {
 		return err
 	}
 	pubrel := NewPubrelMessage(m.PacketID)
-	self.WriteChan <- pubrel
+	err = self.Send(pubrel)
 	return err
 }
 
 func (self *BrokerSideClient) recvPubrelMessage(m *PubrelMessage) (err error) {
-	// acknowledge the sent Pubrel packet
-	err = self.AckMessage(m.PacketID)
-	if err != nil {
-		return err
-	}
+	// the flow of the received QoS 2 PUBLISH is completed
 	pubcomp := NewPubcompMessage(m.PacketID)
-	self.WriteChan <- pubcomp
+	if err = self.releaseReceived(m.PacketID); err != nil {
+		// PUBCOMP is sent anyway, so that the sender stops sending PUBREL
+		pubcomp.ReasonCode = ReasonPacketIdentifierNotFound
+	}
+	self.emitError(self.Send(pubcomp))
 	return err
 }
 
 func (self *BrokerSideClient) recvPubcompMessage(m *PubcompMessage) (err error) {
 	// acknowledge the sent Pubrel packet
 	err = self.AckMessage(m.PacketID)
+	self.releasePacketID(m.PacketID)
 	return err
 }
 
 func (self *BrokerSideClient) recvSubscribeMessage(m *SubscribeMessage) (err error) {
 	// TODO: check The wild card is permitted
+	if self.Ct.Level == MQTT_3_1.Level {
+		// SUBACK of MQTT 3.1 cannot tell the failure, nothing is subscribed then
+		for _, subTopic := range m.SubscribeTopics {
+			if !self.canSubscribe(subTopic.Topic) {
+				self.disconnectProcessing()
+				return NOT_AUTHORIZED_TO_SUBSCRIBE
+			}
+		}
+	}
 	returnCodes := make([]SubscribeReturnCode, len(m.SubscribeTopics))
 	for i, subTopic := range m.SubscribeTopics {
 		// TODO: need to validate wheter there are same topics or not
-		edges, err := self.Broker.TopicRoot.GetTopicNodes(subTopic.Topic, true)
-		code := SubscribeReturnCode(subTopic.QoS)
-		if err != nil {
-			code = SubscribeFailure
-		} else {
-			for _, edge := range edges {
-				edge.Subscribers[self.ID] = subTopic.QoS
-				self.SubTopics = append(self.SubTopics,
-					&SubscribeTopic{SubscribeAck,
-						edge.FullPath,
-						uint8(subTopic.QoS),
-					})
-				if len(edge.RetainMessage) > 0 {
-					// publish retain
-					// TODO: check all arguments
-					self.Broker.checkQoSAndPublish(self, edge.RetainQoS, subTopic.QoS, true, edge.FullPath, []uint8(edge.RetainMessage))
-					EmitError(err)
-				}
+		if !self.canSubscribe(subTopic.Topic) {
+			returnCodes[i] = SubscribeFailure
+			if self.Ct.Level == MQTT_5_0.Level {
+				returnCodes[i] = SubscribeReturnCode(ReasonNotAuthorized)
 			}
+			continue
 		}
+		_, code, err := self.Broker.TopicRoot.ApplySubscriber(self.ID, subTopic.Topic, subTopic.QoS)
 		returnCodes[i] = code
+		if err != nil {
+			self.emitError(err)
+			continue
+		}
+		stored := *subTopic
+		stored.State = SubscribeAck
+		existed := false
+		self.mu.Lock()
+		for j, t := range self.SubTopics {
+			if t.Topic == subTopic.Topic {
+				// the subscription of the same filter is replaced
+				self.SubTopics[j], existed = &stored, true
+			}
+		}
+		if !existed {
+			self.SubTopics = append(self.SubTopics, &stored)
+		}
+		self.mu.Unlock()
+		if subTopic.RetainHandling == 2 || subTopic.RetainHandling == 1 && existed {
+			continue
+		}
+		// publish retain messages of the topics which exist now
+		retained, err := self.Broker.RetainStore.Match(subTopic.Topic)
+		self.emitError(err)
+		if self.Broker.sysRetain != nil {
+			sys, _ := self.Broker.sysRetain.Match(subTopic.Topic)
+			retained = append(retained, sys...)
+		}
+		for _, r := range retained {
+			self.Broker.checkQoSAndPublish(self, r.QoS, subTopic.QoS, true, r.Topic, r.Payload)
+		}
 	}
+	self.saveSession()
 	// TODO: check whether the number of return codes are correct?
 	suback := NewSubackMessage(m.PacketID, returnCodes)
-	self.WriteChan <- suback
+	err = self.Send(suback)
 	return err
 }
 
@@ -325,18 +922,33 @@ func (self *BrokerSideClient) recvUnsubscribeMessage(m *UnsubscribeMessage) (err
 	}
 
 	result := []*SubscribeTopic{}
-	for _, name := range m.TopicNames {
-		self.Broker.TopicRoot.DeleteSubscriber(self.ID, name)
-		for _, t := range self.SubTopics {
-			if string(t.Topic) == string(name) {
-				result = append(result, t)
+	codes := make([]ReasonCode, len(m.TopicNames))
+	for i, name := range m.TopicNames {
+		if err := self.Broker.TopicRoot.DeleteSubscriber(self.ID, name); err != nil {
+			self.emitError(err)
+			codes[i] = ReasonNoSubscriptionExisted
+		}
+	}
+	self.mu.Lock()
+	for _, t := range self.SubTopics {
+		unsubscribed := false
+		for _, name := range m.TopicNames {
+			if t.Topic == name {
+				unsubscribed = true
+				break
 			}
 		}
+		if !unsubscribed {
+			result = append(result, t)
+		}
 	}
 	self.SubTopics = result
+	self.mu.Unlock()
+	self.saveSession()
 	unsuback := NewUnsubackMessage(m.PacketID)
+	unsuback.ReasonCodes = codes
 
-	self.WriteChan <- unsuback
+	err = self.Send(unsuback)
 	return err
 }
 func (self *BrokerSideClient) recvUnsubackMessage(m *UnsubackMessage) (err error) {
@@ -348,10 +960,9 @@ func (self *BrokerSideClient) recvPingreqMessage(m *PingreqMessage) (err error)
 	// TODO: calc elapsed time from previous pingreq.
 	//       and store the time to duration of Transport
 	pingresp := NewPingrespMessage()
-	self.WriteChan <- pingresp
+	err = self.Send(pingresp)
 	if self.KeepAlive != 0 {
 		self.ResetTimer()
-		go self.RunClientTimer()
 	}
 	return err
 }
@@ -361,8 +972,33 @@ func (self *BrokerSideClient) recvPingrespMessage(m *PingrespMessage) (err error
 }
 
 func (self *BrokerSideClient) recvDisconnectMessage(m *DisconnectMessage) (err error) {
-	self.Will = nil
+	self.mu.Lock()
+	// MQTT 5.0 client can ask to publish the will
+	if m.ReasonCode != ReasonDisconnectWithWillMessage {
+		self.Will = nil
+	}
+	// and can change Session Expiry Interval, except the session which ends now
+	ended := false
+	if p := m.Properties.Get(SessionExpiryInterval); p != nil {
+		if expiry := p.Value.(uint32); self.sessionExpiry == 0 && expiry != 0 {
+			err = PROTOCOL_VIOLATION
+		} else {
+			ended = expiry == 0 && !self.CleanSession
+			self.sessionExpiry = expiry
+			self.CleanSession = expiry == 0
+		}
+	}
+	self.mu.Unlock()
+	if ended && self.Broker.SessionStore != nil {
+		self.emitError(self.Broker.SessionStore.Delete(self.ID))
+	}
 	self.disconnectProcessing()
 	// close the client
 	return err
 }
+
+func (self *BrokerSideClient) recvAuthMessage(m *AuthMessage) (err error) {
+	// TODO: support the extended authentication
+	self.disconnectProcessing()
+	return PROTOCOL_VIOLATION
+}
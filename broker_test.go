@@ -0,0 +1,291 @@
+package MQTTg
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func init() {
+	// the broker tests run many clients, the frames are not dumped
+	FrameDebug = false
+}
+
+func waitFor(cond func() bool) bool {
+	deadline := time.Now().Add(5 * time.Second)
+	for !cond() {
+		if time.Now().After(deadline) {
+			return false
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return true
+}
+
+// startTestBroker serves the broker configured by the options on a local port.
+func startTestBroker(t *testing.T, options ...func(b *Broker)) (*Broker, string) {
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTestBroker(t, listener, options...), listener.Addr().String()
+}
+
+// serveTestBroker shuts the broker down when the test ends,
+// so that its connections do not leak into the later tests.
+func serveTestBroker(t *testing.T, listener net.Listener, options ...func(b *Broker)) *Broker {
+	b := &Broker{
+		Clients:     make(map[string]*BrokerSideClient),
+		TopicRoot:   NewTopicNode("", ""),
+		RetainStore: NewMemoryRetainStore(),
+	}
+	for _, option := range options {
+		option(b)
+	}
+	go b.Serve(listener)
+	t.Cleanup(func() {
+		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+		if err := b.Shutdown(ctx); err != nil {
+			t.Errorf("Shutdown: %v", err)
+		}
+	})
+	return b
+}
+
+func TestBrokerConcurrentClients(t *testing.T) {
+	b, addr := startTestBroker(t)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 30; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			id := "client-" + strconv.Itoa(i)
+			c := NewClient(id, nil, 0, NewWill("load/will", id, false, 1))
+			if err := c.Connect(addr, true); err != nil {
+				t.Error(err)
+				return
+			}
+			if !waitFor(c.isConnecting) {
+				t.Errorf("%s could not connect", id)
+				return
+			}
+			c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("load/#", 2), NewSubscribeTopic("load/+", 1)})
+			for j := 0; j < 20; j++ {
+				c.Publish("load/"+id, "data", uint8(j%3), j%5 == 0)
+			}
+			c.Unsubscribe([]string{"load/+"})
+			if i%2 == 0 {
+				c.Disconnect()
+			} else {
+				// fire the will
+				c.disconnectProcessing()
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	ok := waitFor(func() bool {
+		b.mu.RLock()
+		defer b.mu.RUnlock()
+		return len(b.Clients) == 0
+	})
+	if !ok {
+		t.Errorf("got %d clients\nwant 0", len(b.Clients))
+	}
+}
+
+func TestBrokerCleanSessionSubscriptions(t *testing.T) {
+	b, addr := startTestBroker(t)
+	for i := 0; i < 2; i++ {
+		c := NewClient("clean-sub", nil, 0, nil)
+		if err := c.Connect(addr, true); err != nil {
+			t.Fatal(err)
+		}
+		waitFor(c.isConnecting)
+		if subscribers := b.TopicRoot.GetSubscribers("clean/a"); len(subscribers) != 0 {
+			t.Errorf("%d: got %v\nwant no subscribers", i, subscribers)
+		}
+		c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("clean/#", 0)}).Wait()
+		c.Disconnect()
+		waitFor(func() bool {
+			_, ok := b.GetClient("clean-sub")
+			return !ok
+		})
+	}
+	if subscribers := b.TopicRoot.GetSubscribers("clean/a"); len(subscribers) != 0 {
+		t.Errorf("got %v\nwant no subscribers", subscribers)
+	}
+}
+
+func TestBrokerMQTT31(t *testing.T) {
+	b, addr := startTestBroker(t)
+	long := NewClient("device-with-very-long-client-id", nil, 0, nil)
+	long.Protocol = MQTT_3_1
+	if err := long.Connect(addr, true); err != INVALID_CLIENT_ID_LENGTH {
+		t.Errorf("got %v\nwant %v", err, INVALID_CLIENT_ID_LENGTH)
+	}
+
+	legacy := NewClient("legacy-device", nil, 0, nil)
+	legacy.Protocol = MQTT_3_1
+	if err := legacy.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	current := NewClient("current-device", nil, 0, nil)
+	if err := current.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(legacy.isConnecting) || !waitFor(current.isConnecting) {
+		t.Fatal("could not connect")
+	}
+
+	legacy.Subscribe([]*SubscribeTopic{NewSubscribeTopic("shared/#", 1)})
+	ok := waitFor(func() bool { return len(b.TopicRoot.GetSubscribers("shared/a")) == 1 })
+	if !ok {
+		t.Fatalf("got %v\nwant 1 subscriber", b.TopicRoot.GetSubscribers("shared/a"))
+	}
+	current.Publish("shared/a", "data", 1, false)
+	legacy.Publish("shared/b", "data", 2, false)
+	acked := func(c *Client) func() bool {
+		return func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return len(c.PacketIDMap) == 0
+		}
+	}
+	if !waitFor(acked(current)) || !waitFor(acked(legacy)) {
+		t.Errorf("acknowledgements did not come")
+	}
+	legacy.disconnectProcessing()
+	current.disconnectProcessing()
+}
+
+func TestBrokerMQTT31IdentifierRejected(t *testing.T) {
+	_, addr := startTestBroker(t)
+	tr := NewTransport()
+	if err := tr.Connect(addr); err != nil {
+		t.Fatal(err)
+	}
+	connect := NewConnectMessage(0, "", true, nil, nil)
+	connect.Protocol = MQTT_3_1
+	tr.SendMessage(connect)
+	m, err := tr.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code := m.(*ConnackMessage).ReturnCode; code != IdentifierRejected {
+		t.Errorf("got %v\nwant %v", code, IdentifierRejected)
+	}
+}
+
+func TestBrokerShutdown(t *testing.T) {
+	addr, _ := net.ResolveTCPAddr("tcp4", "127.0.0.1:0")
+	listener, err := net.ListenTCP("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sessions := NewMemorySessionStore()
+	b := &Broker{
+		Clients:      make(map[string]*BrokerSideClient),
+		TopicRoot:    NewTopicNode("", ""),
+		RetainStore:  NewMemoryRetainStore(),
+		SessionStore: sessions,
+	}
+	served := make(chan error, 1)
+	go func() { served <- b.Serve(listener) }()
+
+	clients := []*Client{
+		NewClient("shutdown-will", nil, 0, NewWill("shutdown/will", "gone", true, 0)),
+		NewClient("shutdown-persistent", nil, 0, nil),
+	}
+	for i, c := range clients {
+		if err := c.Connect(listener.Addr().String(), i == 0); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(c.isConnecting) {
+			t.Fatal("could not connect")
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := b.Shutdown(ctx); err != nil {
+		t.Fatalf("got %v\nwant nil", err)
+	}
+	select {
+	case err := <-served:
+		if err != BROKER_CLOSED {
+			t.Errorf("got %v\nwant %v", err, BROKER_CLOSED)
+		}
+	case <-time.After(2 * time.Second):
+		t.Error("Serve did not return")
+	}
+	for _, c := range clients {
+		if !waitFor(func() bool { return !c.isConnecting() }) {
+			t.Errorf("%s: the connection is not closed", c.ID)
+		}
+	}
+	// the connection was closed without DISCONNECT, so the will is published
+	if m, _ := b.RetainStore.Get("shutdown/will"); m == nil {
+		t.Error("the will is not published")
+	}
+	stored, _ := sessions.LoadAll()
+	if len(stored) != 1 || stored[0].ClientID != "shutdown-persistent" {
+		t.Errorf("got %v\nwant the session of shutdown-persistent", stored)
+	}
+	if err := b.Serve(listener); err != BROKER_CLOSED {
+		t.Errorf("got %v\nwant %v", err, BROKER_CLOSED)
+	}
+}
+
+func TestBrokerMaxPacketSize(t *testing.T) {
+	b, addr := startTestBroker(t, func(b *Broker) { b.MaxPacketSize = 64 })
+	c := NewClient("large-packet", nil, 0, nil)
+	if err := c.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	c.Publish("large", "small", 0, false)
+	time.Sleep(50 * time.Millisecond)
+	if !c.isConnecting() {
+		t.Fatal("the small packet closed the connection")
+	}
+	c.Publish("large", string(make([]byte, 64)), 0, false)
+	if !waitFor(func() bool { return !c.isConnecting() }) {
+		t.Error("the connection is not closed")
+	}
+	if actual := b.stats.tooLarge.Load(); actual != 1 {
+		t.Errorf("got %v\nwant %v", actual, 1)
+	}
+}
+
+func TestBrokerEmptyTopicFilter(t *testing.T) {
+	_, addr := startTestBroker(t)
+	c := NewClient("empty-filter", nil, 0, nil)
+	if err := c.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	// the client refuses them before they are sent
+	if err := c.Subscribe(nil).Wait(); err != NO_TOPIC_FILTER_IN_PAYLOAD {
+		t.Errorf("got %v\nwant %v", err, NO_TOPIC_FILTER_IN_PAYLOAD)
+	}
+	if err := c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("", 0)}).Wait(); err != TOPIC_FILTER_IS_EMPTY {
+		t.Errorf("got %v\nwant %v", err, TOPIC_FILTER_IS_EMPTY)
+	}
+	if !c.isConnecting() {
+		t.Fatal("the refused SUBSCRIBE closed the connection")
+	}
+	c.Send(NewSubscribeMessage(1, []*SubscribeTopic{NewSubscribeTopic("", 0)}))
+	if !waitFor(func() bool { return !c.isConnecting() }) {
+		t.Error("the connection is not closed")
+	}
+}
@@ -1,10 +1,11 @@
 package MQTTg
 
 import (
-	"fmt"
+	"crypto/tls"
 	"io"
-	"math/rand"
+	"log/slog"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -33,11 +34,57 @@ type ClientInfo struct {
 	Duration       time.Duration
 	LoopQuit       chan bool
 	WriteChan      chan Message
+	// MaxInflight is the number of the packet identifiers which can be used
+	// at the same time, 0 means DefaultMaxInflight
+	MaxInflight int
+	// log is the logger of the Broker, the logger of the package is used when this is nil
+	log *slog.Logger
+	// mu guards PacketIDMap, IsConnecting, disconnected, packetIDs and receivedIDs,
+	// which are touched by ReadLoop, WriteLoop and the goroutines of other clients
+	mu           sync.Mutex
+	disconnected bool
+	packetIDs    packetIDs
+	// receivedIDs keeps PUBREC of the incoming QoS 2 PUBLISH until PUBREL comes.
+	// The identifiers are chosen by the peer, so they are kept apart from PacketIDMap
+	receivedIDs map[uint16]*PubrecMessage
 }
 
 type Client struct {
 	*ClientInfo
 	PingBegin time.Time
+	// Protocol is MQTT_3_1, MQTT_3_1_1 or MQTT_5_0
+	Protocol *Protocol
+	// Properties are sent with CONNECT in MQTT 5.0
+	Properties Properties
+	// MaxPacketSize closes the connection when the broker sends a larger packet,
+	// 0 means no limit. It is told to the broker by CONNECT of MQTT 5.0
+	MaxPacketSize uint32
+	// OnMessage is called with the PUBLISH which no handler of Subscribe matches
+	OnMessage MessageHandler
+	// handlers are guarded by mu, map[filter]MessageHandler
+	handlers map[string]MessageHandler
+	inbox    *inbox
+	// tokens are guarded by mu, map[packetID]*Token
+	tokens map[uint16]*Token
+	// subscriptions are guarded by mu, they are sent again on the reconnection
+	subscriptions map[string]*SubscribeTopic
+
+	// AutoReconnect dials the broker again when the connection is lost.
+	// The delay begins from MinReconnectDelay and is doubled up to MaxReconnectDelay.
+	AutoReconnect     bool
+	MinReconnectDelay time.Duration
+	MaxReconnectDelay time.Duration
+	// OnConnectionLost and OnReconnect are called in their own goroutines
+	OnConnectionLost func(client *Client)
+	OnReconnect      func(client *Client)
+	// dial, closing, established, reconnecting and reconnectAttempt are guarded by mu
+	dial             func() (*Transport, error)
+	closing          bool
+	established      bool
+	reconnecting     bool
+	reconnectAttempt int
+	// loops are ReadLoop, WriteLoop and StartPingLoop of the current connection
+	loops sync.WaitGroup
 }
 
 func NewClient(id string, user *User, keepAlive uint16, will *Will) *Client {
@@ -56,6 +103,11 @@ func NewClient(id string, user *User, keepAlive uint16, will *Will) *Client {
 			LoopQuit:       nil,
 			WriteChan:      nil,
 		},
+		Protocol: MQTT_3_1_1,
+		handlers: make(map[string]MessageHandler),
+		tokens:   make(map[uint16]*Token),
+
+		subscriptions: make(map[string]*SubscribeTopic),
 	}
 }
 
@@ -74,8 +126,6 @@ func (self *Client) StartPingLoop() {
 			return
 		}
 	}
-	t.Stop()
-
 }
 
 type Edge interface {
@@ -93,18 +143,21 @@ type Edge interface {
 	recvPingreqMessage(*PingreqMessage) error
 	recvPingrespMessage(*PingrespMessage) error
 	recvDisconnectMessage(*DisconnectMessage) error
+	recvAuthMessage(*AuthMessage) error
 	disconnectProcessing() error
+	// dropMessage is called when WriteLoop cannot send the message
+	dropMessage(m Message, err error)
 }
 
 func (self *ClientInfo) ReadLoop(edge Edge) (err error) {
 	for {
 		m, err := self.Ct.ReadMessage()
-		EmitError(err)
-		if err == io.EOF {
-			EmitError(edge.disconnectProcessing())
-			return err
-		} else if err != nil {
-			// ?
+		if err != nil {
+			// EOF, reset by peer or broken frame, the stream cannot be continued
+			if err != io.EOF {
+				self.emitError(err)
+			}
+			self.emitError(edge.disconnectProcessing())
 			return err
 		}
 		if m != nil {
@@ -137,147 +190,337 @@ func (self *ClientInfo) ReadLoop(edge Edge) (err error) {
 				err = edge.recvPingrespMessage(m)
 			case *DisconnectMessage:
 				err = edge.recvDisconnectMessage(m)
+			case *AuthMessage:
+				err = edge.recvAuthMessage(m)
 			}
 		}
-		EmitError(err)
+		self.emitError(err)
 	}
-	return
 }
 
-func (self *ClientInfo) WriteLoop() (err error) {
-	for m := range self.WriteChan {
-		if !self.IsConnecting {
-			return NOT_CONNECTED
-		}
-		id := m.GetPacketID()
-		_, ok := self.PacketIDMap[id]
-		if ok {
-			return PACKET_ID_IS_USED_ALREADY
+// maxWriteBatch is the number of the waiting messages written by a single Write.
+const maxWriteBatch = 32
+
+func (self *ClientInfo) WriteLoop(edge Edge) (err error) {
+	batch := make([]Message, 0, maxWriteBatch)
+	for {
+		var m Message
+		select {
+		case m = <-self.WriteChan:
+		case <-self.LoopQuit:
+			return nil
 		}
-		switch m.(type) {
-		case *PublishMessage:
-			if id > 0 {
-				self.PacketIDMap[id] = m
+		batch = batch[:0]
+		for m != nil {
+			if err = self.registerPacketID(m); err != nil {
+				self.emitError(err)
+				edge.dropMessage(m, err)
+			} else {
+				batch = append(batch, m)
 			}
-		case *PubrecMessage, *PubrelMessage, *SubscribeMessage, *UnsubscribeMessage:
-			if id == 0 {
-				return PACKET_ID_SHOULD_NOT_BE_ZERO
+			m = nil
+			if len(batch) < maxWriteBatch {
+				select {
+				case m = <-self.WriteChan:
+				default:
+				}
 			}
-			self.PacketIDMap[id] = m
+		}
+		if len(batch) == 0 {
+			continue
 		}
 
-		err = self.Ct.SendMessage(m)
+		err = self.Ct.SendMessages(batch...)
 		if err != nil {
-			EmitError(err)
-			return err
+			// the peer has gone away, ReadLoop does the disconnect processing when the
+			// connection is closed. Send is not blocked until LoopQuit is closed by it.
+			self.emitError(err)
+			self.Ct.conn.Close()
+			for {
+				select {
+				case m := <-self.WriteChan:
+					edge.dropMessage(m, NOT_CONNECTED)
+				case <-self.LoopQuit:
+					return err
+				}
+			}
 		}
 	}
-	return
 }
 
-func (self *ClientInfo) getUsablePacketID() (uint16, error) {
-	ok := true
-	var id uint16
-	for trial := 0; ok; trial++ {
-		if trial == 5 {
-			return 0, FAIL_TO_SET_PACKET_ID
+// Send passes the message to WriteLoop. It returns NOT_CONNECTED
+// instead of blocking when the connection has already been closed.
+func (self *ClientInfo) Send(m Message) error {
+	// the channels are replaced when the client reconnects
+	self.mu.Lock()
+	writeChan, quit := self.WriteChan, self.LoopQuit
+	self.mu.Unlock()
+	select {
+	case writeChan <- m:
+		return nil
+	case <-quit:
+		return NOT_CONNECTED
+	}
+}
+
+func (self *ClientInfo) dropMessage(m Message, err error) {
+	self.releaseDropped(m)
+}
+
+// releaseDropped releases the packet ID of the message which is not sent.
+// It returns false when the ID is not of the message, or when the message is
+// kept in PacketIDMap to be redelivered.
+func (self *ClientInfo) releaseDropped(m Message) bool {
+	switch m.(type) {
+	case *PublishMessage, *SubscribeMessage, *UnsubscribeMessage:
+	default:
+		return false
+	}
+	id := m.GetPacketID()
+	if id == 0 {
+		return false
+	}
+	self.mu.Lock()
+	_, stored := self.PacketIDMap[id]
+	self.mu.Unlock()
+	if stored {
+		return false
+	}
+	self.releasePacketID(id)
+	return true
+}
+
+// dropMessage fails the token of the message, the next request is not blocked by its ID.
+func (self *Client) dropMessage(m Message, err error) {
+	if self.releaseDropped(m) {
+		self.resolveToken(m.GetPacketID(), err, nil)
+	}
+}
+
+func (self *ClientInfo) registerPacketID(m Message) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if !self.IsConnecting {
+		return NOT_CONNECTED
+	}
+	id := m.GetPacketID()
+	switch m := m.(type) {
+	case *PubrecMessage:
+		return self.registerReceivedID(m)
+	case *PublishMessage, *PubrelMessage, *SubscribeMessage, *UnsubscribeMessage:
+		if id == 0 {
+			if _, ok := m.(*PublishMessage); ok {
+				// QoS 0
+				return nil
+			}
+			return PACKET_ID_SHOULD_NOT_BE_ZERO
+		}
+		if stored, ok := self.PacketIDMap[id]; ok && stored != m {
+			// the same message is sent again when it is redelivered
+			return PACKET_ID_IS_USED_ALREADY
 		}
-		id = uint16(1 + rand.Int31n(65535))
-		_, ok = self.PacketIDMap[id]
+		self.PacketIDMap[id] = m
 	}
-	return id, nil
+	// PUBACK and PUBCOMP use the identifiers of the incoming flows
+	return nil
 }
 
 func (self *Client) Connect(addPair string, cleanSession bool) error {
-	if len(self.ID) == 0 && !cleanSession {
-		// TODO: here should be warnning
-		EmitError(CLEANSESSION_MUST_BE_TRUE)
-		cleanSession = true
+	return self.connect(cleanSession, func() (*Transport, error) {
+		t := NewTransport()
+		return t, t.Connect(addPair)
+	})
+}
+
+// ConnectTLS connects to the broker over TLS. A client certificate can be
+// set to config.Certificates when the broker requires it.
+func (self *Client) ConnectTLS(addPair string, cleanSession bool, config *tls.Config) error {
+	return self.connect(cleanSession, func() (*Transport, error) {
+		t := NewTransport()
+		return t, t.ConnectTLS(addPair, config)
+	})
+}
+
+// ConnectWebSocket connects to the broker by MQTT over WebSocket,
+// url is like "ws://host:8080/mqtt". config is used for "wss://" and can be nil.
+func (self *Client) ConnectWebSocket(url string, cleanSession bool, config *tls.Config) error {
+	return self.connect(cleanSession, func() (*Transport, error) {
+		t := NewTransport()
+		return t, t.ConnectWebSocket(url, config)
+	})
+}
+
+// connect keeps dial to use it again for the reconnection.
+func (self *Client) connect(cleanSession bool, dial func() (*Transport, error)) error {
+	cleanSession, err := self.checkClientID(cleanSession)
+	if err != nil {
+		return err
 	}
 
-	t := NewTransport()
-	err := t.Connect(addPair)
+	t, err := dial()
 	if err != nil {
 		return err
 	}
+	self.mu.Lock()
+	self.dial = dial
+	self.closing = false
+	self.established = false
+	self.reconnectAttempt = 0
+	self.mu.Unlock()
+	return self.start(t, cleanSession)
+}
+
+// checkClientID returns cleanSession which can be used with the client ID.
+func (self *Client) checkClientID(cleanSession bool) (bool, error) {
+	if self.Protocol.Level == MQTT_3_1.Level && (len(self.ID) == 0 || len(self.ID) > MaxClientIDLength_3_1) {
+		return cleanSession, INVALID_CLIENT_ID_LENGTH
+	}
+	if len(self.ID) == 0 && !cleanSession {
+		// TODO: here should be warnning
+		self.emitError(CLEANSESSION_MUST_BE_TRUE)
+		cleanSession = true
+	}
+	return cleanSession, nil
+}
 
+func (self *Client) start(t *Transport, cleanSession bool) (err error) {
+	if self.Protocol.Level != MQTT_3_1_1.Level {
+		t.Level = self.Protocol.Level
+	}
+	t.MaxPacketSize = self.MaxPacketSize
+	self.mu.Lock()
 	self.Ct = t
 	self.LoopQuit = make(chan bool)
 	self.WriteChan = make(chan Message)
 	self.CleanSession = cleanSession
-	go self.ReadLoop(self) // TODO: use single Loop function
-	go self.WriteLoop()
+	self.disconnected = false
+	if cleanSession {
+		// the in-flight messages are not redelivered in the new session
+		self.PacketIDMap = make(map[uint16]Message)
+		self.packetIDs = packetIDs{}
+		self.receivedIDs = make(map[uint16]*PubrecMessage)
+	}
+	self.mu.Unlock()
+	in := newInbox()
+	self.inbox = in
+	self.loops.Add(2)
+	go func() {
+		defer self.loops.Done()
+		self.ReadLoop(self) // TODO: use single Loop function
+		in.close()
+	}()
+	go func() {
+		defer self.loops.Done()
+		self.WriteLoop(self)
+	}()
+	go self.dispatchLoop(in)
+	connect := NewConnectMessage(self.KeepAlive,
+		self.ID, cleanSession, self.Will, self.User)
+	connect.Protocol = self.Protocol
+	connect.Properties = self.Properties
+	if self.Protocol.Level == MQTT_5_0.Level && self.MaxPacketSize > 0 && self.Properties.Get(MaximumPacketSize) == nil {
+		connect.Properties = append(Properties{NewProperty(MaximumPacketSize, self.MaxPacketSize)}, self.Properties...)
+	}
 	// below can avoid first IsConnecting validation
-	err = self.Ct.SendMessage(NewConnectMessage(self.KeepAlive,
-		self.ID, cleanSession, self.Will, self.User))
+	err = self.Ct.SendMessage(connect)
 	return err
 }
 
-func (self *Client) Publish(topic, data string, qos uint8, retain bool) (err error) {
+// Publish returns the token resolved by PUBACK for QoS 1, PUBCOMP for QoS 2,
+// and when the message is passed to WriteLoop for QoS 0.
+func (self *Client) Publish(topic, data string, qos uint8, retain bool) *Token {
 	if qos >= 3 {
-		return INVALID_QOS_3
+		return resolvedToken(INVALID_QOS_3)
 	}
 	if strings.Contains(topic, "#") || strings.Contains(topic, "+") {
-		return WILDCARD_CHARACTERS_IN_PUBLISH
+		return resolvedToken(WILDCARD_CHARACTERS_IN_PUBLISH)
 	}
 
-	var id uint16
-	if qos > 0 {
-		id, err = self.getUsablePacketID()
-		if err != nil {
-			return err
-		}
+	pub := NewPublishMessage(false, qos, retain, topic, 0, []uint8(data))
+	if qos == 0 {
+		return resolvedToken(self.Send(pub))
+	}
+	id, err := self.waitPacketID()
+	if err != nil {
+		return resolvedToken(err)
 	}
+	pub.PacketID = id
+	return self.sendWithToken(pub)
+}
 
-	pub := NewPublishMessage(false, qos, retain, topic, id, []uint8(data))
-	self.WriteChan <- pub
-	return err
+// sendWithToken returns the token resolved by the acknowledgement of m.
+func (self *Client) sendWithToken(m Message) *Token {
+	id := m.GetPacketID()
+	token := self.addToken(id)
+	if err := self.Send(m); err != nil {
+		self.releasePacketID(id)
+		self.resolveToken(id, err, nil)
+	}
+	return token
 }
 
-func (self *Client) Subscribe(topics []*SubscribeTopic) error {
-	id, err := self.getUsablePacketID()
-	if err != nil {
-		return err
+// Subscribe subscribes the topics. handlers[i] is called with the PUBLISH
+// matched by topics[i], OnMessage is used when it is nil or omitted.
+// The token is resolved by SUBACK and has its return codes.
+func (self *Client) Subscribe(topics []*SubscribeTopic, handlers ...MessageHandler) *Token {
+	if len(topics) == 0 {
+		return resolvedToken(NO_TOPIC_FILTER_IN_PAYLOAD)
 	}
 	for _, topic := range topics {
-		parts := strings.Split(topic.Topic, "/")
-		for i, part := range parts {
-			if part == "#" && i != len(parts)-1 {
-				return MULTI_LEVEL_WILDCARD_MUST_BE_ON_TAIL
-			} else if strings.HasSuffix(part, "#") || strings.HasSuffix(part, "+") {
-				return WILDCARD_MUST_NOT_BE_ADJACENT_TO_NAME
-			}
+		if err := ValidateFilter(topic.Topic); err != nil {
+			return resolvedToken(err)
+		}
+	}
+	id, err := self.waitPacketID()
+	if err != nil {
+		return resolvedToken(err)
+	}
+	// the handlers are set before SUBACK, PUBLISH can come right after it
+	for i, topic := range topics {
+		var handler MessageHandler
+		if i < len(handlers) {
+			handler = handlers[i]
 		}
+		self.setHandler(topic.Topic, handler)
+	}
+	self.mu.Lock()
+	for _, topic := range topics {
+		self.subscriptions[topic.Topic] = topic
 	}
+	self.mu.Unlock()
 	sub := NewSubscribeMessage(id, topics)
-	self.WriteChan <- sub
-	return err
+	return self.sendWithToken(sub)
 }
 
-func (self *Client) Unsubscribe(topics []string) error {
+// Unsubscribe returns the token resolved by UNSUBACK.
+func (self *Client) Unsubscribe(topics []string) *Token {
+	if len(topics) == 0 {
+		return resolvedToken(NO_TOPIC_FILTER_IN_PAYLOAD)
+	}
 	for _, name := range topics {
-		parts := strings.Split(name, "/")
-		for i, part := range parts {
-			if part == "#" && i != len(parts)-1 {
-				return MULTI_LEVEL_WILDCARD_MUST_BE_ON_TAIL
-			} else if strings.HasSuffix(part, "#") || strings.HasSuffix(part, "+") {
-				return WILDCARD_MUST_NOT_BE_ADJACENT_TO_NAME
-			}
+		if err := ValidateFilter(name); err != nil {
+			return resolvedToken(err)
 		}
 	}
-
-	id, err := self.getUsablePacketID()
+	id, err := self.waitPacketID()
 	if err != nil {
-		return err
+		return resolvedToken(err)
+	}
+	self.mu.Lock()
+	for _, name := range topics {
+		delete(self.subscriptions, name)
+	}
+	self.mu.Unlock()
+	for _, name := range topics {
+		self.setHandler(name, nil)
 	}
 	unsub := NewUnsubscribeMessage(id, topics)
-	self.WriteChan <- unsub
-	return err
+	return self.sendWithToken(unsub)
 }
 
 func (self *Client) keepAlive() {
 	ping := NewPingreqMessage()
-	self.WriteChan <- ping
+	self.emitError(self.Send(ping))
 	// TODO: ping begin should be start if the delivery is nicely done?
 	/*
 		if err == nil {
@@ -287,8 +530,12 @@ func (self *Client) keepAlive() {
 }
 
 func (self *Client) Disconnect() {
+	self.mu.Lock()
+	// the client is not reconnected after this
+	self.closing = true
+	self.mu.Unlock()
 	discon := NewDisconnectMessage()
-	self.WriteChan <- discon
+	self.emitError(self.Send(discon))
 
 	go func() {
 		// wait broker side detect the DisconnectMessage
@@ -298,26 +545,78 @@ func (self *Client) Disconnect() {
 	}()
 }
 
-func (self *ClientInfo) disconnectBase() (err error) {
-	close(self.WriteChan)
+// beginDisconnect marks the client as disconnected. Only the first caller gets first == true,
+// because ReadLoop, WriteLoop and the keep alive timer may try to disconnect at the same time.
+func (self *ClientInfo) beginDisconnect() (will *Will, wasConnecting, first bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if self.disconnected {
+		return nil, false, false
+	}
+	self.disconnected = true
+	will, wasConnecting = self.Will, self.IsConnecting
 	if self.IsConnecting {
 		self.IsConnecting = false
 		self.Will = nil
 	}
+	return will, wasConnecting, true
+}
+
+func (self *ClientInfo) closeTransport() (err error) {
+	// this stops WriteLoop, StartPingLoop and the pending Send
+	close(self.LoopQuit)
 	err = self.Ct.conn.Close()
 	return err
 }
 
+func (self *ClientInfo) disconnectBase() (err error) {
+	if _, _, first := self.beginDisconnect(); !first {
+		return nil
+	}
+	return self.closeTransport()
+}
+
+func (self *ClientInfo) isConnecting() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.IsConnecting
+}
+
+func (self *ClientInfo) setConnecting() {
+	self.mu.Lock()
+	self.IsConnecting = true
+	self.mu.Unlock()
+}
+
 func (self *Client) disconnectProcessing() (err error) {
-	if self.IsConnecting {
-		self.LoopQuit <- true // for client side
-		close(self.LoopQuit)
+	_, wasConnecting, first := self.beginDisconnect()
+	if !first {
+		return nil
+	}
+	err = self.closeTransport()
+	reconnect := self.willReconnect()
+	if !reconnect || self.CleanSession {
+		// the messages of the persistent session are redelivered after the reconnection
+		self.resolveAllTokens(NOT_CONNECTED)
+	}
+	if wasConnecting && self.OnConnectionLost != nil && !self.isClosing() {
+		go self.OnConnectionLost(self)
+	}
+	if reconnect {
+		self.scheduleReconnect()
 	}
-	err = self.disconnectBase()
 	return err
 }
 
+func (self *Client) isClosing() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.closing
+}
+
 func (self *ClientInfo) AckMessage(id uint16) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
 	_, ok := self.PacketIDMap[id]
 	if !ok {
 		return PACKET_ID_DOES_NOT_EXIST
@@ -327,18 +626,21 @@ func (self *ClientInfo) AckMessage(id uint16) error {
 }
 
 func (self *ClientInfo) Redelivery() {
-	if !self.CleanSession && len(self.PacketIDMap) > 0 {
+	self.mu.Lock()
+	messages := make([]Message, 0, len(self.PacketIDMap))
+	if !self.CleanSession {
 		for _, v := range self.PacketIDMap {
-			switch m := v.(type) {
-			case *PublishMessage:
-				// Only Publish Message's DUP is set
-				m.Dup = true
-				self.WriteChan <- m
-			default:
-				self.WriteChan <- v
-			}
+			messages = append(messages, v)
 		}
 	}
+	self.mu.Unlock()
+	for _, v := range messages {
+		if m, ok := v.(*PublishMessage); ok {
+			// Only Publish Message's DUP is set
+			m.Dup = true
+		}
+		self.emitError(self.Send(v))
+	}
 }
 
 func (self *Client) recvConnectMessage(m *ConnectMessage) (err error) {
@@ -349,11 +651,24 @@ func (self *Client) recvConnackMessage(m *ConnackMessage) (err error) {
 		self.disconnectProcessing()
 		return m.ReturnCode
 	}
-	self.IsConnecting = true
+	if p := m.Properties.Get(AssignedClientIdentifier); p != nil {
+		self.mu.Lock()
+		self.ID = p.Value.(string)
+		self.mu.Unlock()
+	}
+	self.setConnecting()
+	self.mu.Lock()
+	self.established = true
+	self.mu.Unlock()
 	if self.KeepAlive != 0 {
-		go self.StartPingLoop()
+		self.loops.Add(1)
+		go func() {
+			defer self.loops.Done()
+			self.StartPingLoop()
+		}()
 	}
 	self.Redelivery()
+	self.reconnected(m.SessionPresentFlag)
 	return err
 }
 func (self *Client) recvPublishMessage(m *PublishMessage) (err error) {
@@ -377,11 +692,16 @@ func (self *Client) recvPublishMessage(m *PublishMessage) (err error) {
 		}
 	case 1:
 		puback := NewPubackMessage(m.PacketID)
-		self.WriteChan <- puback
+		err = self.Send(puback)
 	case 2:
+		if stored := self.receivedPubrec(m.PacketID); stored != nil {
+			// the message was passed to the handlers already
+			return self.Send(stored)
+		}
 		pubrec := NewPubrecMessage(m.PacketID)
-		self.WriteChan <- pubrec
+		err = self.Send(pubrec)
 	}
+	self.inbox.push(m)
 	return err
 }
 
@@ -389,6 +709,8 @@ func (self *Client) recvPubackMessage(m *PubackMessage) (err error) {
 	// acknowledge the sent Publish packet
 	if m.PacketID > 0 {
 		err = self.AckMessage(m.PacketID)
+		self.releasePacketID(m.PacketID)
+		self.resolveToken(m.PacketID, reasonError(m.ReasonCode), nil)
 	}
 	return err
 }
@@ -399,25 +721,33 @@ func (self *Client) recvPubrecMessage(m *PubrecMessage) (err error) {
 	if err != nil {
 		return err
 	}
+	if err := reasonError(m.ReasonCode); err != nil {
+		// the flow ends without PUBREL in MQTT 5.0
+		self.releasePacketID(m.PacketID)
+		self.resolveToken(m.PacketID, err, nil)
+		return nil
+	}
 	pubrel := NewPubrelMessage(m.PacketID)
-	self.WriteChan <- pubrel
+	err = self.Send(pubrel)
 	return err
 }
 
 func (self *Client) recvPubrelMessage(m *PubrelMessage) (err error) {
-	// acknowledge the sent Pubrel packet
-	err = self.AckMessage(m.PacketID)
-	if err != nil {
-		return err
-	}
+	// the flow of the received QoS 2 PUBLISH is completed
 	pubcomp := NewPubcompMessage(m.PacketID)
-	self.WriteChan <- pubcomp
+	if err = self.releaseReceived(m.PacketID); err != nil {
+		// PUBCOMP is sent anyway, so that the sender stops sending PUBREL
+		pubcomp.ReasonCode = ReasonPacketIdentifierNotFound
+	}
+	self.emitError(self.Send(pubcomp))
 	return err
 }
 
 func (self *Client) recvPubcompMessage(m *PubcompMessage) (err error) {
 	// acknowledge the sent Pubrel packet
 	err = self.AckMessage(m.PacketID)
+	self.releasePacketID(m.PacketID)
+	self.resolveToken(m.PacketID, reasonError(m.ReasonCode), nil)
 	return err
 }
 
@@ -428,6 +758,8 @@ func (self *Client) recvSubscribeMessage(m *SubscribeMessage) (err error) {
 func (self *Client) recvSubackMessage(m *SubackMessage) (err error) {
 	// acknowledge the sent subscribe packet
 	self.AckMessage(m.PacketID)
+	self.releasePacketID(m.PacketID)
+	self.resolveToken(m.PacketID, nil, m.ReturnCodes)
 	return err
 }
 func (self *Client) recvUnsubscribeMessage(m *UnsubscribeMessage) (err error) {
@@ -436,6 +768,8 @@ func (self *Client) recvUnsubscribeMessage(m *UnsubscribeMessage) (err error) {
 func (self *Client) recvUnsubackMessage(m *UnsubackMessage) (err error) {
 	// acknowledged the sent unsubscribe packet
 	err = self.AckMessage(m.PacketID)
+	self.releasePacketID(m.PacketID)
+	self.resolveToken(m.PacketID, nil, nil)
 	return err
 }
 
@@ -446,18 +780,32 @@ func (self *Client) recvPingreqMessage(m *PingreqMessage) (err error) {
 func (self *Client) recvPingrespMessage(m *PingrespMessage) (err error) {
 	self.Duration = time.Since(self.PingBegin)
 	// TODO: suspicious
-	if FrameDebug {
-		fmt.Printf("Ping RTT is %s\n\n", self.Duration)
+	if self.Ct.FrameDebug {
+		self.logger().Debug("ping", "rtt", self.Duration)
 	}
 	if self.Duration.Seconds() >= float64(self.KeepAlive) {
 		// TODO: this must be 'reasonable amount of time'
 		discon := NewDisconnectMessage()
-		self.WriteChan <- discon
+		self.emitError(self.Send(discon))
 		return SERVER_TIMED_OUT
 	}
 	return err
 }
 
 func (self *Client) recvDisconnectMessage(m *DisconnectMessage) (err error) {
-	return INVALID_MESSAGE_CAME
+	// only the server of MQTT 5.0 can send DISCONNECT
+	if self.Ct.Level != MQTT_5_0.Level {
+		return INVALID_MESSAGE_CAME
+	}
+	self.disconnectProcessing()
+	if m.ReasonCode != ReasonSuccess {
+		return m.ReasonCode
+	}
+	return nil
+}
+
+func (self *Client) recvAuthMessage(m *AuthMessage) (err error) {
+	// TODO: support the extended authentication
+	self.disconnectProcessing()
+	return PROTOCOL_VIOLATION
 }
@@ -0,0 +1,325 @@
+package MQTTg
+
+import (
+	"bytes"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+	"io"
+	"log/slog"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// BrokerConfig is the configuration of NewBroker, it can be loaded from
+// a YAML or TOML file by LoadBrokerConfig.
+type BrokerConfig struct {
+	Listeners   []ListenerConfig  `yaml:"listeners" toml:"listeners"`
+	Limits      LimitsConfig      `yaml:"limits" toml:"limits"`
+	Auth        AuthConfig        `yaml:"auth" toml:"auth"`
+	Persistence PersistenceConfig `yaml:"persistence" toml:"persistence"`
+	Log         LogConfig         `yaml:"log" toml:"log"`
+	Sys         SysConfig         `yaml:"sys" toml:"sys"`
+}
+
+type ListenerConfig struct {
+	// Address is the host to bind such as "127.0.0.1" or "::1",
+	// every address of IPv4 and IPv6 is used when it is empty
+	Address string `yaml:"address" toml:"address"`
+	// Port is MQTT_PORT, MQTT_TLS_PORT, MQTT_WEBSOCKET_PORT or MQTT_METRICS_PORT when it is 0
+	Port int `yaml:"port" toml:"port"`
+	// Protocol is "mqtt", "websocket" or "metrics", "mqtt" is used when it is empty.
+	// "metrics" serves the Prometheus metrics over HTTP
+	Protocol string `yaml:"protocol" toml:"protocol"`
+	// Path is the path of WebSocket or metrics, "/mqtt" or "/metrics" is used when it is empty
+	Path string     `yaml:"path" toml:"path"`
+	TLS  *TLSConfig `yaml:"tls" toml:"tls"`
+}
+
+type TLSConfig struct {
+	CertFile string `yaml:"cert_file" toml:"cert_file"`
+	KeyFile  string `yaml:"key_file" toml:"key_file"`
+	// ClientCAFile requires the client certificate signed by it
+	ClientCAFile string `yaml:"client_ca_file" toml:"client_ca_file"`
+}
+
+type LimitsConfig struct {
+	MaxInflight int `yaml:"max_inflight" toml:"max_inflight"`
+	// MaxPacketSize is the bytes of the largest packet including the fixed header, 0 means no limit
+	MaxPacketSize uint32             `yaml:"max_packet_size" toml:"max_packet_size"`
+	OfflineQueue  OfflineQueueLimits `yaml:"offline_queue" toml:"offline_queue"`
+}
+
+type OfflineQueueLimits struct {
+	MaxMessages int `yaml:"max_messages" toml:"max_messages"`
+	MaxBytes    int `yaml:"max_bytes" toml:"max_bytes"`
+	// Policy is "drop_oldest" or "drop_newest"
+	Policy string `yaml:"policy" toml:"policy"`
+}
+
+type AuthConfig struct {
+	// PasswordFile is the htpasswd file for HtpasswdAuthenticator
+	PasswordFile string `yaml:"password_file" toml:"password_file"`
+	// AllowAnonymous accepts the CONNECT without user name, every client is accepted without PasswordFile
+	AllowAnonymous bool `yaml:"allow_anonymous" toml:"allow_anonymous"`
+	// ACLFile is the file for ACLAuthorizer
+	ACLFile string `yaml:"acl_file" toml:"acl_file"`
+}
+
+type PersistenceConfig struct {
+	// SessionFile is the log of FileSessionStore, sessions are kept in memory when it is empty
+	SessionFile string `yaml:"session_file" toml:"session_file"`
+	// RetainFile is the log of FileRetainStore
+	RetainFile string `yaml:"retain_file" toml:"retain_file"`
+}
+
+type LogConfig struct {
+	// FrameDebug logs every frame sent and received at the debug level,
+	// the level is debug when Level is empty
+	FrameDebug bool `yaml:"frame_debug" toml:"frame_debug"`
+	// Level is "debug", "info", "warn" or "error", "info" is used when it is empty
+	Level string `yaml:"level" toml:"level"`
+	// Format is "text", "json" or "console", "text" is used when it is empty
+	Format string `yaml:"format" toml:"format"`
+}
+
+type SysConfig struct {
+	// Interval is the seconds between the $SYS statistics, they are not published when it is 0
+	Interval int `yaml:"interval" toml:"interval"`
+}
+
+// DefaultBrokerConfig listens MQTT_PORT of every address.
+func DefaultBrokerConfig() *BrokerConfig {
+	return &BrokerConfig{
+		Listeners: []ListenerConfig{{Protocol: "mqtt"}},
+	}
+}
+
+// LoadBrokerConfig reads the file as YAML or TOML by its extension.
+// Unknown keys are errors, so that a typo does not silently use the default.
+func LoadBrokerConfig(path string) (*BrokerConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	config := &BrokerConfig{}
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".yaml", ".yml":
+		decoder := yaml.NewDecoder(bytes.NewReader(data))
+		decoder.KnownFields(true)
+		if err := decoder.Decode(config); err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	case ".toml":
+		meta, err := toml.Decode(string(data), config)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+		if undecoded := meta.Undecoded(); len(undecoded) > 0 {
+			return nil, fmt.Errorf("%s: unknown key %s", path, undecoded[0])
+		}
+	default:
+		return nil, errors.New("unknown config format: " + path)
+	}
+	if len(config.Listeners) == 0 {
+		config.Listeners = DefaultBrokerConfig().Listeners
+	}
+	return config, config.validate()
+}
+
+func (self *BrokerConfig) validate() error {
+	for _, l := range self.Listeners {
+		switch l.Protocol {
+		case "", "mqtt", "websocket", "metrics":
+		default:
+			return errors.New("unknown listener protocol: " + l.Protocol)
+		}
+		if l.Port < 0 || l.Port > 65535 {
+			return errors.New("invalid listener port: " + strconv.Itoa(l.Port))
+		}
+	}
+	if self.Sys.Interval < 0 {
+		return errors.New("invalid sys interval: " + strconv.Itoa(self.Sys.Interval))
+	}
+	if _, err := self.Limits.OfflineQueue.policy(); err != nil {
+		return err
+	}
+	if _, err := self.Log.handler(os.Stderr); err != nil {
+		return err
+	}
+	return nil
+}
+
+func (self OfflineQueueLimits) policy() (QueuePolicy, error) {
+	switch self.Policy {
+	case "", "drop_oldest":
+		return DropOldest, nil
+	case "drop_newest":
+		return DropNewest, nil
+	}
+	return DropOldest, errors.New("unknown offline queue policy: " + self.Policy)
+}
+
+func (self LogConfig) handler(w io.Writer) (slog.Handler, error) {
+	level := slog.LevelInfo
+	if self.Level == "" && self.FrameDebug {
+		level = slog.LevelDebug
+	} else if self.Level != "" {
+		if err := level.UnmarshalText([]byte(self.Level)); err != nil {
+			return nil, errors.New("unknown log level: " + self.Level)
+		}
+	}
+	opts := &slog.HandlerOptions{Level: level}
+	switch self.Format {
+	case "", "text":
+		return slog.NewTextHandler(w, opts), nil
+	case "json":
+		return slog.NewJSONHandler(w, opts), nil
+	case "console":
+		return NewConsoleHandler(w, opts), nil
+	}
+	return nil, errors.New("unknown log format: " + self.Format)
+}
+
+// NewBroker builds the broker and opens the files of the configuration.
+// The logger of the broker is built from config.Log.
+// The listeners are served by Run.
+func NewBroker(config *BrokerConfig) (*Broker, error) {
+	if err := config.validate(); err != nil {
+		return nil, err
+	}
+	policy, _ := config.Limits.OfflineQueue.policy()
+	b := &Broker{
+		Clients:       make(map[string]*BrokerSideClient),
+		TopicRoot:     NewTopicNode("", ""),
+		MaxInflight:   config.Limits.MaxInflight,
+		MaxPacketSize: config.Limits.MaxPacketSize,
+		OfflineQueue: OfflineQueueConfig{
+			MaxMessages: config.Limits.OfflineQueue.MaxMessages,
+			MaxBytes:    config.Limits.OfflineQueue.MaxBytes,
+			Policy:      policy,
+		},
+		Listeners:   config.Listeners,
+		SysInterval: time.Duration(config.Sys.Interval) * time.Second,
+	}
+	var err error
+	if path := config.Auth.PasswordFile; path != "" {
+		auth, err := NewHtpasswdAuthenticator(path)
+		if err != nil {
+			return nil, err
+		}
+		auth.AllowAnonymous = config.Auth.AllowAnonymous
+		b.Authenticator = auth
+	}
+	if path := config.Auth.ACLFile; path != "" {
+		if b.Authorizer, err = NewACLAuthorizer(path); err != nil {
+			return nil, err
+		}
+	}
+	if path := config.Persistence.SessionFile; path != "" {
+		store, err := NewFileSessionStore(path)
+		if err != nil {
+			return nil, err
+		}
+		b.SessionStore = store
+		b.closers = append(b.closers, store)
+	}
+	if path := config.Persistence.RetainFile; path != "" {
+		store, err := NewFileRetainStore(path)
+		if err != nil {
+			for _, c := range b.closers {
+				c.Close()
+			}
+			return nil, err
+		}
+		b.RetainStore = store
+		b.closers = append(b.closers, store)
+	}
+	handler, _ := config.Log.handler(os.Stderr)
+	b.Logger = slog.New(handler)
+	b.FrameDebug = config.Log.FrameDebug
+	return b, nil
+}
+
+func (self *ListenerConfig) listen() (net.Listener, error) {
+	port := self.Port
+	if port == 0 {
+		switch {
+		case self.Protocol == "websocket":
+			port = MQTT_WEBSOCKET_PORT
+		case self.Protocol == "metrics":
+			port = MQTT_METRICS_PORT
+		case self.TLS != nil:
+			port = MQTT_TLS_PORT
+		default:
+			port = MQTT_PORT
+		}
+	}
+	host := strings.TrimSuffix(strings.TrimPrefix(self.Address, "["), "]")
+	listener, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	if self.TLS != nil {
+		config, err := NewServerTLSConfig(self.TLS.CertFile, self.TLS.KeyFile, self.TLS.ClientCAFile)
+		if err != nil {
+			listener.Close()
+			return nil, err
+		}
+		listener = tls.NewListener(listener, config)
+	}
+	return listener, nil
+}
+
+// Run serves every listener of Listeners, and returns when one of them stops.
+// It returns BROKER_CLOSED after Shutdown.
+func (self *Broker) Run() error {
+	if err := self.initialize(); err != nil {
+		return err
+	}
+	listeners := make([]net.Listener, 0, len(self.Listeners))
+	for i := range self.Listeners {
+		listener, err := self.Listeners[i].listen()
+		if err != nil {
+			for _, l := range listeners {
+				l.Close()
+			}
+			return err
+		}
+		listeners = append(listeners, listener)
+	}
+
+	errs := make(chan error, len(listeners))
+	for i, listener := range listeners {
+		config := self.Listeners[i]
+		go func(listener net.Listener) {
+			switch config.Protocol {
+			case "websocket":
+				path := config.Path
+				if path == "" {
+					path = "/mqtt"
+				}
+				errs <- self.ServeWebSocket(listener, path)
+			case "metrics":
+				path := config.Path
+				if path == "" {
+					path = "/metrics"
+				}
+				errs <- self.ServeMetrics(listener, path)
+			default:
+				errs <- self.Serve(listener)
+			}
+		}(listener)
+	}
+	err := <-errs
+	for _, l := range listeners {
+		l.Close()
+	}
+	return err
+}
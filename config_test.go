@@ -0,0 +1,190 @@
+package MQTTg
+
+import (
+	"context"
+	"io/ioutil"
+	"net"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestLoadBrokerConfig(t *testing.T) {
+	dir := t.TempDir()
+	yamlPath := filepath.Join(dir, "broker.yaml")
+	ioutil.WriteFile(yamlPath, []byte(`
+listeners:
+  - address: 127.0.0.1
+    port: 1883
+  - address: "::1"
+    protocol: websocket
+    path: /ws
+    tls:
+      cert_file: server.crt
+      key_file: server.key
+limits:
+  max_inflight: 100
+  offline_queue:
+    max_messages: 10
+    policy: drop_newest
+auth:
+  password_file: passwd
+  allow_anonymous: true
+persistence:
+  session_file: sessions.log
+log:
+  frame_debug: true
+`), 0600)
+	tomlPath := filepath.Join(dir, "broker.toml")
+	ioutil.WriteFile(tomlPath, []byte(`
+[[listeners]]
+address = "127.0.0.1"
+port = 1883
+
+[[listeners]]
+address = "::1"
+protocol = "websocket"
+path = "/ws"
+[listeners.tls]
+cert_file = "server.crt"
+key_file = "server.key"
+
+[limits]
+max_inflight = 100
+[limits.offline_queue]
+max_messages = 10
+policy = "drop_newest"
+
+[auth]
+password_file = "passwd"
+allow_anonymous = true
+
+[persistence]
+session_file = "sessions.log"
+
+[log]
+frame_debug = true
+`), 0600)
+
+	expected := &BrokerConfig{
+		Listeners: []ListenerConfig{
+			{Address: "127.0.0.1", Port: 1883},
+			{Address: "::1", Protocol: "websocket", Path: "/ws",
+				TLS: &TLSConfig{CertFile: "server.crt", KeyFile: "server.key"}},
+		},
+		Limits: LimitsConfig{
+			MaxInflight:  100,
+			OfflineQueue: OfflineQueueLimits{MaxMessages: 10, Policy: "drop_newest"},
+		},
+		Auth:        AuthConfig{PasswordFile: "passwd", AllowAnonymous: true},
+		Persistence: PersistenceConfig{SessionFile: "sessions.log"},
+		Log:         LogConfig{FrameDebug: true},
+	}
+	for _, path := range []string{yamlPath, tomlPath} {
+		actual, err := LoadBrokerConfig(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: got %+v\nwant %+v", path, actual, expected)
+		}
+	}
+
+	invalid := map[string]string{
+		"typo.yaml":   "listener:\n  - port: 1883\n",
+		"typo.toml":   "[[listener]]\nport = 1883\n",
+		"policy.yaml": "limits:\n  offline_queue:\n    policy: drop_all\n",
+		"proto.yaml":  "listeners:\n  - protocol: quic\n",
+		"log.yaml":    "log:\n  format: xml\n",
+		"broker.json": "{}",
+	}
+	for name, content := range invalid {
+		path := filepath.Join(dir, name)
+		ioutil.WriteFile(path, []byte(content), 0600)
+		if _, err := LoadBrokerConfig(path); err == nil {
+			t.Errorf("%s: got nil\nwant error", name)
+		}
+	}
+}
+
+func freePort(t *testing.T, network, address string) int {
+	l, err := net.Listen(network, address)
+	if err != nil {
+		t.Skip(err)
+	}
+	defer l.Close()
+	return l.Addr().(*net.TCPAddr).Port
+}
+
+func TestBrokerRun(t *testing.T) {
+	config := DefaultBrokerConfig()
+	config.Listeners = []ListenerConfig{
+		{Address: "127.0.0.1", Port: freePort(t, "tcp4", "127.0.0.1:0")},
+		{Address: "127.0.0.1", Port: freePort(t, "tcp4", "127.0.0.1:0"), Protocol: "websocket"},
+	}
+	// IPv6 is not always available
+	if l, err := net.Listen("tcp6", "[::1]:0"); err == nil {
+		l.Close()
+		config.Listeners = append(config.Listeners, ListenerConfig{Address: "[::1]", Port: freePort(t, "tcp6", "[::1]:0")})
+	}
+	config.Log.FrameDebug = !FrameDebug
+	logger, frameDebug := currentLogger(), FrameDebug
+	b, err := NewBroker(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// the settings of the package are shared by the Clients and the other Brokers
+	if currentLogger() != logger || FrameDebug != frameDebug {
+		t.Errorf("NewBroker changed the logger or FrameDebug of the package")
+	}
+	if b.Logger == nil || b.FrameDebug != config.Log.FrameDebug {
+		t.Errorf("got %v %v\nwant a logger and %v", b.Logger, b.FrameDebug, config.Log.FrameDebug)
+	}
+	ran := make(chan error, 1)
+	go func() { ran <- b.Run() }()
+
+	for i, l := range config.Listeners {
+		addr := l.Address + ":" + strconv.Itoa(l.Port)
+		if l.Address == "[::1]" {
+			// the client dials only IPv4, the listener is checked by a plain connection
+			ok := waitFor(func() bool {
+				conn, err := net.Dial("tcp6", addr)
+				if err == nil {
+					conn.Close()
+				}
+				return err == nil
+			})
+			if !ok {
+				t.Errorf("could not connect to %s", addr)
+			}
+			continue
+		}
+		c := NewClient("run-client-"+strconv.Itoa(i), nil, 0, nil)
+		connected := false
+		for trial := 0; trial < 50 && !connected; trial++ {
+			if l.Protocol == "websocket" {
+				err = c.ConnectWebSocket("ws://"+addr+"/mqtt", true, nil)
+			} else {
+				err = c.Connect(addr, true)
+			}
+			connected = err == nil && waitFor(c.isConnecting)
+			if err != nil {
+				time.Sleep(10 * time.Millisecond)
+			}
+		}
+		if !connected {
+			t.Errorf("could not connect to %s: %v", addr, err)
+			continue
+		}
+		c.disconnectProcessing()
+	}
+
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if err := <-ran; err != BROKER_CLOSED {
+		t.Errorf("got %v\nwant %v", err, BROKER_CLOSED)
+	}
+}
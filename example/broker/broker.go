@@ -1,16 +1,50 @@
 package main
 
 import (
+	"context"
+	"flag"
+	"fmt"
 	"github.com/ami-GS/MQTTg"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
 )
 
 func main() {
-	b := MQTTg.Broker{
-		MyAddr:  nil,
-		Clients: make(map[string]*MQTTg.BrokerSideClient),
-		TopicRoot: &MQTTg.TopicNode{
-			make(map[string]*MQTTg.TopicNode),
-			"", "/", "", 0, make(map[string]uint8)},
+	path := flag.String("config", "", "YAML or TOML configuration file")
+	flag.Parse()
+
+	config := MQTTg.DefaultBrokerConfig()
+	if *path != "" {
+		var err error
+		if config, err = MQTTg.LoadBrokerConfig(*path); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+	}
+	b, err := MQTTg.NewBroker(config)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, os.Interrupt, syscall.SIGTERM)
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		<-sig
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		defer cancel()
+		if err := b.Shutdown(ctx); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+		}
+	}()
+	if err := b.Run(); err != MQTTg.BROKER_CLOSED {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
 	}
-	b.Start()
+	// Run returns when the listeners are closed, the clients are closed after that
+	<-done
 }
@@ -0,0 +1,107 @@
+package MQTTg
+
+import (
+	"bufio"
+	"encoding/json"
+	"io"
+	"os"
+)
+
+// fileLog is an append-only file of JSON lines used by the file stores.
+// Every record is synced, and the file is rewritten with the live records
+// when it is opened and when the old records become the majority.
+type fileLog struct {
+	path string
+	file *os.File
+	// appended is the number of records since the last compaction
+	appended int
+}
+
+// openFileLog calls replay for each record in the file. The caller must
+// compact the log to start appending.
+func openFileLog(path string, replay func(line []byte) error) (*fileLog, error) {
+	self := &fileLog{path: path}
+	f, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return self, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	r := bufio.NewReader(f)
+	for {
+		line, err := r.ReadBytes('\n')
+		if err == io.EOF {
+			// a line without the newline is a write torn by a crash
+			return self, nil
+		} else if err != nil {
+			return nil, err
+		}
+		if err := replay(line); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func writeLogRecord(w io.Writer, record interface{}) error {
+	b, err := json.Marshal(record)
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(b, '\n'))
+	return err
+}
+
+// compact rewrites the log with the records and opens it for appending.
+func (self *fileLog) compact(records []interface{}) error {
+	tmpPath := self.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0600)
+	if err != nil {
+		return err
+	}
+	w := bufio.NewWriter(tmp)
+	for _, record := range records {
+		if err = writeLogRecord(w, record); err != nil {
+			break
+		}
+	}
+	if err == nil {
+		err = w.Flush()
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+	if err := os.Rename(tmpPath, self.path); err != nil {
+		return err
+	}
+	if self.file != nil {
+		self.file.Close()
+	}
+	self.appended = 0
+	self.file, err = os.OpenFile(self.path, os.O_WRONLY|os.O_APPEND, 0600)
+	return err
+}
+
+func (self *fileLog) append(record interface{}) error {
+	if err := writeLogRecord(self.file, record); err != nil {
+		return err
+	}
+	self.appended++
+	return self.file.Sync()
+}
+
+func (self *fileLog) needsCompaction(live int) bool {
+	return self.appended >= 1024 && self.appended >= 2*live
+}
+
+func (self *fileLog) Close() error {
+	return self.file.Close()
+}
@@ -1,10 +1,13 @@
 package MQTTg
 
 import (
+	"bytes"
 	"encoding/binary"
 	"fmt"
 	"io"
 	"strings"
+	"sync"
+	"unicode/utf8"
 )
 
 type MessageType uint8
@@ -25,7 +28,7 @@ const (
 	Pingreq
 	Pingresp
 	Disconnect
-	Reserved_2
+	Auth // MQTT 5.0 only
 )
 
 func (self MessageType) String() string {
@@ -45,24 +48,203 @@ func (self MessageType) String() string {
 		"Pingreq",
 		"Pingresp",
 		"Disconnect",
-		"Reserved_2",
+		"Auth",
 	}[int(self)]
 }
 
+// ReadFrame reads a MQTT 3.1.1 frame, or CONNECT of any protocol level.
 func ReadFrame(r io.Reader) (Message, error) {
-	// TODO: The argument should be considered (like io.Reader)
-	fh, _, err := ParseFixedHeader(r) // This causes error
+	return ReadFrameWithLevel(r, 0)
+}
+
+// ReadFrameWithLevel reads a frame of the protocol level decided by CONNECT,
+// 0 is the same as MQTT 3.1.1.
+func ReadFrameWithLevel(r io.Reader, level uint8) (Message, error) {
+	return readFrame(r, level, 0)
+}
+
+// readFrame returns PACKET_IS_TOO_LARGE before the body is allocated
+// when the packet is larger than maxSize, 0 means no limit.
+func readFrame(r io.Reader, level uint8, maxSize uint32) (Message, error) {
+	fh, n, err := ParseFixedHeader(r)
 	if err != nil {
 		return nil, err
 	}
-	ms, err := ParseMessage[fh.Type](fh, r)
+	if maxSize > 0 && uint64(n)+uint64(fh.RemainLength) > uint64(maxSize) {
+		return nil, PACKET_IS_TOO_LARGE
+	}
+	fh.Level = level
+	parse, err := parserOf(fh)
 	if err != nil {
 		return nil, err
 	}
+	// the parser reads only the packet, so that a broken packet
+	// cannot consume the following ones. The parsers copy what they keep,
+	// so the body can be reused.
+	buf := getBuffer()
+	defer putBuffer(buf)
+	if cap(*buf) < int(fh.RemainLength) {
+		*buf = make([]byte, 0, fh.RemainLength)
+	}
+	body := (*buf)[:fh.RemainLength]
+	if _, err := io.ReadFull(r, body); err != nil {
+		if err == io.EOF || err == io.ErrUnexpectedEOF {
+			return nil, newMalformedPacketError(fh.Type, err)
+		}
+		return nil, err
+	}
+	return parseBody(fh, parse, body)
+}
 
+func parserOf(fh *FixedHeader) (FrameParser, error) {
+	parse, ok := ParseMessage[fh.Type]
+	if !ok || fh.Type == Auth && !fh.isV5() {
+		return nil, INVALID_MESSAGE_CAME
+	}
+	return parse, nil
+}
+
+func parseBody(fh *FixedHeader, parse FrameParser, body []byte) (Message, error) {
+	br := bytes.NewReader(body)
+	ms, err := parse(fh, br)
+	if err != nil {
+		return nil, newMalformedPacketError(fh.Type, err)
+	}
+	if br.Len() > 0 {
+		return nil, newMalformedPacketError(fh.Type, PACKET_HAS_EXTRA_BYTES)
+	}
 	return ms, nil
 }
 
+// DecodeMessage parses the packet at the head of b and returns its length.
+// io.EOF or io.ErrUnexpectedEOF is returned while b does not have the whole packet.
+// The Payload of PUBLISH refers to b instead of a copy, so b must not be
+// modified while the message is used.
+func DecodeMessage(b []byte, level uint8) (Message, int, error) {
+	var fh FixedHeader
+	n, err := decodeFixedHeader(&fh, b)
+	if err != nil {
+		return nil, 0, err
+	}
+	fh.Level = level
+	end := n + int(fh.RemainLength)
+	if len(b) < end {
+		return nil, 0, io.ErrUnexpectedEOF
+	}
+	if fh.Type == Publish {
+		// the message and its header are allocated at once
+		frame := &publishFrame{fh: fh}
+		frame.FixedHeader = &frame.fh
+		if err := decodePublish(&frame.PublishMessage, b[n:end]); err != nil {
+			return nil, 0, newMalformedPacketError(Publish, err)
+		}
+		return &frame.PublishMessage, end, nil
+	}
+	parse, err := parserOf(&fh)
+	if err != nil {
+		return nil, 0, err
+	}
+	m, err := parseBody(&fh, parse, b[n:end])
+	if err != nil {
+		return nil, 0, err
+	}
+	return m, end, nil
+}
+
+// DecodePublishMessage is DecodeMessage reusing m and its FixedHeader for PUBLISH.
+// TopicName is not allocated when it is the same as the previous one.
+func DecodePublishMessage(m *PublishMessage, b []byte, level uint8) (int, error) {
+	if m.FixedHeader == nil {
+		m.FixedHeader = &FixedHeader{}
+	}
+	fh := m.FixedHeader
+	*fh = FixedHeader{}
+	n, err := decodeFixedHeader(fh, b)
+	if err != nil {
+		return 0, err
+	}
+	if fh.Type != Publish {
+		return 0, INVALID_MESSAGE_CAME
+	}
+	fh.Level = level
+	end := n + int(fh.RemainLength)
+	if len(b) < end {
+		return 0, io.ErrUnexpectedEOF
+	}
+	if err := decodePublish(m, b[n:end]); err != nil {
+		return 0, newMalformedPacketError(Publish, err)
+	}
+	return end, nil
+}
+
+type publishFrame struct {
+	PublishMessage
+	fh FixedHeader
+}
+
+func decodeFixedHeader(fh *FixedHeader, b []byte) (int, error) {
+	if len(b) == 0 {
+		return 0, io.EOF
+	}
+	if err := fh.setFlags(b[0]); err != nil {
+		return 0, err
+	}
+	m := uint32(1)
+	for i := 1; ; i++ {
+		if i >= len(b) {
+			return 0, io.ErrUnexpectedEOF
+		}
+		fh.RemainLength += uint32(b[i]&0x7f) * m
+		if b[i]&0x80 == 0 {
+			return i + 1, nil
+		}
+		m *= 0x80
+		if m > 2097152 {
+			return 0, MALFORMED_REMAIN_LENGTH
+		}
+	}
+}
+
+func decodePublish(m *PublishMessage, body []byte) error {
+	if len(body) < 2 {
+		return PACKET_IS_TRUNCATED
+	}
+	i := 2 + int(binary.BigEndian.Uint16(body))
+	if len(body) < i {
+		return PACKET_IS_TRUNCATED
+	}
+	topic := body[2:i]
+	if !utf8.Valid(topic) || bytes.IndexByte(topic, 0) >= 0 {
+		return INVALID_UTF8_STRING
+	}
+	if bytes.ContainsAny(topic, "#+") {
+		return WILDCARD_CHARACTERS_IN_PUBLISH
+	}
+	// the comparison does not allocate the string
+	if m.TopicName != string(topic) {
+		m.TopicName = string(topic)
+	}
+	if m.QoS > 0 {
+		if len(body) < i+2 {
+			return PACKET_IS_TRUNCATED
+		}
+		m.PacketID = binary.BigEndian.Uint16(body[i:])
+		i += 2
+	}
+	m.Properties = nil
+	if m.isV5() {
+		props, n, err := ParseProperties(bytes.NewReader(body[i:]))
+		if err != nil {
+			return err
+		}
+		m.Properties = props
+		i += n
+	}
+	// the capacity is limited, so that append to Payload does not overwrite the next packet
+	m.Payload = body[i:len(body):len(body)]
+	return nil
+}
+
 type FixedHeader struct {
 	Type         MessageType
 	Dup          bool
@@ -70,6 +252,9 @@ type FixedHeader struct {
 	Retain       bool
 	RemainLength uint32
 	PacketID     uint16 // for easy use
+	// Level is the protocol level used by Write and the parsers,
+	// 0 is the same as MQTT 3.1.1
+	Level uint8
 }
 
 func NewFixedHeader(mType MessageType, dup bool, qos uint8, retain bool, length uint32, id uint16) *FixedHeader {
@@ -83,7 +268,74 @@ func NewFixedHeader(mType MessageType, dup bool, qos uint8, retain bool, length
 	}
 }
 
-func (self *FixedHeader) Write(w io.Writer) {
+func (self *FixedHeader) Write(w io.Writer) (int, error) {
+	b := make([]byte, 0, 5)
+	return w.Write(appendRemainLength(append(b, self.flags()), self.RemainLength))
+}
+
+func (self *FixedHeader) encode(w io.Writer) {
+	self.writeLength(w, self.RemainLength)
+}
+
+// writeWithBody is used by MQTT 5.0 messages whose length depends on the properties.
+func (self *FixedHeader) writeWithBody(w io.Writer, body *bytes.Buffer) {
+	self.writeLength(w, uint32(body.Len()))
+	w.Write(body.Bytes())
+}
+
+func (self *FixedHeader) writeLength(w io.Writer, length uint32) {
+	w.Write([]byte{self.flags()})
+	RemainEncode(w, length)
+}
+
+func (self *FixedHeader) SetLevel(level uint8) {
+	// written only when it changes, the message can be read by other goroutines
+	if self.Level != level {
+		self.Level = level
+	}
+}
+
+func (self *FixedHeader) GetLevel() uint8 {
+	return self.Level
+}
+
+func (self *FixedHeader) GetType() MessageType {
+	return self.Type
+}
+
+func (self *FixedHeader) isV5() bool {
+	return self.Level == MQTT_5_0.Level
+}
+
+func (self *FixedHeader) String() string {
+	return fmt.Sprintf("[%s]\nDupulicate=%t, QoS=%d, Retain=%t, Remain Length=%d",
+		self.Type.String(), self.Dup, self.QoS, self.Retain, self.RemainLength)
+}
+
+// setFlags sets the first byte of the packet and checks the reserved flags.
+func (self *FixedHeader) setFlags(b byte) error {
+	self.Type = MessageType(b >> 4)
+	self.Dup = b&0x08 == 0x08
+	self.QoS = byte((b >> 1) & 0x03)
+	self.Retain = b&0x01 == 0x01
+	switch self.Type {
+	case Pubrel, Subscribe, Unsubscribe:
+		if self.Dup || self.Retain || self.QoS != 1 {
+			return MALFORMED_FIXED_HEADER_RESERVED_BIT
+		}
+	case Publish:
+		if self.QoS == 3 {
+			return INVALID_QOS_3
+		}
+	default:
+		if self.Dup || self.Retain || self.QoS != 0 {
+			return MALFORMED_FIXED_HEADER_RESERVED_BIT
+		}
+	}
+	return nil
+}
+
+func (self *FixedHeader) flags() byte {
 	flags := uint8(self.Type) << 4
 	if self.Dup {
 		flags |= 0x08
@@ -92,13 +344,7 @@ func (self *FixedHeader) Write(w io.Writer) {
 	if self.Retain {
 		flags |= 0x01
 	}
-	binary.Write(w, binary.BigEndian, &flags)
-	RemainEncode(w, self.RemainLength)
-}
-
-func (self *FixedHeader) String() string {
-	return fmt.Sprintf("[%s]\nDupulicate=%t, QoS=%d, Retain=%t, Remain Length=%d",
-		ClFrames[self.Type].Apply(self.Type.String()), self.Dup, self.QoS, self.Retain, self.RemainLength)
+	return flags
 }
 
 func ParseFixedHeader(r io.Reader) (*FixedHeader, int, error) {
@@ -109,23 +355,8 @@ func ParseFixedHeader(r io.Reader) (*FixedHeader, int, error) {
 		// EOF only
 		return nil, 0, err
 	}
-	fh.Type = MessageType(tmp >> 4)
-	fh.Dup = tmp&0x08 == 0x08
-	fh.QoS = byte((tmp >> 1) & 0x03)
-	fh.Retain = tmp&0x01 == 0x01
-	switch fh.Type {
-	case Pubrel, Subscribe, Unsubscribe:
-		if fh.Dup || fh.Retain || fh.QoS != 1 {
-			return nil, 0, MALFORMED_FIXED_HEADER_RESERVED_BIT
-		}
-	case Publish:
-		if fh.QoS == 3 {
-			return nil, 0, INVALID_QOS_3
-		}
-	default:
-		if fh.Dup || fh.Retain || fh.QoS != 0 {
-			return nil, 0, MALFORMED_FIXED_HEADER_RESERVED_BIT
-		}
+	if err := fh.setFlags(tmp); err != nil {
+		return nil, 0, err
 	}
 
 	var length int
@@ -137,6 +368,95 @@ func ParseFixedHeader(r io.Reader) (*FixedHeader, int, error) {
 	return fh, length + 1, nil
 }
 
+// bufferPool keeps the buffers used to encode and read the messages.
+var bufferPool = sync.Pool{
+	New: func() interface{} {
+		b := make([]byte, 0, 512)
+		return &b
+	},
+}
+
+// maxPooledBuffer is the largest buffer put back to bufferPool,
+// a buffer grown by a large payload is left to the GC.
+const maxPooledBuffer = 64 * 1024
+
+func getBuffer() *[]byte {
+	return bufferPool.Get().(*[]byte)
+}
+
+func putBuffer(b *[]byte) {
+	if cap(*b) <= maxPooledBuffer {
+		*b = (*b)[:0]
+		bufferPool.Put(b)
+	}
+}
+
+type encoder interface {
+	encode(w io.Writer)
+}
+
+// writeMessage encodes the message into a pooled buffer, which never fails,
+// so that the error of w is the only error.
+func writeMessage(w io.Writer, m Message) (int, error) {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	*buf = AppendMessage(*buf, m)
+	return w.Write(*buf)
+}
+
+// AppendMessage appends the packet to b and returns the extended slice,
+// the bytes are the same as Write. PUBLISH and the acknowledgements
+// without MQTT 5.0 properties are appended without allocation.
+func AppendMessage(b []byte, m Message) []byte {
+	switch m := m.(type) {
+	case *PublishMessage:
+		return m.appendTo(b)
+	case *PubackMessage:
+		if !m.isV5() || m.ReasonCode == ReasonSuccess && len(m.Properties) == 0 {
+			return m.appendAck(b)
+		}
+	case *PubrecMessage:
+		if !m.isV5() || m.ReasonCode == ReasonSuccess && len(m.Properties) == 0 {
+			return m.appendAck(b)
+		}
+	case *PubrelMessage:
+		if !m.isV5() || m.ReasonCode == ReasonSuccess && len(m.Properties) == 0 {
+			return m.appendAck(b)
+		}
+	case *PubcompMessage:
+		if !m.isV5() || m.ReasonCode == ReasonSuccess && len(m.Properties) == 0 {
+			return m.appendAck(b)
+		}
+	}
+	buf := bytes.NewBuffer(b)
+	m.(encoder).encode(buf)
+	return buf.Bytes()
+}
+
+func appendRemainLength(b []byte, length uint32) []byte {
+	for {
+		digit := uint8(length % 128)
+		length /= 128
+		if length == 0 {
+			return append(b, digit)
+		}
+		b = append(b, digit|0x80)
+	}
+}
+
+func remainLengthSize(length uint32) int {
+	n := 1
+	for ; length >= 128; length /= 128 {
+		n++
+	}
+	return n
+}
+
+// appendAck appends the acknowledgement which has only the packet ID.
+func (self *FixedHeader) appendAck(b []byte) []byte {
+	return append(b, self.flags(), 2, byte(self.PacketID>>8), byte(self.PacketID))
+}
+
 type FrameParser func(fh *FixedHeader, r io.Reader) (Message, error)
 
 var ParseMessage = map[MessageType]FrameParser{
@@ -154,12 +474,18 @@ var ParseMessage = map[MessageType]FrameParser{
 	Pingreq:     ParsePingreqMessage,
 	Pingresp:    ParsePingrespMessage,
 	Disconnect:  ParseDisconnectMessage,
+	Auth:        ParseAuthMessage,
 }
 
 type Message interface {
-	Write(w io.Writer)
+	// Write encodes the message and writes it by a single Write
+	Write(w io.Writer) (int, error)
 	String() string
 	GetPacketID() uint16
+	GetType() MessageType
+	// SetLevel decides the protocol level used by Write
+	SetLevel(level uint8)
+	GetLevel() uint8
 }
 
 type ConnectFlag uint8
@@ -208,12 +534,13 @@ func (self ConnectFlag) String() (s string) {
 
 type ConnectMessage struct {
 	*FixedHeader
-	Protocol  *Protocol
-	Flags     ConnectFlag
-	KeepAlive uint16
-	ClientID  string
-	Will      *Will
-	User      *User
+	Protocol   *Protocol
+	Flags      ConnectFlag
+	KeepAlive  uint16
+	Properties Properties // MQTT 5.0
+	ClientID   string
+	Will       *Will
+	User       *User
 }
 
 type Protocol struct {
@@ -227,11 +554,36 @@ var MQTT_3_1_1 *Protocol = &Protocol{
 	Level: 4,
 }
 
+var MQTT_5_0 *Protocol = &Protocol{
+	Name:  "MQTT",
+	Level: 5,
+}
+
+var MQTT_3_1 *Protocol = &Protocol{
+	Name:  "MQIsdp",
+	Level: 3,
+}
+
+// MQTT 3.1 limits the client ID to 23 bytes
+const MaxClientIDLength_3_1 = 23
+
+// supported reports whether the name and the level are of the same version.
+func (self *Protocol) supported() bool {
+	switch self.Name {
+	case MQTT_3_1_1.Name:
+		return self.Level == MQTT_3_1_1.Level || self.Level == MQTT_5_0.Level
+	case MQTT_3_1.Name:
+		return self.Level == MQTT_3_1.Level
+	}
+	return false
+}
+
 type Will struct {
-	Topic   string
-	Message string
-	Retain  bool
-	QoS     uint8
+	Topic      string
+	Message    string
+	Retain     bool
+	QoS        uint8
+	Properties Properties // MQTT 5.0
 }
 
 func NewWill(topic, message string, retain bool, qos uint8) *Will {
@@ -243,8 +595,9 @@ func NewWill(topic, message string, retain bool, qos uint8) *Will {
 	}
 }
 
+// String omits the message, the frames are logged.
 func (self *Will) String() string {
-	return fmt.Sprintf("%s:%s, Retain=%t, QoS=%d", self.Topic, self.Message, self.Retain, self.QoS)
+	return fmt.Sprintf("%s:(%d bytes), Retain=%t, QoS=%d", self.Topic, len(self.Message), self.Retain, self.QoS)
 }
 
 func NewConnectMessage(keepAlive uint16, clientID string, cleanSession bool, will *Will, user *User) *ConnectMessage {
@@ -286,15 +639,32 @@ func NewConnectMessage(keepAlive uint16, clientID string, cleanSession bool, wil
 	}
 }
 
-func (self *ConnectMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
+// Write uses the level of Protocol instead of SetLevel. The length is taken
+// from the body because Protocol can be changed after NewConnectMessage.
+func (self *ConnectMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *ConnectMessage) encode(w io.Writer) {
+	var body bytes.Buffer
+	self.writeBody(&body, self.Protocol.Level == MQTT_5_0.Level)
+	self.FixedHeader.writeWithBody(w, &body)
+}
+
+func (self *ConnectMessage) writeBody(w io.Writer, v5 bool) {
 	_ = UTF8_encode(w, self.Protocol.Name)
 	binary.Write(w, binary.BigEndian, byte(self.Protocol.Level))
 	binary.Write(w, binary.BigEndian, byte(self.Flags))
 	binary.Write(w, binary.BigEndian, &self.KeepAlive)
+	if v5 {
+		self.Properties.Write(w)
+	}
 	_ = UTF8_encode(w, self.ClientID)
 
 	if self.Flags&Will_Flag == Will_Flag {
+		if v5 {
+			self.Will.Properties.Write(w)
+		}
 		_ = UTF8_encode(w, self.Will.Topic)
 		_ = UTF8_encode(w, self.Will.Message)
 	}
@@ -311,25 +681,60 @@ func ParseConnectMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 		FixedHeader: fh,
 		Protocol:    &Protocol{},
 	}
-	_ = UTF8_decode(r, &m.Protocol.Name)
-	// TODO: validate protocol version
-	binary.Read(r, binary.BigEndian, &m.Protocol.Level)
+	if _, err := UTF8_decode(r, &m.Protocol.Name); err != nil {
+		return nil, err
+	}
+	// the broker validates the protocol, it has to answer CONNACK to unknown level
+	if err := binary.Read(r, binary.BigEndian, &m.Protocol.Level); err != nil {
+		return nil, err
+	}
 	var tmp_f uint8
-	binary.Read(r, binary.BigEndian, &tmp_f)
+	if err := binary.Read(r, binary.BigEndian, &tmp_f); err != nil {
+		return nil, err
+	}
 	m.Flags = ConnectFlag(tmp_f)
 	if m.Flags&Reserved_Flag == Reserved_Flag {
 		return nil, MALFORMED_CONNECT_FLAG_BIT
 	}
-	if m.Flags&UserName_Flag != UserName_Flag && m.Flags&Password_Flag == Password_Flag {
+	v5 := m.Protocol.Level == MQTT_5_0.Level
+	// MQTT 5.0 allows password without user name
+	if !v5 && m.Flags&UserName_Flag != UserName_Flag && m.Flags&Password_Flag == Password_Flag {
 		return nil, USERNAME_DOES_NOT_EXIST_WITH_PASSWORD
 	}
-	binary.Read(r, binary.BigEndian, &m.KeepAlive)
+	if err := binary.Read(r, binary.BigEndian, &m.KeepAlive); err != nil {
+		return nil, err
+	}
+	var err error
+	if m.Protocol.Level == MQTT_3_1.Level {
+		fh.Level = m.Protocol.Level
+	}
+	if v5 {
+		// the following frames are parsed in this level
+		fh.Level = m.Protocol.Level
+		if m.Properties, _, err = ParseProperties(r); err != nil {
+			return nil, err
+		}
+	}
 
-	_ = UTF8_decode(r, &m.ClientID)
+	if _, err = UTF8_decode(r, &m.ClientID); err != nil {
+		return nil, err
+	}
 	if m.Flags&Will_Flag == Will_Flag {
 		m.Will = NewWill("", "", false, 0)
-		_ = UTF8_decode(r, &m.Will.Topic)
-		_ = UTF8_decode(r, &m.Will.Message)
+		if v5 {
+			if m.Will.Properties, _, err = ParseProperties(r); err != nil {
+				return nil, err
+			}
+		}
+		if _, err = UTF8_decode(r, &m.Will.Topic); err != nil {
+			return nil, err
+		}
+		// the will message is binary data
+		message, err := readBinary(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Will.Message = string(message)
 		m.Will.Retain = m.Flags&WillRetain_Flag == WillRetain_Flag
 		m.Will.QoS = uint8(m.Flags&WillQoS_3_Flag) >> 3
 	}
@@ -337,10 +742,17 @@ func ParseConnectMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	if m.Flags&UserName_Flag == UserName_Flag || m.Flags&Password_Flag == Password_Flag {
 		m.User = NewUser("", "")
 		if m.Flags&UserName_Flag == UserName_Flag {
-			_ = UTF8_decode(r, &m.User.Name)
+			if _, err = UTF8_decode(r, &m.User.Name); err != nil {
+				return nil, err
+			}
 		}
 		if m.Flags&Password_Flag == Password_Flag {
-			_ = UTF8_decode(r, &m.User.Passwd)
+			// the password is binary data
+			passwd, err := readBinary(r)
+			if err != nil {
+				return nil, err
+			}
+			m.User.Passwd = string(passwd)
 		}
 	}
 
@@ -352,10 +764,19 @@ func (self *ConnectMessage) String() string {
 	if self.Will != nil {
 		ws = self.Will.String()
 	}
+	var us string = "None"
+	if self.User != nil {
+		// the password is not logged
+		pass := ""
+		if len(self.User.Passwd) > 0 {
+			pass = "<redacted>"
+		}
+		us = fmt.Sprintf("{NAME:%s, PASS:%s}", self.User.Name, pass)
+	}
 
-	return fmt.Sprintf("%s\n\tProtocol=%s:%d, Flags=\n%s\t, KeepAlive=%d, ClientID=%s, Will=%s, UserInfo={NAME:%s, PASS:%s}\n",
+	return fmt.Sprintf("%s\n\tProtocol=%s:%d, Flags=\n%s\t, KeepAlive=%d, ClientID=%s, Will=%s, UserInfo=%s\n",
 		self.FixedHeader.String(), self.Protocol.Name, self.Protocol.Level, self.Flags.String(),
-		self.KeepAlive, self.ClientID, ws, self.User.Name, self.User.Passwd)
+		self.KeepAlive, self.ClientID, ws, us)
 }
 
 func (self *ConnectMessage) GetPacketID() uint16 {
@@ -374,6 +795,10 @@ const (
 )
 
 func (self ConnectReturnCode) String() string {
+	// the code of CONNACK can be anything on the wire
+	if self > NotAuthorized {
+		return fmt.Sprintf("ConnectReturnCode(%d)", uint8(self))
+	}
 	return []string{
 		"Accepted",
 		"UnacceptableProtocolVersion",
@@ -392,6 +817,9 @@ type ConnackMessage struct {
 	*FixedHeader
 	SessionPresentFlag bool
 	ReturnCode         ConnectReturnCode
+	// ReasonCode is used instead of ReturnCode in MQTT 5.0
+	ReasonCode ReasonCode
+	Properties Properties
 }
 
 func NewConnackMessage(flag bool, code ConnectReturnCode) *ConnackMessage {
@@ -403,17 +831,31 @@ func NewConnackMessage(flag bool, code ConnectReturnCode) *ConnackMessage {
 		),
 		SessionPresentFlag: flag,
 		ReturnCode:         code,
+		ReasonCode:         code.ReasonCode(),
 	}
 }
 
-func (self *ConnackMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
+func (self *ConnackMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *ConnackMessage) encode(w io.Writer) {
 	var sPresentFlag byte = 0
-	if self.SessionPresentFlag {
+	// MQTT 3.1 does not have the flag
+	if self.SessionPresentFlag && self.Level != MQTT_3_1.Level {
 		sPresentFlag = 0x01
 	}
-	binary.Write(w, binary.BigEndian, &sPresentFlag)
-	binary.Write(w, binary.BigEndian, byte(self.ReturnCode))
+	if !self.isV5() {
+		self.FixedHeader.encode(w)
+		binary.Write(w, binary.BigEndian, &sPresentFlag)
+		binary.Write(w, binary.BigEndian, byte(self.ReturnCode))
+		return
+	}
+	var body bytes.Buffer
+	body.WriteByte(sPresentFlag)
+	body.WriteByte(byte(self.ReasonCode))
+	self.Properties.Write(&body)
+	self.FixedHeader.writeWithBody(w, &body)
 }
 
 func (self *ConnackMessage) String() string {
@@ -430,16 +872,28 @@ func ParseConnackMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 		FixedHeader: fh,
 	}
 	tmp := make([]byte, 2)
-	r.Read(tmp)
+	_, err := io.ReadFull(r, tmp)
+	if err != nil {
+		return nil, err
+	}
 	m.SessionPresentFlag = (tmp[0] == 1)
-	m.ReturnCode = ConnectReturnCode(tmp[1])
+	if !fh.isV5() {
+		m.ReturnCode = ConnectReturnCode(tmp[1])
+		return m, nil
+	}
+	m.ReasonCode = ReasonCode(tmp[1])
+	m.ReturnCode = m.ReasonCode.ConnectReturnCode()
+	if m.Properties, _, err = ParseProperties(r); err != nil {
+		return nil, err
+	}
 	return m, nil
 }
 
 type PublishMessage struct {
 	*FixedHeader
-	TopicName string
-	Payload   []uint8
+	TopicName  string
+	Properties Properties // MQTT 5.0
+	Payload    []uint8
 }
 
 func NewPublishMessage(dup bool, qos uint8, retain bool, topic string, id uint16, payload []uint8) *PublishMessage {
@@ -462,13 +916,34 @@ func NewPublishMessage(dup bool, qos uint8, retain bool, topic string, id uint16
 	}
 }
 
-func (self *PublishMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
-	_ = UTF8_encode(w, self.TopicName)
+func (self *PublishMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *PublishMessage) appendTo(b []byte) []byte {
+	length := 2 + len(self.TopicName) + len(self.Payload)
 	if self.QoS > 0 {
-		binary.Write(w, binary.BigEndian, &self.PacketID)
+		length += 2
+	}
+	var props []byte
+	if self.isV5() {
+		// the properties are rarely used for the telemetry
+		if len(self.Properties) > 0 {
+			props = self.Properties.encode()
+		}
+		length += remainLengthSize(uint32(len(props))) + len(props)
+	}
+	b = appendRemainLength(append(b, self.flags()), uint32(length))
+	b = append(b, byte(len(self.TopicName)>>8), byte(len(self.TopicName)))
+	b = append(b, self.TopicName...)
+	if self.QoS > 0 {
+		b = append(b, byte(self.PacketID>>8), byte(self.PacketID))
 	}
-	w.Write(self.Payload)
+	if self.isV5() {
+		b = appendRemainLength(b, uint32(len(props)))
+		b = append(b, props...)
+	}
+	return append(b, self.Payload...)
 }
 
 func (self *PublishMessage) String() string {
@@ -483,22 +958,77 @@ func ParsePublishMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &PublishMessage{
 		FixedHeader: fh,
 	}
-	len := UTF8_decode(r, &m.TopicName)
+	n, err := UTF8_decode(r, &m.TopicName)
+	if err != nil {
+		return nil, err
+	}
+	len := uint32(n)
 	if strings.Contains(m.TopicName, "#") || strings.Contains(m.TopicName, "+") {
 		return nil, WILDCARD_CHARACTERS_IN_PUBLISH
 	}
 	if fh.QoS > 0 {
-		binary.Read(r, binary.BigEndian, &m.PacketID)
+		if err := binary.Read(r, binary.BigEndian, &m.PacketID); err != nil {
+			return nil, err
+		}
 		len += 2
 	}
-	m.Payload = make([]byte, fh.RemainLength-uint32(len))
-	r.Read(m.Payload)
+	if fh.isV5() {
+		props, n, err := ParseProperties(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Properties = props
+		len += uint32(n)
+	}
+	if len > fh.RemainLength {
+		return nil, PACKET_IS_TRUNCATED
+	}
+	m.Payload = make([]byte, fh.RemainLength-len)
+	// a single Read can return less than the payload on TCP
+	if _, err := io.ReadFull(r, m.Payload); err != nil {
+		return nil, err
+	}
 
 	return m, nil
 }
 
+// writeAck writes PUBACK, PUBREC, PUBREL and PUBCOMP of MQTT 5.0,
+// the reason code and the properties are omitted when they are not needed.
+func writeAck(w io.Writer, fh *FixedHeader, code ReasonCode, props Properties) {
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, &fh.PacketID)
+	if code != ReasonSuccess || len(props) > 0 {
+		body.WriteByte(byte(code))
+	}
+	if len(props) > 0 {
+		props.Write(&body)
+	}
+	fh.writeWithBody(w, &body)
+}
+
+func parseAck(fh *FixedHeader, r io.Reader) (code ReasonCode, props Properties, err error) {
+	if err = binary.Read(r, binary.BigEndian, &fh.PacketID); err != nil {
+		return
+	}
+	if !fh.isV5() || fh.RemainLength < 3 {
+		return
+	}
+	var tmp byte
+	if err = binary.Read(r, binary.BigEndian, &tmp); err != nil {
+		return
+	}
+	code = ReasonCode(tmp)
+	if fh.RemainLength > 3 {
+		props, _, err = ParseProperties(r)
+	}
+	return
+}
+
 type PubackMessage struct {
 	*FixedHeader
+	// MQTT 5.0
+	ReasonCode ReasonCode
+	Properties Properties
 }
 
 func NewPubackMessage(id uint16) *PubackMessage {
@@ -511,8 +1041,16 @@ func NewPubackMessage(id uint16) *PubackMessage {
 	}
 }
 
-func (self *PubackMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
+func (self *PubackMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *PubackMessage) encode(w io.Writer) {
+	if self.isV5() {
+		writeAck(w, self.FixedHeader, self.ReasonCode, self.Properties)
+		return
+	}
+	self.FixedHeader.encode(w)
 	binary.Write(w, binary.BigEndian, &self.PacketID)
 }
 
@@ -528,13 +1066,20 @@ func ParsePubackMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &PubackMessage{
 		FixedHeader: fh,
 	}
-	binary.Read(r, binary.BigEndian, &m.PacketID)
+	var err error
+	m.ReasonCode, m.Properties, err = parseAck(fh, r)
+	if err != nil {
+		return nil, err
+	}
 
 	return m, nil
 }
 
 type PubrecMessage struct {
 	*FixedHeader
+	// MQTT 5.0
+	ReasonCode ReasonCode
+	Properties Properties
 }
 
 func NewPubrecMessage(id uint16) *PubrecMessage {
@@ -547,10 +1092,17 @@ func NewPubrecMessage(id uint16) *PubrecMessage {
 	}
 }
 
-func (self *PubrecMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
-	binary.Write(w, binary.BigEndian, &self.PacketID)
+func (self *PubrecMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
 
+func (self *PubrecMessage) encode(w io.Writer) {
+	if self.isV5() {
+		writeAck(w, self.FixedHeader, self.ReasonCode, self.Properties)
+		return
+	}
+	self.FixedHeader.encode(w)
+	binary.Write(w, binary.BigEndian, &self.PacketID)
 }
 
 func (self *PubrecMessage) String() string {
@@ -565,13 +1117,20 @@ func ParsePubrecMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &PubrecMessage{
 		FixedHeader: fh,
 	}
-	binary.Read(r, binary.BigEndian, &m.PacketID)
+	var err error
+	m.ReasonCode, m.Properties, err = parseAck(fh, r)
+	if err != nil {
+		return nil, err
+	}
 
 	return m, nil
 }
 
 type PubrelMessage struct {
 	*FixedHeader
+	// MQTT 5.0
+	ReasonCode ReasonCode
+	Properties Properties
 }
 
 func NewPubrelMessage(id uint16) *PubrelMessage {
@@ -584,8 +1143,16 @@ func NewPubrelMessage(id uint16) *PubrelMessage {
 	}
 }
 
-func (self *PubrelMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
+func (self *PubrelMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *PubrelMessage) encode(w io.Writer) {
+	if self.isV5() {
+		writeAck(w, self.FixedHeader, self.ReasonCode, self.Properties)
+		return
+	}
+	self.FixedHeader.encode(w)
 	binary.Write(w, binary.BigEndian, &self.PacketID)
 }
 
@@ -601,13 +1168,20 @@ func ParsePubrelMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &PubrelMessage{
 		FixedHeader: fh,
 	}
-	binary.Read(r, binary.BigEndian, &m.PacketID)
+	var err error
+	m.ReasonCode, m.Properties, err = parseAck(fh, r)
+	if err != nil {
+		return nil, err
+	}
 
 	return m, nil
 }
 
 type PubcompMessage struct {
 	*FixedHeader
+	// MQTT 5.0
+	ReasonCode ReasonCode
+	Properties Properties
 }
 
 func NewPubcompMessage(id uint16) *PubcompMessage {
@@ -620,8 +1194,16 @@ func NewPubcompMessage(id uint16) *PubcompMessage {
 	}
 }
 
-func (self *PubcompMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
+func (self *PubcompMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *PubcompMessage) encode(w io.Writer) {
+	if self.isV5() {
+		writeAck(w, self.FixedHeader, self.ReasonCode, self.Properties)
+		return
+	}
+	self.FixedHeader.encode(w)
 	binary.Write(w, binary.BigEndian, &self.PacketID)
 }
 
@@ -637,7 +1219,11 @@ func ParsePubcompMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &PubcompMessage{
 		FixedHeader: fh,
 	}
-	binary.Read(r, binary.BigEndian, &m.PacketID)
+	var err error
+	m.ReasonCode, m.Properties, err = parseAck(fh, r)
+	if err != nil {
+		return nil, err
+	}
 
 	return m, nil
 }
@@ -655,6 +1241,21 @@ type SubscribeTopic struct {
 	State SubscribeState
 	Topic string
 	QoS   uint8
+	// subscription options of MQTT 5.0
+	NoLocal           bool
+	RetainAsPublished bool
+	RetainHandling    uint8
+}
+
+func (self *SubscribeTopic) options() byte {
+	options := self.QoS | self.RetainHandling<<4
+	if self.NoLocal {
+		options |= 0x04
+	}
+	if self.RetainAsPublished {
+		options |= 0x08
+	}
+	return options
 }
 
 func NewSubscribeTopic(topic string, qos uint8) *SubscribeTopic {
@@ -667,6 +1268,7 @@ func NewSubscribeTopic(topic string, qos uint8) *SubscribeTopic {
 
 type SubscribeMessage struct {
 	*FixedHeader
+	Properties      Properties // MQTT 5.0
 	SubscribeTopics []*SubscribeTopic
 }
 
@@ -686,14 +1288,29 @@ func NewSubscribeMessage(id uint16, topics []*SubscribeTopic) *SubscribeMessage
 	}
 }
 
-func (self *SubscribeMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
-	binary.Write(w, binary.BigEndian, &self.PacketID)
+func (self *SubscribeMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
 
+func (self *SubscribeMessage) encode(w io.Writer) {
+	if !self.isV5() {
+		self.FixedHeader.encode(w)
+		binary.Write(w, binary.BigEndian, &self.PacketID)
+
+		for _, v := range self.SubscribeTopics {
+			_ = UTF8_encode(w, v.Topic)
+			binary.Write(w, binary.BigEndian, &v.QoS)
+		}
+		return
+	}
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, &self.PacketID)
+	self.Properties.Write(&body)
 	for _, v := range self.SubscribeTopics {
-		_ = UTF8_encode(w, v.Topic)
-		binary.Write(w, binary.BigEndian, &v.QoS)
+		_ = UTF8_encode(&body, v.Topic)
+		body.WriteByte(v.options())
 	}
+	self.FixedHeader.writeWithBody(w, &body)
 }
 
 func (self *SubscribeMessage) String() string {
@@ -713,15 +1330,40 @@ func ParseSubscribeMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &SubscribeMessage{
 		FixedHeader: fh,
 	}
-	err := binary.Read(r, binary.BigEndian, &m.PacketID)
-	if err == io.EOF {
-		return nil, PROTOCOL_VIOLATION
+	if err := binary.Read(r, binary.BigEndian, &m.PacketID); err != nil {
+		return nil, err
 	}
-	for i := 2; uint32(i) < fh.RemainLength; {
+	i := 2
+	if fh.isV5() {
+		props, n, err := ParseProperties(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Properties = props
+		i += n
+	}
+	for uint32(i) < fh.RemainLength {
 		subTopic := NewSubscribeTopic("", 0)
-		length := UTF8_decode(r, &subTopic.Topic)
+		length, err := UTF8_decode(r, &subTopic.Topic)
+		if err != nil {
+			return nil, err
+		}
+		if len(subTopic.Topic) == 0 {
+			return nil, TOPIC_FILTER_IS_EMPTY
+		}
 		var tmp byte
-		binary.Read(r, binary.BigEndian, &tmp)
+		if err := binary.Read(r, binary.BigEndian, &tmp); err != nil {
+			return nil, err
+		}
+		if fh.isV5() {
+			subTopic.NoLocal = tmp&0x04 == 0x04
+			subTopic.RetainAsPublished = tmp&0x08 == 0x08
+			subTopic.RetainHandling = (tmp >> 4) & 0x03
+			if tmp&0xc0 != 0 || subTopic.RetainHandling == 3 {
+				return nil, MALFORMED_SUBSCRIBE_RESERVED_PART
+			}
+			tmp &= 0x03
+		}
 		if tmp == 3 {
 			return nil, INVALID_QOS_3
 		} else if tmp > 3 {
@@ -731,6 +1373,9 @@ func ParseSubscribeMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 		m.SubscribeTopics = append(m.SubscribeTopics, subTopic)
 		i += int(length) + 1
 	}
+	if len(m.SubscribeTopics) == 0 {
+		return nil, NO_TOPIC_FILTER_IN_PAYLOAD
+	}
 
 	return m, nil
 }
@@ -755,6 +1400,8 @@ func (self SubscribeReturnCode) String() string {
 
 type SubackMessage struct {
 	*FixedHeader
+	Properties Properties // MQTT 5.0
+	// the reason codes of MQTT 5.0 are also put here
 	ReturnCodes []SubscribeReturnCode
 }
 
@@ -770,13 +1417,27 @@ func NewSubackMessage(id uint16, codes []SubscribeReturnCode) *SubackMessage {
 	}
 }
 
-func (self *SubackMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
-	binary.Write(w, binary.BigEndian, &self.PacketID)
+func (self *SubackMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *SubackMessage) encode(w io.Writer) {
+	if !self.isV5() {
+		self.FixedHeader.encode(w)
+		binary.Write(w, binary.BigEndian, &self.PacketID)
 
+		for _, v := range self.ReturnCodes {
+			binary.Write(w, binary.BigEndian, byte(v))
+		}
+		return
+	}
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, &self.PacketID)
+	self.Properties.Write(&body)
 	for _, v := range self.ReturnCodes {
-		binary.Write(w, binary.BigEndian, byte(v))
+		body.WriteByte(byte(v))
 	}
+	self.FixedHeader.writeWithBody(w, &body)
 }
 
 func (self *SubackMessage) String() string {
@@ -795,10 +1456,23 @@ func ParseSubackMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &SubackMessage{
 		FixedHeader: fh,
 	}
-	binary.Read(r, binary.BigEndian, &m.PacketID)
+	if err := binary.Read(r, binary.BigEndian, &m.PacketID); err != nil {
+		return nil, err
+	}
+	i := uint32(2)
+	if fh.isV5() {
+		props, n, err := ParseProperties(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Properties = props
+		i += uint32(n)
+	}
 	var tmp byte
-	for i := uint32(2); i < fh.RemainLength; i++ {
-		binary.Read(r, binary.BigEndian, &tmp)
+	for ; i < fh.RemainLength; i++ {
+		if err := binary.Read(r, binary.BigEndian, &tmp); err != nil {
+			return nil, err
+		}
 		m.ReturnCodes = append(m.ReturnCodes, SubscribeReturnCode(tmp))
 	}
 
@@ -807,6 +1481,7 @@ func ParseSubackMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 
 type UnsubscribeMessage struct {
 	*FixedHeader
+	Properties Properties // MQTT 5.0
 	TopicNames []string
 }
 
@@ -825,13 +1500,27 @@ func NewUnsubscribeMessage(id uint16, topics []string) *UnsubscribeMessage {
 	}
 }
 
-func (self *UnsubscribeMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
-	binary.Write(w, binary.BigEndian, &self.PacketID)
+func (self *UnsubscribeMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
 
+func (self *UnsubscribeMessage) encode(w io.Writer) {
+	if !self.isV5() {
+		self.FixedHeader.encode(w)
+		binary.Write(w, binary.BigEndian, &self.PacketID)
+
+		for _, v := range self.TopicNames {
+			_ = UTF8_encode(w, v)
+		}
+		return
+	}
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, &self.PacketID)
+	self.Properties.Write(&body)
 	for _, v := range self.TopicNames {
-		_ = UTF8_encode(w, v)
+		_ = UTF8_encode(&body, v)
 	}
+	self.FixedHeader.writeWithBody(w, &body)
 }
 
 func (self *UnsubscribeMessage) String() string {
@@ -850,22 +1539,42 @@ func ParseUnsubscribeMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &UnsubscribeMessage{
 		FixedHeader: fh,
 	}
-	err := binary.Read(r, binary.BigEndian, &m.PacketID)
-	if err == io.EOF {
-		return nil, PROTOCOL_VIOLATION
+	if err := binary.Read(r, binary.BigEndian, &m.PacketID); err != nil {
+		return nil, err
+	}
+	i := uint32(2)
+	if fh.isV5() {
+		props, n, err := ParseProperties(r)
+		if err != nil {
+			return nil, err
+		}
+		m.Properties = props
+		i += uint32(n)
 	}
 	var topicName string
-	for i := uint32(2); i < fh.RemainLength; {
-		len := UTF8_decode(r, &topicName)
+	for i < fh.RemainLength {
+		len, err := UTF8_decode(r, &topicName)
+		if err != nil {
+			return nil, err
+		}
+		if topicName == "" {
+			return nil, TOPIC_FILTER_IS_EMPTY
+		}
 		m.TopicNames = append(m.TopicNames, topicName)
 		i += uint32(len)
 	}
+	if len(m.TopicNames) == 0 {
+		return nil, NO_TOPIC_FILTER_IN_PAYLOAD
+	}
 
 	return m, nil
 }
 
 type UnsubackMessage struct {
 	*FixedHeader
+	// MQTT 5.0, a reason code for each topic filter of UNSUBSCRIBE
+	Properties  Properties
+	ReasonCodes []ReasonCode
 }
 
 func NewUnsubackMessage(id uint16) *UnsubackMessage {
@@ -878,9 +1587,23 @@ func NewUnsubackMessage(id uint16) *UnsubackMessage {
 	}
 }
 
-func (self *UnsubackMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
-	binary.Write(w, binary.BigEndian, &self.PacketID)
+func (self *UnsubackMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *UnsubackMessage) encode(w io.Writer) {
+	if !self.isV5() {
+		self.FixedHeader.encode(w)
+		binary.Write(w, binary.BigEndian, &self.PacketID)
+		return
+	}
+	var body bytes.Buffer
+	binary.Write(&body, binary.BigEndian, &self.PacketID)
+	self.Properties.Write(&body)
+	for _, v := range self.ReasonCodes {
+		body.WriteByte(byte(v))
+	}
+	self.FixedHeader.writeWithBody(w, &body)
 }
 
 func (self *UnsubackMessage) String() string {
@@ -895,7 +1618,24 @@ func ParseUnsubackMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &UnsubackMessage{
 		FixedHeader: fh,
 	}
-	binary.Read(r, binary.BigEndian, &m.PacketID)
+	if err := binary.Read(r, binary.BigEndian, &m.PacketID); err != nil {
+		return nil, err
+	}
+	if !fh.isV5() {
+		return m, nil
+	}
+	props, n, err := ParseProperties(r)
+	if err != nil {
+		return nil, err
+	}
+	m.Properties = props
+	var tmp byte
+	for i := uint32(2 + n); i < fh.RemainLength; i++ {
+		if err := binary.Read(r, binary.BigEndian, &tmp); err != nil {
+			return nil, err
+		}
+		m.ReasonCodes = append(m.ReasonCodes, ReasonCode(tmp))
+	}
 
 	return m, nil
 }
@@ -914,8 +1654,12 @@ func NewPingreqMessage() *PingreqMessage {
 	}
 }
 
-func (self *PingreqMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w) // CHECK: Is this correct?
+func (self *PingreqMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *PingreqMessage) encode(w io.Writer) {
+	self.FixedHeader.encode(w) // CHECK: Is this correct?
 }
 
 func (self *PingreqMessage) String() string {
@@ -948,8 +1692,12 @@ func NewPingrespMessage() *PingrespMessage {
 	}
 }
 
-func (self *PingrespMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w) // CHECK: Is this correct?
+func (self *PingrespMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *PingrespMessage) encode(w io.Writer) {
+	self.FixedHeader.encode(w) // CHECK: Is this correct?
 }
 
 func (self *PingrespMessage) String() string {
@@ -970,6 +1718,9 @@ func ParsePingrespMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 
 type DisconnectMessage struct {
 	*FixedHeader
+	// MQTT 5.0
+	ReasonCode ReasonCode
+	Properties Properties
 }
 
 func NewDisconnectMessage() *DisconnectMessage {
@@ -982,12 +1733,22 @@ func NewDisconnectMessage() *DisconnectMessage {
 	}
 }
 
-func (self *DisconnectMessage) Write(w io.Writer) {
-	self.FixedHeader.Write(w)
+func (self *DisconnectMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *DisconnectMessage) encode(w io.Writer) {
+	if self.isV5() {
+		writeReason(w, self.FixedHeader, self.ReasonCode, self.Properties)
+		return
+	}
+	self.FixedHeader.encode(w)
 }
 
 func (self *DisconnectMessage) String() string {
-	// TODO: need to put disconnect message?
+	if self.isV5() {
+		return fmt.Sprintf("%s\n\tReason code=%s, Properties=%s\n", self.FixedHeader.String(), self.ReasonCode, self.Properties)
+	}
 	return fmt.Sprintf("%s\n", self.FixedHeader.String())
 }
 
@@ -999,5 +1760,87 @@ func ParseDisconnectMessage(fh *FixedHeader, r io.Reader) (Message, error) {
 	m := &DisconnectMessage{
 		FixedHeader: fh,
 	}
+	var err error
+	m.ReasonCode, m.Properties, err = parseReason(fh, r)
+	if err != nil {
+		return nil, err
+	}
+	return m, nil
+}
+
+// writeReason writes DISCONNECT and AUTH of MQTT 5.0,
+// the reason code and the properties are omitted when they are not needed.
+func writeReason(w io.Writer, fh *FixedHeader, code ReasonCode, props Properties) {
+	var body bytes.Buffer
+	if code != ReasonSuccess || len(props) > 0 {
+		body.WriteByte(byte(code))
+	}
+	if len(props) > 0 {
+		props.Write(&body)
+	}
+	fh.writeWithBody(w, &body)
+}
+
+func parseReason(fh *FixedHeader, r io.Reader) (code ReasonCode, props Properties, err error) {
+	if !fh.isV5() || fh.RemainLength == 0 {
+		return
+	}
+	var tmp byte
+	if err = binary.Read(r, binary.BigEndian, &tmp); err != nil {
+		return
+	}
+	code = ReasonCode(tmp)
+	if fh.RemainLength > 1 {
+		props, _, err = ParseProperties(r)
+	}
+	return
+}
+
+// AuthMessage is used for the extended authentication of MQTT 5.0
+type AuthMessage struct {
+	*FixedHeader
+	ReasonCode ReasonCode
+	Properties Properties
+}
+
+func NewAuthMessage(code ReasonCode, props Properties) *AuthMessage {
+	fh := NewFixedHeader(
+		Auth,
+		false, 0, false,
+		0, 0,
+	)
+	fh.Level = MQTT_5_0.Level
+	return &AuthMessage{
+		FixedHeader: fh,
+		ReasonCode:  code,
+		Properties:  props,
+	}
+}
+
+func (self *AuthMessage) Write(w io.Writer) (int, error) {
+	return writeMessage(w, self)
+}
+
+func (self *AuthMessage) encode(w io.Writer) {
+	writeReason(w, self.FixedHeader, self.ReasonCode, self.Properties)
+}
+
+func (self *AuthMessage) String() string {
+	return fmt.Sprintf("%s\n\tReason code=%s, Properties=%s\n", self.FixedHeader.String(), self.ReasonCode, self.Properties)
+}
+
+func (self *AuthMessage) GetPacketID() uint16 {
+	return self.PacketID
+}
+
+func ParseAuthMessage(fh *FixedHeader, r io.Reader) (Message, error) {
+	m := &AuthMessage{
+		FixedHeader: fh,
+	}
+	var err error
+	m.ReasonCode, m.Properties, err = parseReason(fh, r)
+	if err != nil {
+		return nil, err
+	}
 	return m, nil
 }
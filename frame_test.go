@@ -2,8 +2,13 @@ package MQTTg
 
 import (
 	"encoding/binary"
+	"errors"
+	"io"
 	"reflect"
+	"runtime"
+	"strings"
 	"testing"
+	"testing/iotest"
 	"bytes"
 )
 
@@ -12,7 +17,7 @@ func TestNewFixedHeader(t *testing.T) {
 	r, d := true, true
 	var q uint8 = 2
 	var rl uint32 = 1
-	e_fh := &FixedHeader{tp, d, q, r, rl, 0}
+	e_fh := &FixedHeader{tp, d, q, r, rl, 0, 0}
 	a_fh := NewFixedHeader(tp, d, q, r, rl, 0)
 	if !reflect.DeepEqual(e_fh, a_fh) {
 		t.Errorf("got %v\nwant %v", a_fh, e_fh)
@@ -564,3 +569,315 @@ func TestReadFrame(t *testing.T) {
 	}
 
 }
+
+func TestConnectMessageStringRedacted(t *testing.T) {
+	m := NewConnectMessage(60, "redacted", true, NewWill("a/b", "secret will", false, 1), NewUser("name", "secret pass"))
+	if str := m.String(); strings.Contains(str, "secret") || !strings.Contains(str, "name") {
+		t.Errorf("got %s\nwant the string without the password and the will message", str)
+	}
+}
+
+func TestConnectMessage_3_1(t *testing.T) {
+	e_m := NewConnectMessage(10, "legacy-device", true, nil, nil)
+	e_m.Protocol = MQTT_3_1
+	var wire bytes.Buffer
+	e_m.Write(&wire)
+
+	a_m, err := ReadFrame(&wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	connect := a_m.(*ConnectMessage)
+	if !reflect.DeepEqual(connect.Protocol, MQTT_3_1) || connect.ClientID != e_m.ClientID {
+		t.Errorf("got %v\nwant %v", connect, e_m)
+	}
+	if connect.GetLevel() != MQTT_3_1.Level {
+		t.Errorf("got %v\nwant %v", connect.GetLevel(), MQTT_3_1.Level)
+	}
+
+	// CONNACK of MQTT 3.1 does not have the session present flag
+	connack := NewConnackMessage(true, Accepted)
+	connack.SetLevel(MQTT_3_1.Level)
+	var a_wire bytes.Buffer
+	connack.Write(&a_wire)
+	e_wire := []byte{byte(Connack) << 4, 2, 0x00, byte(Accepted)}
+	if !bytes.Equal(a_wire.Bytes(), e_wire) {
+		t.Errorf("got %v\nwant %v", a_wire.Bytes(), e_wire)
+	}
+}
+
+func TestReadFrameMalformed(t *testing.T) {
+	ping := []byte{byte(Pingreq) << 4, 0}
+	tests := []struct {
+		name     string
+		wire     []byte
+		expected error
+	}{
+		{"the stream ends in the packet", []byte{byte(Publish) << 4, 10, 0x00, 0x01, 'a'}, PACKET_IS_TRUNCATED},
+		{"the topic is longer than the packet", []byte{byte(Publish) << 4, 3, 0x00, 0x05, 'a'}, PACKET_IS_TRUNCATED},
+		{"PUBACK has extra bytes", []byte{byte(Puback) << 4, 3, 0x00, 0x01, 0xff}, PACKET_HAS_EXTRA_BYTES},
+		{"invalid UTF-8", []byte{byte(Subscribe)<<4 | 0x02, 7, 0x00, 0x01, 0x00, 0x02, 0xc3, 0x28, 0x00}, INVALID_UTF8_STRING},
+		{"U+0000 in the topic", []byte{byte(Publish) << 4, 5, 0x00, 0x03, 'a', 0x00, 'b'}, INVALID_UTF8_STRING},
+		{"SUBSCRIBE without topic filter", []byte{byte(Subscribe)<<4 | 0x02, 2, 0x00, 0x01}, NO_TOPIC_FILTER_IN_PAYLOAD},
+		{"empty topic filter in SUBSCRIBE", []byte{byte(Subscribe)<<4 | 0x02, 5, 0x00, 0x01, 0x00, 0x00, 0x00}, TOPIC_FILTER_IS_EMPTY},
+		{"UNSUBSCRIBE without topic filter", []byte{byte(Unsubscribe)<<4 | 0x02, 2, 0x00, 0x01}, NO_TOPIC_FILTER_IN_PAYLOAD},
+		{"empty topic filter in UNSUBSCRIBE", []byte{byte(Unsubscribe)<<4 | 0x02, 4, 0x00, 0x01, 0x00, 0x00}, TOPIC_FILTER_IS_EMPTY},
+	}
+	for _, test := range tests {
+		r := bytes.NewReader(append(test.wire, ping...))
+		_, err := ReadFrame(r)
+		var malformed *MalformedPacketError
+		if !errors.As(err, &malformed) || malformed.Err != test.expected {
+			t.Errorf("%s: got %v\nwant %v", test.name, err, test.expected)
+			continue
+		}
+		// the following packet is not consumed by the broken one
+		if int(test.wire[1]) == len(test.wire)-2 {
+			if m, err := ReadFrame(r); err != nil || m.GetType() != Pingreq {
+				t.Errorf("%s: got %v, %v\nwant %v", test.name, m, err, Pingreq)
+			}
+		}
+	}
+}
+
+func TestReadFramePropertyLength(t *testing.T) {
+	// the property length of 256MB in a CONNECT of 16 bytes
+	wire := []byte{byte(Connect) << 4, 14, 0x00, 0x04, 'M', 'Q', 'T', 'T', 5, 0x02, 0x00, 0x3c, 0xff, 0xff, 0xff, 0x7f}
+	var before, after runtime.MemStats
+	runtime.ReadMemStats(&before)
+	_, err := readFrame(bytes.NewReader(wire), MQTT_5_0.Level, 64)
+	runtime.ReadMemStats(&after)
+	if !errors.Is(err, PACKET_IS_TRUNCATED) {
+		t.Errorf("got %v\nwant %v", err, PACKET_IS_TRUNCATED)
+	}
+	if allocated := after.TotalAlloc - before.TotalAlloc; allocated > 1<<20 {
+		t.Errorf("got %v\nwant less than %v bytes allocated", allocated, 1<<20)
+	}
+
+	publish := []byte{byte(Publish) << 4, 8, 0x00, 0x01, 'a', 0xff, 0xff, 0xff, 0x7f, 'x'}
+	if _, _, err := DecodeMessage(publish, MQTT_5_0.Level); !errors.Is(err, PACKET_IS_TRUNCATED) {
+		t.Errorf("got %v\nwant %v", err, PACKET_IS_TRUNCATED)
+	}
+}
+
+func TestReadFrameShortRead(t *testing.T) {
+	e_m := NewPublishMessage(false, 1, false, "a/b", 1, []byte("payload of the short reads"))
+	var wire bytes.Buffer
+	e_m.Write(&wire)
+	// TCP can return any part of the packet
+	a_m, err := ReadFrame(iotest.OneByteReader(&wire))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(a_m.(*PublishMessage).Payload, e_m.Payload) {
+		t.Errorf("got %s\nwant %s", a_m.(*PublishMessage).Payload, e_m.Payload)
+	}
+}
+
+func TestReadFrameMaxSize(t *testing.T) {
+	// the remaining length of 256MB is refused before it is allocated
+	huge := []byte{byte(Publish) << 4, 0xff, 0xff, 0xff, 0x7f, 0x00, 0x01, 'a'}
+	r := bytes.NewReader(huge)
+	if _, err := readFrame(r, 0, 1024); err != PACKET_IS_TOO_LARGE {
+		t.Errorf("got %v\nwant %v", err, PACKET_IS_TOO_LARGE)
+	}
+	if r.Len() != 3 {
+		t.Errorf("got %v\nwant %v bytes left", r.Len(), 3)
+	}
+
+	m := NewPublishMessage(false, 0, false, "a", 0, make([]byte, 10))
+	var wire bytes.Buffer
+	m.Write(&wire)
+	size := uint32(wire.Len())
+	if _, err := readFrame(bytes.NewReader(wire.Bytes()), 0, size); err != nil {
+		t.Errorf("got %v\nwant nil", err)
+	}
+	if _, err := readFrame(bytes.NewReader(wire.Bytes()), 0, size-1); err != PACKET_IS_TOO_LARGE {
+		t.Errorf("got %v\nwant %v", err, PACKET_IS_TOO_LARGE)
+	}
+}
+
+func TestAppendMessage(t *testing.T) {
+	v5 := func(m Message) Message {
+		m.SetLevel(MQTT_5_0.Level)
+		return m
+	}
+	props := Properties{NewProperty(ContentType, "text/plain")}
+	v5Publish := v5(NewPublishMessage(false, 1, true, "a/b", 1, []byte("data"))).(*PublishMessage)
+	v5Publish.Properties = props
+	v5Puback := v5(NewPubackMessage(3)).(*PubackMessage)
+	v5Puback.ReasonCode = ReasonNoMatchingSubscribers
+
+	var body bytes.Buffer
+	UTF8_encode(&body, "a/b")
+	binary.Write(&body, binary.BigEndian, uint16(1))
+	props.Write(&body)
+	body.WriteString("data")
+	var e_v5Publish bytes.Buffer
+	NewFixedHeader(Publish, false, 1, true, uint32(body.Len()), 0).Write(&e_v5Publish)
+	e_v5Publish.Write(body.Bytes())
+
+	cases := []struct {
+		m      Message
+		e_wire []byte
+	}{
+		{NewPublishMessage(true, 2, false, "a/b", 5, []byte("data")),
+			[]byte{0x3c, 0x0b, 0x00, 0x03, 'a', '/', 'b', 0x00, 0x05, 'd', 'a', 't', 'a'}},
+		{NewPublishMessage(false, 0, false, "a", 0, nil), []byte{0x30, 0x03, 0x00, 0x01, 'a'}},
+		{v5(NewPublishMessage(false, 0, false, "a", 0, nil)), []byte{0x30, 0x04, 0x00, 0x01, 'a', 0x00}},
+		{v5Publish, e_v5Publish.Bytes()},
+		{NewPubackMessage(3), []byte{0x40, 0x02, 0x00, 0x03}},
+		{v5(NewPubrelMessage(3)), []byte{0x62, 0x02, 0x00, 0x03}},
+		{v5Puback, []byte{0x40, 0x03, 0x00, 0x03, byte(ReasonNoMatchingSubscribers)}},
+		{NewPingreqMessage(), []byte{0xc0, 0x00}},
+	}
+	for _, c := range cases {
+		prefix := []byte("xy")
+		a_wire := AppendMessage(prefix, c.m)
+		if !bytes.Equal(a_wire[:2], prefix) || !bytes.Equal(a_wire[2:], c.e_wire) {
+			t.Errorf("got %v\nwant %v", a_wire[2:], c.e_wire)
+		}
+		var w bytes.Buffer
+		if n, err := c.m.Write(&w); err != nil || !bytes.Equal(w.Bytes(), c.e_wire) || n != len(c.e_wire) {
+			t.Errorf("got %v, %v\nwant %v", w.Bytes(), err, c.e_wire)
+		}
+	}
+
+	m := NewPublishMessage(false, 1, false, "sensor/1", 1, make([]byte, 64))
+	buf := make([]byte, 0, 128)
+	allocs := testing.AllocsPerRun(100, func() {
+		buf = AppendMessage(buf[:0], m)
+	})
+	if allocs != 0 {
+		t.Errorf("got %v\nwant %v allocs", allocs, 0)
+	}
+}
+
+func TestDecodeMessage(t *testing.T) {
+	var wire []byte
+	e_ms := []Message{
+		NewPublishMessage(false, 1, false, "a/b", 1, []byte("first")),
+		NewPubackMessage(1),
+		NewPublishMessage(false, 0, false, "a/b", 0, []byte("second")),
+	}
+	for _, m := range e_ms {
+		wire = AppendMessage(wire, m)
+	}
+	b := wire
+	for _, e_m := range e_ms {
+		a_m, n, err := DecodeMessage(b, 0)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a_m.String() != e_m.String() {
+			t.Errorf("got %v\nwant %v", a_m, e_m)
+		}
+		if p, ok := a_m.(*PublishMessage); ok && &p.Payload[0] != &b[n-len(p.Payload)] {
+			t.Errorf("the payload is copied")
+		}
+		b = b[n:]
+	}
+	if _, _, err := DecodeMessage(b, 0); err != io.EOF {
+		t.Errorf("got %v\nwant %v", err, io.EOF)
+	}
+	if _, _, err := DecodeMessage(wire[:len(wire)-1], 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := DecodeMessage(wire[:3], 0); err != io.ErrUnexpectedEOF {
+		t.Errorf("got %v\nwant %v", err, io.ErrUnexpectedEOF)
+	}
+	// the same errors as ReadFrame
+	broken := []byte{0x30, 0x04, 0x00, 0x01, '#', 'x'}
+	if _, _, err := DecodeMessage(broken, 0); !errors.Is(err, WILDCARD_CHARACTERS_IN_PUBLISH) {
+		t.Errorf("got %v\nwant %v", err, WILDCARD_CHARACTERS_IN_PUBLISH)
+	}
+	if _, _, err := DecodeMessage([]byte{0x40, 0x03, 0x00, 0x01, 0x00}, 0); !errors.Is(err, PACKET_HAS_EXTRA_BYTES) {
+		t.Errorf("got %v\nwant %v", err, PACKET_HAS_EXTRA_BYTES)
+	}
+
+	v5 := NewPublishMessage(false, 1, false, "a/b", 7, []byte("data"))
+	v5.SetLevel(MQTT_5_0.Level)
+	v5.Properties = Properties{NewProperty(ContentType, "text/plain")}
+	a_m, _, err := DecodeMessage(AppendMessage(nil, v5), MQTT_5_0.Level)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a_p := a_m.(*PublishMessage)
+	if a_p.PacketID != v5.PacketID || !bytes.Equal(a_p.Payload, v5.Payload) || !reflect.DeepEqual(a_p.Properties, v5.Properties) {
+		t.Errorf("got %v\nwant %v", a_p, v5)
+	}
+}
+
+func TestDecodePublishMessage(t *testing.T) {
+	wire := AppendMessage(nil, NewPublishMessage(false, 1, false, "sensor/1", 1, []byte("data")))
+	m := &PublishMessage{}
+	if _, err := DecodePublishMessage(m, wire, 0); err != nil {
+		t.Fatal(err)
+	}
+	if m.TopicName != "sensor/1" || m.PacketID != 1 || string(m.Payload) != "data" {
+		t.Errorf("got %v\nwant %v", m, "sensor/1")
+	}
+	allocs := testing.AllocsPerRun(100, func() {
+		DecodePublishMessage(m, wire, 0)
+	})
+	if allocs != 0 {
+		t.Errorf("got %v\nwant %v allocs", allocs, 0)
+	}
+	if _, err := DecodePublishMessage(m, AppendMessage(nil, NewPubackMessage(1)), 0); err != INVALID_MESSAGE_CAME {
+		t.Errorf("got %v\nwant %v", err, INVALID_MESSAGE_CAME)
+	}
+}
+
+func benchmarkPublish() *PublishMessage {
+	return NewPublishMessage(false, 1, false, "telemetry/sensor/1", 1, make([]byte, 256))
+}
+
+func BenchmarkPublishWrite(b *testing.B) {
+	m := benchmarkPublish()
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		m.Write(io.Discard)
+	}
+}
+
+func BenchmarkPublishAppend(b *testing.B) {
+	m := benchmarkPublish()
+	buf := make([]byte, 0, 512)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		buf = AppendMessage(buf[:0], m)
+	}
+}
+
+func BenchmarkReadFramePublish(b *testing.B) {
+	wire := AppendMessage(nil, benchmarkPublish())
+	r := bytes.NewReader(wire)
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		r.Reset(wire)
+		if _, err := ReadFrame(r); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodeMessagePublish(b *testing.B) {
+	wire := AppendMessage(nil, benchmarkPublish())
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, _, err := DecodeMessage(wire, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+func BenchmarkDecodePublishMessage(b *testing.B) {
+	wire := AppendMessage(nil, benchmarkPublish())
+	m := &PublishMessage{}
+	b.ReportAllocs()
+	for i := 0; i < b.N; i++ {
+		if _, err := DecodePublishMessage(m, wire, 0); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
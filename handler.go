@@ -0,0 +1,99 @@
+package MQTTg
+
+import (
+	"sync"
+)
+
+// MessageHandler is called with the PUBLISH which came to the client.
+type MessageHandler func(client *Client, m *PublishMessage)
+
+// inbox passes the PUBLISH from ReadLoop to the handlers in order.
+// It is not bounded so that a slow handler never blocks ReadLoop.
+type inbox struct {
+	mu       sync.Mutex
+	messages []*PublishMessage
+	closed   bool
+	signal   chan struct{}
+}
+
+func newInbox() *inbox {
+	return &inbox{
+		messages: make([]*PublishMessage, 0),
+		signal:   make(chan struct{}, 1),
+	}
+}
+
+func (self *inbox) push(m *PublishMessage) {
+	self.mu.Lock()
+	self.messages = append(self.messages, m)
+	self.mu.Unlock()
+	select {
+	case self.signal <- struct{}{}:
+	default:
+		// the dispatcher has not taken the previous signal yet
+	}
+}
+
+// close tells the dispatcher that nothing is pushed any more.
+func (self *inbox) close() {
+	self.mu.Lock()
+	self.closed = true
+	self.mu.Unlock()
+	select {
+	case self.signal <- struct{}{}:
+	default:
+	}
+}
+
+// pop returns the messages pushed so far and whether the inbox is closed.
+func (self *inbox) pop() ([]*PublishMessage, bool) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	messages := self.messages
+	self.messages = make([]*PublishMessage, 0)
+	return messages, self.closed
+}
+
+// setHandler registers the handler of the filter, nil falls back to OnMessage.
+func (self *Client) setHandler(filter string, handler MessageHandler) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if handler == nil {
+		delete(self.handlers, filter)
+	} else {
+		self.handlers[filter] = handler
+	}
+}
+
+// matchHandlers returns the handlers of every filter which matches the topic,
+// or OnMessage when there is no such filter.
+func (self *Client) matchHandlers(topic string) []MessageHandler {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	handlers := make([]MessageHandler, 0, 1)
+	for filter, handler := range self.handlers {
+		if FilterCovers(filter, topic) {
+			handlers = append(handlers, handler)
+		}
+	}
+	if len(handlers) == 0 && self.OnMessage != nil {
+		handlers = append(handlers, self.OnMessage)
+	}
+	return handlers
+}
+
+// dispatchLoop calls the handlers with the messages of in until in is closed.
+// The messages left in in are still dispatched because they were acknowledged already.
+func (self *Client) dispatchLoop(in *inbox) {
+	for range in.signal {
+		messages, closed := in.pop()
+		for _, m := range messages {
+			for _, handler := range self.matchHandlers(m.TopicName) {
+				handler(self, m)
+			}
+		}
+		if closed {
+			return
+		}
+	}
+}
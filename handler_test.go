@@ -0,0 +1,122 @@
+package MQTTg
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestFilterHandlers(t *testing.T) {
+	c := NewClient("handler-client", nil, 0, nil)
+	temp := func(*Client, *PublishMessage) {}
+	all := func(*Client, *PublishMessage) {}
+	c.OnMessage = func(*Client, *PublishMessage) {}
+	c.setHandler("sensor/+/temp", temp)
+	c.setHandler("sensor/#", all)
+
+	tests := []struct {
+		topic    string
+		expected int
+	}{
+		{"sensor/a/temp", 2},
+		{"sensor/a/humidity", 1},
+		{"other", 1},
+	}
+	for _, test := range tests {
+		if actual := len(c.matchHandlers(test.topic)); actual != test.expected {
+			t.Errorf("%s: got %v\nwant %v", test.topic, actual, test.expected)
+		}
+	}
+	// nil removes the handler
+	c.setHandler("sensor/#", nil)
+	if actual := c.matchHandlers("sensor/a/humidity"); len(actual) != 1 || actual[0] == nil {
+		t.Errorf("got %v\nwant OnMessage", actual)
+	}
+}
+
+func TestClientMessageHandler(t *testing.T) {
+	b, addr := startTestBroker(t)
+	sub := NewClient("handler-sub", nil, 0, nil)
+	defaults := make(chan string, 10)
+	sub.OnMessage = func(c *Client, m *PublishMessage) {
+		defaults <- m.TopicName
+	}
+	pub := NewClient("handler-pub", nil, 0, nil)
+	for _, c := range []*Client{sub, pub} {
+		if err := c.Connect(addr, true); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(c.isConnecting) {
+			t.Fatal("could not connect")
+		}
+	}
+
+	release := make(chan bool)
+	received := make(chan string, 10)
+	sub.Subscribe([]*SubscribeTopic{NewSubscribeTopic("sensor/+/temp", 1), NewSubscribeTopic("other/#", 1)},
+		func(c *Client, m *PublishMessage) {
+			<-release
+			received <- string(m.Payload)
+		})
+	waitFor(func() bool { return len(b.TopicRoot.GetSubscribers("other/a")) == 1 })
+
+	for _, payload := range []string{"1", "2", "3"} {
+		pub.Publish("sensor/a/temp", payload, 1, false)
+	}
+	pub.Publish("other/a", "default", 0, false)
+
+	// ReadLoop acknowledges the messages while the handler is blocked
+	bc, _ := b.GetClient("handler-sub")
+	ok := waitFor(func() bool {
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+		return len(bc.PacketIDMap) == 0
+	})
+	if !ok {
+		t.Errorf("PUBACK is blocked by the handler")
+	}
+	close(release)
+
+	expected := []string{"1", "2", "3"}
+	actual := []string{}
+	for range expected {
+		select {
+		case payload := <-received:
+			actual = append(actual, payload)
+		case <-time.After(2 * time.Second):
+			t.Fatalf("got %v\nwant %v", actual, expected)
+		}
+	}
+	if !reflect.DeepEqual(actual, expected) {
+		t.Errorf("got %v\nwant %v", actual, expected)
+	}
+	select {
+	case topic := <-defaults:
+		if topic != "other/a" {
+			t.Errorf("got %v\nwant %v", topic, "other/a")
+		}
+	case <-time.After(2 * time.Second):
+		t.Errorf("OnMessage was not called")
+	}
+	sub.disconnectProcessing()
+	pub.disconnectProcessing()
+}
+
+func TestDispatchLoopDrainsClosedInbox(t *testing.T) {
+	c := NewClient("drain-client", nil, 0, nil)
+	received := make([]string, 0)
+	c.OnMessage = func(c *Client, m *PublishMessage) {
+		received = append(received, m.TopicName)
+	}
+	in := newInbox()
+	expected := []string{"a", "b", "c"}
+	for _, topic := range expected {
+		in.push(&PublishMessage{TopicName: topic})
+	}
+	// the messages were acknowledged before the connection was closed
+	in.close()
+	c.dispatchLoop(in)
+	if !reflect.DeepEqual(received, expected) {
+		t.Errorf("got %v\nwant %v", received, expected)
+	}
+}
@@ -0,0 +1,217 @@
+package MQTTg
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+var logger atomic.Pointer[slog.Logger]
+
+// SetLogger replaces the logger of the package, slog.Default() is used while it is nil.
+// Broker.Logger is used instead for the broker and its connections when it is set.
+func SetLogger(l *slog.Logger) {
+	logger.Store(l)
+}
+
+func currentLogger() *slog.Logger {
+	if l := logger.Load(); l != nil {
+		return l
+	}
+	return slog.Default()
+}
+
+func (self *Broker) logger() *slog.Logger {
+	if self.Logger != nil {
+		return self.Logger
+	}
+	return currentLogger()
+}
+
+func (self *Broker) emitError(e error) {
+	if e != nil {
+		logError(self.logger(), e)
+	}
+}
+
+func logError(l *slog.Logger, e error) {
+	kind := "NORMAL_ERROR"
+	if _, ok := e.(MQTT_ERROR); ok {
+		kind = "MQTT_ERROR"
+	}
+	l.Error(e.Error(), "kind", kind)
+}
+
+func (self *Transport) currentLogger() *slog.Logger {
+	if self != nil && self.logger != nil {
+		return self.logger
+	}
+	return currentLogger()
+}
+
+// logger has the client ID and the remote address of the connection.
+func (self *ClientInfo) logger() *slog.Logger {
+	self.mu.Lock()
+	id, ct := self.ID, self.Ct
+	self.mu.Unlock()
+	l := self.log
+	if l == nil {
+		l = currentLogger()
+	}
+	if id != "" {
+		l = l.With("client_id", id)
+	}
+	if ct != nil && ct.conn != nil {
+		l = l.With("remote_addr", ct.conn.RemoteAddr().String())
+	}
+	return l
+}
+
+func (self *ClientInfo) emitError(e error) {
+	if e != nil {
+		logError(self.logger(), e)
+	}
+}
+
+func (self *Transport) logFrame(direction string, m Message) {
+	l := self.currentLogger()
+	if !self.FrameDebug || !l.Enabled(context.Background(), slog.LevelDebug) {
+		return
+	}
+	l.Debug(direction,
+		"local_addr", self.conn.LocalAddr().String(),
+		"remote_addr", self.conn.RemoteAddr().String(),
+		"packet", m.GetType().String(),
+		"frame", m.String())
+}
+
+// ConsoleHandler writes colored lines for terminals. The "send" and "recv"
+// messages and the "packet" attribute are colored like the frames,
+// and the "frame" attribute is written as is after the line.
+type ConsoleHandler struct {
+	w     io.Writer
+	mu    *sync.Mutex
+	level slog.Leveler
+	// attrs are formatted by WithAttrs
+	attrs  string
+	prefix string
+}
+
+// NewConsoleHandler uses slog.LevelInfo when opts or opts.Level is nil.
+func NewConsoleHandler(w io.Writer, opts *slog.HandlerOptions) *ConsoleHandler {
+	var level slog.Leveler = slog.LevelInfo
+	if opts != nil && opts.Level != nil {
+		level = opts.Level
+	}
+	return &ConsoleHandler{
+		w:     w,
+		mu:    &sync.Mutex{},
+		level: level,
+	}
+}
+
+func (self *ConsoleHandler) Enabled(_ context.Context, level slog.Level) bool {
+	return level >= self.level.Level()
+}
+
+func (self *ConsoleHandler) Handle(_ context.Context, r slog.Record) error {
+	b := &strings.Builder{}
+	if !r.Time.IsZero() {
+		b.WriteString(r.Time.Format("15:04:05.000 "))
+	}
+	level := r.Level.String()
+	switch {
+	case r.Level >= slog.LevelError:
+		level = ClError.Apply(level)
+	case r.Level >= slog.LevelWarn:
+		level = ClWarn.Apply(level)
+	}
+	b.WriteString("[" + level + "] ")
+	switch r.Message {
+	case "send":
+		b.WriteString(ClSend.Apply("Send"))
+	case "recv":
+		b.WriteString(ClRecv.Apply("Recv"))
+	default:
+		b.WriteString(r.Message)
+	}
+	b.WriteString(self.attrs)
+	frame := ""
+	r.Attrs(func(a slog.Attr) bool {
+		if a.Key == "frame" && self.prefix == "" {
+			frame = a.Value.String()
+		} else {
+			self.appendAttr(b, self.prefix, a)
+		}
+		return true
+	})
+	b.WriteString("\n")
+	if frame != "" {
+		b.WriteString(frame + "\n")
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	_, err := io.WriteString(self.w, b.String())
+	return err
+}
+
+func (self *ConsoleHandler) appendAttr(b *strings.Builder, prefix string, a slog.Attr) {
+	a.Value = a.Value.Resolve()
+	if a.Equal(slog.Attr{}) {
+		return
+	}
+	if a.Value.Kind() == slog.KindGroup {
+		if a.Key != "" {
+			prefix += a.Key + "."
+		}
+		for _, ga := range a.Value.Group() {
+			self.appendAttr(b, prefix, ga)
+		}
+		return
+	}
+	value := a.Value.String()
+	switch a.Value.Kind() {
+	case slog.KindTime:
+		value = a.Value.Time().Format(time.RFC3339Nano)
+	case slog.KindString:
+		if a.Key == "packet" && prefix == "" {
+			value = colorPacket(value)
+		} else if strings.ContainsAny(value, " \t\n\"=") {
+			value = fmt.Sprintf("%q", value)
+		}
+	}
+	b.WriteString(" " + prefix + a.Key + "=" + value)
+}
+
+func colorPacket(name string) string {
+	for t := MessageType(1); int(t) < len(ClFrames); t++ {
+		if t.String() == name {
+			return ClFrames[t].Apply(name)
+		}
+	}
+	return name
+}
+
+func (self *ConsoleHandler) WithAttrs(attrs []slog.Attr) slog.Handler {
+	b := &strings.Builder{}
+	for _, a := range attrs {
+		self.appendAttr(b, self.prefix, a)
+	}
+	c := *self
+	c.attrs += b.String()
+	return &c
+}
+
+func (self *ConsoleHandler) WithGroup(name string) slog.Handler {
+	if name == "" {
+		return self
+	}
+	c := *self
+	c.prefix += name + "."
+	return &c
+}
@@ -0,0 +1,97 @@
+package MQTTg
+
+import (
+	"bytes"
+	"encoding/json"
+	"log/slog"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// lockedBuffer is written by the goroutines of the other tests too
+type lockedBuffer struct {
+	mu  sync.Mutex
+	buf bytes.Buffer
+}
+
+func (self *lockedBuffer) Write(p []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.Write(p)
+}
+
+func (self *lockedBuffer) String() string {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.buf.String()
+}
+
+func TestEmitErrorFields(t *testing.T) {
+	out := &lockedBuffer{}
+	SetLogger(slog.New(slog.NewJSONHandler(out, nil)))
+	defer SetLogger(nil)
+
+	local, remote := net.Pipe()
+	defer local.Close()
+	defer remote.Close()
+	c := NewClient("log-client", nil, 0, nil)
+	c.Ct = &Transport{conn: local}
+	c.emitError(CLIENT_TIMED_OUT)
+
+	var actual map[string]interface{}
+	for _, line := range strings.Split(out.String(), "\n") {
+		if strings.Contains(line, `"client_id":"log-client"`) {
+			if err := json.Unmarshal([]byte(line), &actual); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	expected := map[string]interface{}{
+		"level":       "ERROR",
+		"msg":         "CLIENT_TIMED_OUT",
+		"kind":        "MQTT_ERROR",
+		"client_id":   "log-client",
+		"remote_addr": "pipe",
+	}
+	for k, v := range expected {
+		if actual[k] != v {
+			t.Errorf("%s: got %v\nwant %v", k, actual[k], v)
+		}
+	}
+}
+
+func TestConsoleHandler(t *testing.T) {
+	out := &bytes.Buffer{}
+	l := slog.New(NewConsoleHandler(out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	l = l.With("remote_addr", "127.0.0.1:1883")
+	l.Debug("send", "packet", "Publish", "frame", "[Publish]\n\tTopic=a/b")
+	l.WithGroup("limits").Info("queue is full", "client id", "a b")
+	l.Debug("ping")
+
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	expected := []string{
+		"[DEBUG] Send remote_addr=127.0.0.1:1883 packet=Publish",
+		"[Publish]",
+		"\tTopic=a/b",
+		`[INFO] queue is full remote_addr=127.0.0.1:1883 limits.client id="a b"`,
+		"[DEBUG] ping remote_addr=127.0.0.1:1883",
+	}
+	if len(lines) != len(expected) {
+		t.Fatalf("got %q\nwant %q", lines, expected)
+	}
+	for i, line := range lines {
+		// the time is not compared
+		if !strings.HasSuffix(line, expected[i]) {
+			t.Errorf("got %q\nwant %q", line, expected[i])
+		}
+	}
+
+	out.Reset()
+	l = slog.New(NewConsoleHandler(out, nil))
+	l.Debug("ping")
+	if out.Len() != 0 {
+		t.Errorf("got %q\nwant nothing under the info level", out.String())
+	}
+}
@@ -0,0 +1,102 @@
+package MQTTg
+
+import (
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sort"
+	"strings"
+	"time"
+)
+
+// writeMetric writes a metric of the Prometheus text format,
+// the values are the samples by labels such as `type="Publish"`.
+func writeMetric(w io.Writer, name, kind, help string, values map[string]int64) {
+	fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	keys := make([]string, 0, len(values))
+	for labels := range values {
+		keys = append(keys, labels)
+	}
+	sort.Strings(keys)
+	for _, labels := range keys {
+		v := values[labels]
+		if labels != "" {
+			labels = "{" + labels + "}"
+		}
+		fmt.Fprintf(w, "%s%s %d\n", name, labels, v)
+	}
+}
+
+func (self *Broker) writeMetrics(w io.Writer) {
+	connected, total, subscriptions, inflight := self.clientStats()
+	gauge := func(name, help string, v int) {
+		writeMetric(w, name, "gauge", help, map[string]int64{"": int64(v)})
+	}
+	gauge("mqttg_clients_connected", "Number of connected clients.", connected)
+	gauge("mqttg_clients_total", "Number of clients including the offline sessions.", total)
+	gauge("mqttg_subscriptions", "Number of subscriptions.", subscriptions)
+	gauge("mqttg_inflight_messages", "Number of messages in PacketIDMap of every client.", inflight)
+	gauge("mqttg_retained_messages", "Number of retained messages.", self.retainedCount())
+	gauge("mqttg_uptime_seconds", "Seconds since the broker started.", int(time.Since(self.stats.started)/time.Second))
+
+	for _, direction := range []string{"received", "sent"} {
+		counters := &self.stats.received
+		if direction == "sent" {
+			counters = &self.stats.sent
+		}
+		values := make(map[string]int64)
+		for t := Connect; t <= Auth; t++ {
+			values[`type="`+t.String()+`"`] = counters[t].Load()
+		}
+		writeMetric(w, "mqttg_packets_"+direction+"_total", "counter",
+			"Number of packets "+direction+" by type.", values)
+	}
+	writeMetric(w, "mqttg_bytes_received_total", "counter", "Number of bytes received.",
+		map[string]int64{"": self.stats.bytesReceived.Load()})
+	writeMetric(w, "mqttg_bytes_sent_total", "counter", "Number of bytes sent.",
+		map[string]int64{"": self.stats.bytesSent.Load()})
+	writeMetric(w, "mqttg_messages_dropped_total", "counter", "Number of messages dropped by reason.",
+		map[string]int64{
+			`reason="offline_queue_full"`: self.stats.droppedQueueFull.Load(),
+			`reason="inflight_full"`:      self.stats.droppedInflight.Load(),
+		})
+	writeMetric(w, "mqttg_packets_too_large_total", "counter", "Number of packets larger than the maximum packet size.",
+		map[string]int64{"": self.stats.tooLarge.Load()})
+	writeMetric(w, "mqttg_auth_failures_total", "counter", "Number of requests rejected by Authenticator or Authorizer.",
+		map[string]int64{
+			`type="connect"`:   self.stats.connectDenied.Load(),
+			`type="publish"`:   self.stats.publishDenied.Load(),
+			`type="subscribe"`: self.stats.subscribeDenied.Load(),
+		})
+}
+
+// MetricsHandler serves the metrics in the Prometheus text format.
+func (self *Broker) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if err := self.initialize(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		b := &strings.Builder{}
+		self.writeMetrics(b)
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4; charset=utf-8")
+		io.WriteString(w, b.String())
+	})
+}
+
+// ServeMetrics serves MetricsHandler on the path, it returns BROKER_CLOSED after Shutdown.
+func (self *Broker) ServeMetrics(listener net.Listener, path string) error {
+	mux := http.NewServeMux()
+	mux.Handle(path, self.MetricsHandler())
+	if !self.trackListener(listener) {
+		listener.Close()
+		return BROKER_CLOSED
+	}
+	defer self.untrackListener(listener)
+	err := http.Serve(listener, mux)
+	if self.isClosed() {
+		return BROKER_CLOSED
+	}
+	return err
+}
@@ -0,0 +1,71 @@
+package MQTTg
+
+import (
+	"io/ioutil"
+	"net"
+	"net/http"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBrokerMetrics(t *testing.T) {
+	b, addr := startTestBroker(t)
+	path := filepath.Join(t.TempDir(), "acl")
+	ioutil.WriteFile(path, []byte("topic readwrite allowed/#\n"), 0600)
+	acl, err := NewACLAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Authorizer = acl
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go b.ServeMetrics(listener, "/metrics")
+
+	c := NewClient("metrics-client", nil, 0, nil)
+	if err := c.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("allowed/#", 1), NewSubscribeTopic("denied/#", 1)})
+	if err := c.Publish("allowed/a", "data", 1, true).WaitTimeout(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		"mqttg_clients_connected 1",
+		"mqttg_subscriptions 1",
+		"mqttg_retained_messages 1",
+		`mqttg_packets_received_total{type="Connect"} 1`,
+		`mqttg_packets_received_total{type="Publish"} 1`,
+		`mqttg_packets_sent_total{type="Connack"} 1`,
+		`mqttg_packets_sent_total{type="Puback"} 1`,
+		`mqttg_auth_failures_total{type="subscribe"} 1`,
+		`mqttg_messages_dropped_total{reason="offline_queue_full"} 0`,
+		"# TYPE mqttg_bytes_received_total counter",
+	}
+	body := ""
+	ok := waitFor(func() bool {
+		resp, err := http.Get("http://" + listener.Addr().String() + "/metrics")
+		if err != nil {
+			return false
+		}
+		defer resp.Body.Close()
+		b, _ := ioutil.ReadAll(resp.Body)
+		body = string(b)
+		for _, line := range expected {
+			if !strings.Contains(body, line+"\n") {
+				return false
+			}
+		}
+		return true
+	})
+	if !ok {
+		t.Errorf("got %s\nwant %q", body, expected)
+	}
+}
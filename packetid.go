@@ -0,0 +1,130 @@
+package MQTTg
+
+// DefaultMaxInflight is the window used when ClientInfo.MaxInflight is 0.
+const DefaultMaxInflight = 65535
+
+// packetIDs hands out the packet identifiers in order from 1 to 65535.
+// It is guarded by ClientInfo.mu.
+type packetIDs struct {
+	last uint16
+	// inflight are the identifiers handed out and not released yet
+	inflight map[uint16]struct{}
+	// released is closed and replaced when an identifier is released
+	released chan struct{}
+}
+
+func (self *packetIDs) init() {
+	if self.inflight == nil {
+		self.inflight = make(map[uint16]struct{})
+		self.released = make(chan struct{})
+	}
+}
+
+func (self *ClientInfo) maxInflight() int {
+	if self.MaxInflight <= 0 || self.MaxInflight > DefaultMaxInflight {
+		return DefaultMaxInflight
+	}
+	return self.MaxInflight
+}
+
+// usablePacketID needs mu to be held. It skips the identifiers of PacketIDMap
+// too, they can be the ones restored from the session.
+func (self *ClientInfo) usablePacketID() (uint16, error) {
+	self.packetIDs.init()
+	if len(self.packetIDs.inflight) >= self.maxInflight() {
+		return 0, PACKET_ID_IS_EXHAUSTED
+	}
+	for i := 0; i < 65535; i++ {
+		self.packetIDs.last++
+		if self.packetIDs.last == 0 {
+			self.packetIDs.last = 1
+		}
+		id := self.packetIDs.last
+		if _, ok := self.packetIDs.inflight[id]; ok {
+			continue
+		}
+		if _, ok := self.PacketIDMap[id]; ok {
+			continue
+		}
+		self.packetIDs.inflight[id] = struct{}{}
+		return id, nil
+	}
+	return 0, PACKET_ID_IS_EXHAUSTED
+}
+
+// getUsablePacketID returns PACKET_ID_IS_EXHAUSTED instead of blocking.
+func (self *ClientInfo) getUsablePacketID() (uint16, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.usablePacketID()
+}
+
+// waitPacketID blocks while the window is full,
+// and returns NOT_CONNECTED when the connection is closed.
+func (self *ClientInfo) waitPacketID() (uint16, error) {
+	for {
+		self.mu.Lock()
+		id, err := self.usablePacketID()
+		released, quit := self.packetIDs.released, self.LoopQuit
+		self.mu.Unlock()
+		if err != PACKET_ID_IS_EXHAUSTED {
+			return id, err
+		}
+		select {
+		case <-released:
+		case <-quit:
+			return 0, NOT_CONNECTED
+		}
+	}
+}
+
+// releasePacketID is called when the flow of the identifier is completed.
+func (self *ClientInfo) releasePacketID(id uint16) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.packetIDs.init()
+	if _, ok := self.packetIDs.inflight[id]; !ok {
+		return
+	}
+	delete(self.packetIDs.inflight, id)
+	close(self.packetIDs.released)
+	self.packetIDs.released = make(chan struct{})
+}
+
+// registerReceivedID needs mu to be held. PUBREC is kept until PUBREL comes,
+// except the one of MQTT 5.0 which ends the flow with the failure.
+func (self *ClientInfo) registerReceivedID(m *PubrecMessage) error {
+	if m.PacketID == 0 {
+		return PACKET_ID_SHOULD_NOT_BE_ZERO
+	}
+	if self.receivedIDs == nil {
+		self.receivedIDs = make(map[uint16]*PubrecMessage)
+	}
+	if stored, ok := self.receivedIDs[m.PacketID]; ok && stored != m {
+		// the same PUBREC is sent again for the duplicated PUBLISH
+		return PACKET_ID_IS_USED_ALREADY
+	}
+	if m.ReasonCode < 0x80 {
+		self.receivedIDs[m.PacketID] = m
+	}
+	return nil
+}
+
+// receivedPubrec returns PUBREC sent for the incoming QoS 2 PUBLISH of id,
+// it is nil when the PUBLISH is new.
+func (self *ClientInfo) receivedPubrec(id uint16) *PubrecMessage {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.receivedIDs[id]
+}
+
+// releaseReceived is called by PUBREL.
+func (self *ClientInfo) releaseReceived(id uint16) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.receivedIDs[id]; !ok {
+		return PACKET_ID_DOES_NOT_EXIST
+	}
+	delete(self.receivedIDs, id)
+	return nil
+}
@@ -0,0 +1,216 @@
+package MQTTg
+
+import (
+	"net"
+	"testing"
+	"time"
+)
+
+func TestUsablePacketID(t *testing.T) {
+	c := NewClient("id-client", nil, 0, nil)
+	c.PacketIDMap[2] = NewPubrecMessage(2)
+	expected := []uint16{1, 3, 4}
+	for _, e_id := range expected {
+		a_id, err := c.getUsablePacketID()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a_id != e_id {
+			t.Errorf("got %v\nwant %v", a_id, e_id)
+		}
+	}
+
+	// wraps to 1 and skips the identifiers in flight
+	c.releasePacketID(1)
+	c.packetIDs.last = 65534
+	expected = []uint16{65535, 1, 5}
+	for _, e_id := range expected {
+		a_id, _ := c.getUsablePacketID()
+		if a_id != e_id {
+			t.Errorf("got %v\nwant %v", a_id, e_id)
+		}
+	}
+}
+
+func TestMaxInflight(t *testing.T) {
+	c := NewClient("window-client", nil, 0, nil)
+	c.MaxInflight = 2
+	c.LoopQuit = make(chan bool)
+	c.getUsablePacketID()
+	c.getUsablePacketID()
+	if _, err := c.getUsablePacketID(); err != PACKET_ID_IS_EXHAUSTED {
+		t.Errorf("got %v\nwant %v", err, PACKET_ID_IS_EXHAUSTED)
+	}
+
+	// waitPacketID blocks until an identifier is released
+	got := make(chan uint16)
+	go func() {
+		id, _ := c.waitPacketID()
+		got <- id
+	}()
+	select {
+	case id := <-got:
+		t.Fatalf("got %v\nwant blocking", id)
+	case <-time.After(50 * time.Millisecond):
+	}
+	c.releasePacketID(1)
+	select {
+	case id := <-got:
+		if id != 3 {
+			t.Errorf("got %v\nwant %v", id, 3)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitPacketID was not released")
+	}
+
+	go func() {
+		_, err := c.waitPacketID()
+		if err != NOT_CONNECTED {
+			t.Errorf("got %v\nwant %v", err, NOT_CONNECTED)
+		}
+		got <- 0
+	}()
+	close(c.LoopQuit)
+	select {
+	case <-got:
+	case <-time.After(2 * time.Second):
+		t.Fatal("waitPacketID was not stopped by the disconnection")
+	}
+}
+
+func TestClientMaxInflight(t *testing.T) {
+	_, addr := startTestBroker(t)
+	c := NewClient("window-publisher", nil, 0, nil)
+	c.MaxInflight = 4
+	if err := c.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	// more messages than the window are published in order
+	tokens := make([]*Token, 0)
+	for i := 0; i < 50; i++ {
+		tokens = append(tokens, c.Publish("window/a", "data", uint8(1+i%2), false))
+	}
+	for _, token := range tokens {
+		if err := token.WaitTimeout(2 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	c.disconnectProcessing()
+}
+
+func TestClientPublishBeforeConnack(t *testing.T) {
+	// the broker which never sends CONNACK
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			defer conn.Close()
+			conn.Read(make([]byte, 1024))
+			time.Sleep(time.Second)
+		}
+	}()
+	c := NewClient("early-publisher", nil, 0, nil)
+	c.MaxInflight = 1
+	if err := c.Connect(listener.Addr().String(), true); err != nil {
+		t.Fatal(err)
+	}
+	defer c.disconnectProcessing()
+	// the ID of the dropped message is released, the second one is not blocked
+	for i := 0; i < 2; i++ {
+		token := c.Publish("early/a", "data", 1, false)
+		if err := token.WaitTimeout(500 * time.Millisecond); err != NOT_CONNECTED {
+			t.Errorf("%d: got %v\nwant %v", i, err, NOT_CONNECTED)
+		}
+	}
+}
+
+// expectFrame reads the next frame sent to the peer.
+func expectFrame(t *testing.T, peer *Transport, mt MessageType, id uint16) Message {
+	t.Helper()
+	peer.conn.SetReadDeadline(time.Now().Add(2 * time.Second))
+	m, err := peer.ReadMessage()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if m.GetType() != mt || m.GetPacketID() != id {
+		t.Fatalf("got %v\nwant %v of %d", m, mt, id)
+	}
+	return m
+}
+
+// exchangeIncomingQoS2 sends QoS 2 PUBLISH of id from the peer and completes its flow.
+func exchangeIncomingQoS2(t *testing.T, peer *Transport, id uint16) {
+	t.Helper()
+	peer.SendMessage(NewPublishMessage(false, 2, false, "incoming/a", id, []byte("data")))
+	expectFrame(t, peer, Pubrec, id)
+	peer.SendMessage(NewPubrelMessage(id))
+	expectFrame(t, peer, Pubcomp, id)
+}
+
+func TestPacketIDInflightBothWays(t *testing.T) {
+	// the client publishes with ID 1 and receives QoS 2 PUBLISH with ID 1
+	listener, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	accepted := make(chan net.Conn, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err == nil {
+			accepted <- conn
+		}
+	}()
+	c := NewClient("both-ways-client", nil, 0, nil)
+	if err := c.Connect(listener.Addr().String(), true); err != nil {
+		t.Fatal(err)
+	}
+	defer c.disconnectProcessing()
+	peer := &Transport{conn: <-accepted}
+	defer peer.conn.Close()
+	expectFrame(t, peer, Connect, 0)
+	peer.SendMessage(NewConnackMessage(false, Accepted))
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	token := c.Publish("outgoing/a", "data", 1, false)
+	expectFrame(t, peer, Publish, 1)
+	exchangeIncomingQoS2(t, peer, 1)
+	peer.SendMessage(NewPubackMessage(1))
+	if err := token.WaitTimeout(2 * time.Second); err != nil {
+		t.Errorf("got %v\nwant nil", err)
+	}
+
+	// the broker publishes with ID 1 and receives QoS 2 PUBLISH with ID 1
+	b, addr := startTestBroker(t)
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	peer = &Transport{conn: conn}
+	defer conn.Close()
+	peer.SendMessage(NewConnectMessage(0, "both-ways-subscriber", true, nil, nil))
+	expectFrame(t, peer, Connack, 0)
+	peer.SendMessage(NewSubscribeMessage(1, []*SubscribeTopic{NewSubscribeTopic("outgoing/#", 1)}))
+	expectFrame(t, peer, Suback, 1)
+	bc, _ := b.GetClient("both-ways-subscriber")
+	b.checkQoSAndPublish(bc, 1, 1, false, "outgoing/a", []byte("data"))
+	expectFrame(t, peer, Publish, 1)
+	exchangeIncomingQoS2(t, peer, 1)
+	peer.SendMessage(NewPubackMessage(1))
+	ok := waitFor(func() bool {
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+		return len(bc.PacketIDMap) == 0 && len(bc.receivedIDs) == 0
+	})
+	if !ok {
+		t.Error("the packet IDs are not released")
+	}
+}
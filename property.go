@@ -0,0 +1,389 @@
+package MQTTg
+
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"io"
+)
+
+type PropertyID uint8
+
+const (
+	PayloadFormatIndicator          PropertyID = 0x01
+	MessageExpiryInterval           PropertyID = 0x02
+	ContentType                     PropertyID = 0x03
+	ResponseTopic                   PropertyID = 0x08
+	CorrelationData                 PropertyID = 0x09
+	SubscriptionIdentifier          PropertyID = 0x0b
+	SessionExpiryInterval           PropertyID = 0x11
+	AssignedClientIdentifier        PropertyID = 0x12
+	ServerKeepAlive                 PropertyID = 0x13
+	AuthenticationMethod            PropertyID = 0x15
+	AuthenticationData              PropertyID = 0x16
+	RequestProblemInformation       PropertyID = 0x17
+	WillDelayInterval               PropertyID = 0x18
+	RequestResponseInformation      PropertyID = 0x19
+	ResponseInformation             PropertyID = 0x1a
+	ServerReference                 PropertyID = 0x1c
+	ReasonString                    PropertyID = 0x1f
+	ReceiveMaximum                  PropertyID = 0x21
+	TopicAliasMaximum               PropertyID = 0x22
+	TopicAlias                      PropertyID = 0x23
+	MaximumQoS                      PropertyID = 0x24
+	RetainAvailable                 PropertyID = 0x25
+	UserProperty                    PropertyID = 0x26
+	MaximumPacketSize               PropertyID = 0x27
+	WildcardSubscriptionAvailable   PropertyID = 0x28
+	SubscriptionIdentifierAvailable PropertyID = 0x29
+	SharedSubscriptionAvailable     PropertyID = 0x2a
+)
+
+type propertyType uint8
+
+const (
+	propertyByte propertyType = iota
+	propertyUint16
+	propertyUint32
+	propertyVarInt
+	propertyString
+	propertyBinary
+	propertyStringPair
+)
+
+var propertyTypes = map[PropertyID]propertyType{
+	PayloadFormatIndicator:          propertyByte,
+	MessageExpiryInterval:           propertyUint32,
+	ContentType:                     propertyString,
+	ResponseTopic:                   propertyString,
+	CorrelationData:                 propertyBinary,
+	SubscriptionIdentifier:          propertyVarInt,
+	SessionExpiryInterval:           propertyUint32,
+	AssignedClientIdentifier:        propertyString,
+	ServerKeepAlive:                 propertyUint16,
+	AuthenticationMethod:            propertyString,
+	AuthenticationData:              propertyBinary,
+	RequestProblemInformation:       propertyByte,
+	WillDelayInterval:               propertyUint32,
+	RequestResponseInformation:      propertyByte,
+	ResponseInformation:             propertyString,
+	ServerReference:                 propertyString,
+	ReasonString:                    propertyString,
+	ReceiveMaximum:                  propertyUint16,
+	TopicAliasMaximum:               propertyUint16,
+	TopicAlias:                      propertyUint16,
+	MaximumQoS:                      propertyByte,
+	RetainAvailable:                 propertyByte,
+	UserProperty:                    propertyStringPair,
+	MaximumPacketSize:               propertyUint32,
+	WildcardSubscriptionAvailable:   propertyByte,
+	SubscriptionIdentifierAvailable: propertyByte,
+	SharedSubscriptionAvailable:     propertyByte,
+}
+
+// Property is a MQTT 5.0 property. The type of Value is decided by ID,
+// uint8, uint16, uint32 (also for variable byte integer), string, []byte
+// or [2]string for UserProperty.
+type Property struct {
+	ID    PropertyID
+	Value interface{}
+}
+
+func NewProperty(id PropertyID, value interface{}) *Property {
+	return &Property{
+		ID:    id,
+		Value: value,
+	}
+}
+
+func (self *Property) String() string {
+	return fmt.Sprintf("0x%02x:%v", uint8(self.ID), self.Value)
+}
+
+// write writes the property, a Value of the wrong type is written as the zero value.
+func (self *Property) write(w io.Writer) {
+	binary.Write(w, binary.BigEndian, uint8(self.ID))
+	switch propertyTypes[self.ID] {
+	case propertyByte:
+		v, _ := self.Value.(uint8)
+		binary.Write(w, binary.BigEndian, v)
+	case propertyUint16:
+		v, _ := self.Value.(uint16)
+		binary.Write(w, binary.BigEndian, v)
+	case propertyUint32:
+		v, _ := self.Value.(uint32)
+		binary.Write(w, binary.BigEndian, v)
+	case propertyVarInt:
+		v, _ := self.Value.(uint32)
+		RemainEncode(w, v)
+	case propertyString:
+		v, _ := self.Value.(string)
+		UTF8_encode(w, v)
+	case propertyBinary:
+		v, _ := self.Value.([]byte)
+		binary.Write(w, binary.BigEndian, uint16(len(v)))
+		w.Write(v)
+	case propertyStringPair:
+		v, _ := self.Value.([2]string)
+		UTF8_encode(w, v[0])
+		UTF8_encode(w, v[1])
+	}
+}
+
+func parseProperty(r io.Reader) (*Property, error) {
+	var id uint8
+	if err := binary.Read(r, binary.BigEndian, &id); err != nil {
+		return nil, err
+	}
+	p := &Property{ID: PropertyID(id)}
+	kind, ok := propertyTypes[p.ID]
+	if !ok {
+		return nil, MALFORMED_PROPERTY
+	}
+	var err error
+	switch kind {
+	case propertyByte:
+		var v uint8
+		err = binary.Read(r, binary.BigEndian, &v)
+		p.Value = v
+	case propertyUint16:
+		var v uint16
+		err = binary.Read(r, binary.BigEndian, &v)
+		p.Value = v
+	case propertyUint32:
+		var v uint32
+		err = binary.Read(r, binary.BigEndian, &v)
+		p.Value = v
+	case propertyVarInt:
+		var v uint32
+		_, err = RemainDecode(r, &v)
+		p.Value = v
+	case propertyString:
+		var v string
+		_, err = UTF8_decode(r, &v)
+		p.Value = v
+	case propertyBinary:
+		var length uint16
+		err = binary.Read(r, binary.BigEndian, &length)
+		if err == nil {
+			err = checkRemaining(r, uint64(length))
+		}
+		var v []byte
+		if err == nil {
+			v = make([]byte, length)
+			_, err = io.ReadFull(r, v)
+		}
+		p.Value = v
+	case propertyStringPair:
+		var v [2]string
+		if _, err = UTF8_decode(r, &v[0]); err == nil {
+			_, err = UTF8_decode(r, &v[1])
+		}
+		p.Value = v
+	}
+	if err == INVALID_UTF8_STRING {
+		return nil, err
+	} else if err != nil {
+		return nil, MALFORMED_PROPERTY
+	}
+	return p, nil
+}
+
+type Properties []*Property
+
+// Get returns the first property of the id, or nil.
+func (self Properties) Get(id PropertyID) *Property {
+	for _, p := range self {
+		if p.ID == id {
+			return p
+		}
+	}
+	return nil
+}
+
+func (self Properties) encode() []byte {
+	var buf bytes.Buffer
+	for _, p := range self {
+		p.write(&buf)
+	}
+	return buf.Bytes()
+}
+
+// Write writes the property length and the properties.
+func (self Properties) Write(w io.Writer) {
+	b := self.encode()
+	RemainEncode(w, uint32(len(b)))
+	w.Write(b)
+}
+
+func (self Properties) String() string {
+	return fmt.Sprintf("%v", []*Property(self))
+}
+
+// ParseProperties reads the property length and the properties,
+// it returns the number of the bytes read.
+func ParseProperties(r io.Reader) (Properties, int, error) {
+	var length uint32
+	n, err := RemainDecode(r, &length)
+	if err != nil {
+		return nil, 0, err
+	}
+	if err := checkRemaining(r, uint64(length)); err != nil {
+		return nil, 0, err
+	}
+	b := make([]byte, length)
+	if _, err := io.ReadFull(r, b); err != nil {
+		return nil, 0, err
+	}
+	var props Properties
+	br := bytes.NewReader(b)
+	for br.Len() > 0 {
+		p, err := parseProperty(br)
+		if err != nil {
+			return nil, 0, err
+		}
+		props = append(props, p)
+	}
+	return props, n + int(length), nil
+}
+
+// ReasonCode is used by the acknowledgements, DISCONNECT and AUTH of MQTT 5.0
+type ReasonCode uint8
+
+const (
+	ReasonSuccess                             ReasonCode = 0x00
+	ReasonGrantedQoS1                         ReasonCode = 0x01
+	ReasonGrantedQoS2                         ReasonCode = 0x02
+	ReasonDisconnectWithWillMessage           ReasonCode = 0x04
+	ReasonNoMatchingSubscribers               ReasonCode = 0x10
+	ReasonNoSubscriptionExisted               ReasonCode = 0x11
+	ReasonContinueAuthentication              ReasonCode = 0x18
+	ReasonReAuthenticate                      ReasonCode = 0x19
+	ReasonUnspecifiedError                    ReasonCode = 0x80
+	ReasonMalformedPacket                     ReasonCode = 0x81
+	ReasonProtocolError                       ReasonCode = 0x82
+	ReasonImplementationSpecificError         ReasonCode = 0x83
+	ReasonUnsupportedProtocolVersion          ReasonCode = 0x84
+	ReasonClientIdentifierNotValid            ReasonCode = 0x85
+	ReasonBadUserNameOrPassword               ReasonCode = 0x86
+	ReasonNotAuthorized                       ReasonCode = 0x87
+	ReasonServerUnavailable                   ReasonCode = 0x88
+	ReasonServerBusy                          ReasonCode = 0x89
+	ReasonBanned                              ReasonCode = 0x8a
+	ReasonServerShuttingDown                  ReasonCode = 0x8b
+	ReasonBadAuthenticationMethod             ReasonCode = 0x8c
+	ReasonKeepAliveTimeout                    ReasonCode = 0x8d
+	ReasonSessionTakenOver                    ReasonCode = 0x8e
+	ReasonTopicFilterInvalid                  ReasonCode = 0x8f
+	ReasonTopicNameInvalid                    ReasonCode = 0x90
+	ReasonPacketIdentifierInUse               ReasonCode = 0x91
+	ReasonPacketIdentifierNotFound            ReasonCode = 0x92
+	ReasonReceiveMaximumExceeded              ReasonCode = 0x93
+	ReasonTopicAliasInvalid                   ReasonCode = 0x94
+	ReasonPacketTooLarge                      ReasonCode = 0x95
+	ReasonMessageRateTooHigh                  ReasonCode = 0x96
+	ReasonQuotaExceeded                       ReasonCode = 0x97
+	ReasonAdministrativeAction                ReasonCode = 0x98
+	ReasonPayloadFormatInvalid                ReasonCode = 0x99
+	ReasonRetainNotSupported                  ReasonCode = 0x9a
+	ReasonQoSNotSupported                     ReasonCode = 0x9b
+	ReasonUseAnotherServer                    ReasonCode = 0x9c
+	ReasonServerMoved                         ReasonCode = 0x9d
+	ReasonSharedSubscriptionsNotSupported     ReasonCode = 0x9e
+	ReasonConnectionRateExceeded              ReasonCode = 0x9f
+	ReasonMaximumConnectTime                  ReasonCode = 0xa0
+	ReasonSubscriptionIdentifiersNotSupported ReasonCode = 0xa1
+	ReasonWildcardSubscriptionsNotSupported   ReasonCode = 0xa2
+)
+
+func (self ReasonCode) String() string {
+	s, ok := map[ReasonCode]string{
+		0x00: "Success",
+		0x01: "GrantedQoS1",
+		0x02: "GrantedQoS2",
+		0x04: "DisconnectWithWillMessage",
+		0x10: "NoMatchingSubscribers",
+		0x11: "NoSubscriptionExisted",
+		0x18: "ContinueAuthentication",
+		0x19: "ReAuthenticate",
+		0x80: "UnspecifiedError",
+		0x81: "MalformedPacket",
+		0x82: "ProtocolError",
+		0x83: "ImplementationSpecificError",
+		0x84: "UnsupportedProtocolVersion",
+		0x85: "ClientIdentifierNotValid",
+		0x86: "BadUserNameOrPassword",
+		0x87: "NotAuthorized",
+		0x88: "ServerUnavailable",
+		0x89: "ServerBusy",
+		0x8a: "Banned",
+		0x8b: "ServerShuttingDown",
+		0x8c: "BadAuthenticationMethod",
+		0x8d: "KeepAliveTimeout",
+		0x8e: "SessionTakenOver",
+		0x8f: "TopicFilterInvalid",
+		0x90: "TopicNameInvalid",
+		0x91: "PacketIdentifierInUse",
+		0x92: "PacketIdentifierNotFound",
+		0x93: "ReceiveMaximumExceeded",
+		0x94: "TopicAliasInvalid",
+		0x95: "PacketTooLarge",
+		0x96: "MessageRateTooHigh",
+		0x97: "QuotaExceeded",
+		0x98: "AdministrativeAction",
+		0x99: "PayloadFormatInvalid",
+		0x9a: "RetainNotSupported",
+		0x9b: "QoSNotSupported",
+		0x9c: "UseAnotherServer",
+		0x9d: "ServerMoved",
+		0x9e: "SharedSubscriptionsNotSupported",
+		0x9f: "ConnectionRateExceeded",
+		0xa0: "MaximumConnectTime",
+		0xa1: "SubscriptionIdentifiersNotSupported",
+		0xa2: "WildcardSubscriptionsNotSupported",
+	}[self]
+	if !ok {
+		return fmt.Sprintf("ReasonCode(0x%02x)", uint8(self))
+	}
+	return s
+}
+
+func (self ReasonCode) Error() string {
+	return self.String()
+}
+
+// ConnectReturnCode maps the reason code of CONNACK to MQTT 3.1.1 return code.
+func (self ReasonCode) ConnectReturnCode() ConnectReturnCode {
+	switch self {
+	case ReasonSuccess:
+		return Accepted
+	case ReasonUnsupportedProtocolVersion:
+		return UnacceptableProtocolVersion
+	case ReasonClientIdentifierNotValid:
+		return IdentifierRejected
+	case ReasonBadUserNameOrPassword:
+		return BadUserNameOrPassword
+	case ReasonNotAuthorized, ReasonBanned, ReasonBadAuthenticationMethod:
+		return NotAuthorized
+	}
+	return ServerUnavailable
+}
+
+// ReasonCode maps the return code to the reason code of MQTT 5.0 CONNACK.
+func (self ConnectReturnCode) ReasonCode() ReasonCode {
+	switch self {
+	case Accepted:
+		return ReasonSuccess
+	case UnacceptableProtocolVersion:
+		return ReasonUnsupportedProtocolVersion
+	case IdentifierRejected:
+		return ReasonClientIdentifierNotValid
+	case ServerUnavailable:
+		return ReasonServerUnavailable
+	case BadUserNameOrPassword:
+		return ReasonBadUserNameOrPassword
+	case NotAuthorized:
+		return ReasonNotAuthorized
+	}
+	return ReasonUnspecifiedError
+}
@@ -0,0 +1,261 @@
+package MQTTg
+
+import (
+	"bytes"
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestProperties(t *testing.T) {
+	e_props := Properties{
+		NewProperty(PayloadFormatIndicator, uint8(1)),
+		NewProperty(TopicAlias, uint16(10)),
+		NewProperty(SessionExpiryInterval, uint32(3600)),
+		NewProperty(SubscriptionIdentifier, uint32(268435455)),
+		NewProperty(ContentType, "text/plain"),
+		NewProperty(CorrelationData, []byte{0x00, 0xff}),
+		NewProperty(UserProperty, [2]string{"key", "value"}),
+	}
+	var buf bytes.Buffer
+	e_props.Write(&buf)
+	length := buf.Len()
+	a_props, n, err := ParseProperties(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != length {
+		t.Errorf("got %v\nwant %v", n, length)
+	}
+	if !reflect.DeepEqual(a_props, e_props) {
+		t.Errorf("got %v\nwant %v", a_props, e_props)
+	}
+
+	// unknown identifier
+	_, _, err = ParseProperties(bytes.NewReader([]byte{2, 0x7f, 0}))
+	if err != MALFORMED_PROPERTY {
+		t.Errorf("got %v\nwant %v", err, MALFORMED_PROPERTY)
+	}
+}
+
+func TestV5Frames(t *testing.T) {
+	props := Properties{NewProperty(ReasonString, "reason")}
+	connect := NewConnectMessage(10, "daiki", true, NewWill("w", "m", false, 1), nil)
+	connect.Protocol = MQTT_5_0
+	connect.Properties = Properties{NewProperty(SessionExpiryInterval, uint32(60))}
+	connect.Will.Properties = Properties{NewProperty(WillDelayInterval, uint32(5))}
+	connack := NewConnackMessage(true, Accepted)
+	connack.Properties = Properties{NewProperty(AssignedClientIdentifier, "assigned")}
+	publish := NewPublishMessage(false, 1, false, "a/b", 1, []uint8("data"))
+	publish.Properties = Properties{NewProperty(ContentType, "text/plain")}
+	puback := NewPubackMessage(1)
+	puback.ReasonCode = ReasonNoMatchingSubscribers
+	pubrel := NewPubrelMessage(2)
+	pubrel.Properties = props
+	topic := NewSubscribeTopic("a/#", 2)
+	topic.NoLocal = true
+	topic.RetainHandling = 2
+	subscribe := NewSubscribeMessage(3, []*SubscribeTopic{topic})
+	unsuback := NewUnsubackMessage(4)
+	unsuback.ReasonCodes = []ReasonCode{ReasonSuccess, ReasonNoSubscriptionExisted}
+	disconnect := NewDisconnectMessage()
+	disconnect.ReasonCode = ReasonDisconnectWithWillMessage
+
+	messages := []Message{
+		connect, connack, publish, puback, pubrel, subscribe,
+		NewSubackMessage(3, []SubscribeReturnCode{SubscribeReturnCode(ReasonNotAuthorized)}),
+		NewUnsubscribeMessage(4, []string{"a/#", "b"}), unsuback,
+		disconnect, NewAuthMessage(ReasonSuccess, props),
+	}
+	for _, e_m := range messages {
+		e_m.SetLevel(MQTT_5_0.Level)
+		var e_buf bytes.Buffer
+		e_m.Write(&e_buf)
+		a_m, err := ReadFrameWithLevel(bytes.NewReader(e_buf.Bytes()), MQTT_5_0.Level)
+		if err != nil {
+			t.Fatalf("%s: %v", e_m, err)
+		}
+		// the parsed message must be written to the same bytes
+		var a_buf bytes.Buffer
+		a_m.Write(&a_buf)
+		if !bytes.Equal(a_buf.Bytes(), e_buf.Bytes()) {
+			t.Errorf("got %v\nwant %v", a_buf.Bytes(), e_buf.Bytes())
+		}
+	}
+
+	// AUTH does not exist in MQTT 3.1.1
+	var buf bytes.Buffer
+	NewAuthMessage(ReasonSuccess, nil).Write(&buf)
+	if _, err := ReadFrame(&buf); err != INVALID_MESSAGE_CAME {
+		t.Errorf("got %v\nwant %v", err, INVALID_MESSAGE_CAME)
+	}
+}
+
+func TestBrokerMixedProtocol(t *testing.T) {
+	b, addr := startTestBroker(t)
+	v5 := NewClient("", nil, 0, nil)
+	v5.Protocol = MQTT_5_0
+	if err := v5.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	v3 := NewClient("v3-client", nil, 0, nil)
+	if err := v3.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(v5.isConnecting) || !waitFor(v3.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	// the broker assigns the identifier to MQTT 5.0 client
+	if len(v5.ID) == 0 {
+		t.Errorf("got empty client ID\nwant assigned one")
+	}
+
+	v5.Subscribe([]*SubscribeTopic{NewSubscribeTopic("mixed/#", 1)})
+	v3.Subscribe([]*SubscribeTopic{NewSubscribeTopic("mixed/+", 2)})
+	ok := waitFor(func() bool { return len(b.TopicRoot.GetSubscribers("mixed/a")) == 2 })
+	if !ok {
+		t.Fatalf("got %v\nwant 2 subscribers", b.TopicRoot.GetSubscribers("mixed/a"))
+	}
+
+	acked := func(c *Client) func() bool {
+		return func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return len(c.PacketIDMap) == 0
+		}
+	}
+	// each subscriber reads the PUBLISH in its own level
+	v3.Publish("mixed/a", "from 3.1.1", 2, false)
+	v5.Publish("mixed/a", "from 5.0", 1, false)
+	if !waitFor(acked(v3)) || !waitFor(acked(v5)) {
+		t.Errorf("acknowledgements did not come")
+	}
+	if !v5.isConnecting() || !v3.isConnecting() {
+		t.Errorf("connection was closed by the broken frame")
+	}
+	v5.disconnectProcessing()
+	v3.disconnectProcessing()
+}
+
+func TestBrokerSubscriptionOptions(t *testing.T) {
+	_, addr := startTestBroker(t)
+	type received struct {
+		topic  string
+		retain bool
+	}
+	var mu sync.Mutex
+	messages := make(map[string][]received)
+	connect := func(id string) *Client {
+		c := NewClient(id, nil, 0, nil)
+		c.Protocol = MQTT_5_0
+		c.OnMessage = func(c *Client, m *PublishMessage) {
+			mu.Lock()
+			messages[c.ID] = append(messages[c.ID], received{m.TopicName, m.Retain})
+			mu.Unlock()
+		}
+		if err := c.Connect(addr, true); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(c.isConnecting) {
+			t.Fatal("could not connect")
+		}
+		t.Cleanup(func() { c.disconnectProcessing() })
+		return c
+	}
+	subscribe := func(c *Client, filter string, options func(s *SubscribeTopic)) {
+		s := NewSubscribeTopic(filter, 1)
+		options(s)
+		if err := c.Subscribe([]*SubscribeTopic{s}).WaitTimeout(2 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+	}
+	// waitMessages waits for the message of the topic, then the earlier ones have come
+	waitMessages := func(id, topic string) []received {
+		waitFor(func() bool {
+			mu.Lock()
+			defer mu.Unlock()
+			for _, m := range messages[id] {
+				if m.topic == topic {
+					return true
+				}
+			}
+			return false
+		})
+		mu.Lock()
+		defer mu.Unlock()
+		return append([]received{}, messages[id]...)
+	}
+
+	// No Local
+	local := connect("no-local")
+	subscribe(local, "local/#", func(s *SubscribeTopic) { s.NoLocal = true })
+	other := connect("no-local-other")
+	local.Publish("local/own", "data", 1, false).Wait()
+	other.Publish("local/other", "data", 1, false).Wait()
+	expected := []received{{"local/other", false}}
+	if actual := waitMessages("no-local", "local/other"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("No Local: got %v\nwant %v", actual, expected)
+	}
+
+	// Retain As Published
+	kept := connect("rap-kept")
+	subscribe(kept, "rap/#", func(s *SubscribeTopic) { s.RetainAsPublished = true })
+	cleared := connect("rap-cleared")
+	subscribe(cleared, "rap/#", func(s *SubscribeTopic) {})
+	other.Publish("rap/a", "data", 1, true).Wait()
+	expected = []received{{"rap/a", true}}
+	if actual := waitMessages("rap-kept", "rap/a"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Retain As Published: got %v\nwant %v", actual, expected)
+	}
+	expected = []received{{"rap/a", false}}
+	if actual := waitMessages("rap-cleared", "rap/a"); !reflect.DeepEqual(actual, expected) {
+		t.Errorf("Retain As Published: got %v\nwant %v", actual, expected)
+	}
+
+	// Retain Handling, rap/a is retained now. The message of rh/end is not
+	// retained, it tells the retained ones have come before it
+	for handling, count := range []int{2, 1, 0} {
+		id := "retain-handling-" + strconv.Itoa(handling)
+		c := connect(id)
+		for i := 0; i < 2; i++ {
+			subscribe(c, "rap/#", func(s *SubscribeTopic) { s.RetainHandling = uint8(handling) })
+		}
+		subscribe(c, "rh/end", func(s *SubscribeTopic) {})
+		other.Publish("rh/end", "data", 1, false).Wait()
+		if actual := waitMessages(id, "rh/end"); len(actual) != count+1 {
+			t.Errorf("Retain Handling %d: got %v\nwant %d retained messages", handling, actual, count)
+		}
+	}
+}
+
+func TestBrokerReceiveMaximum(t *testing.T) {
+	b, addr := startTestBroker(t)
+	conn, err := net.Dial("tcp4", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	peer := &Transport{conn: conn, Level: MQTT_5_0.Level}
+	connect := NewConnectMessage(0, "receive-maximum", true, nil, nil)
+	connect.Protocol = MQTT_5_0
+	connect.Properties = Properties{NewProperty(ReceiveMaximum, uint16(1))}
+	peer.SendMessage(connect)
+	expectFrame(t, peer, Connack, 0)
+	peer.SendMessage(NewSubscribeMessage(1, []*SubscribeTopic{NewSubscribeTopic("maximum/#", 1)}))
+	expectFrame(t, peer, Suback, 1)
+
+	bc, _ := b.GetClient("receive-maximum")
+	b.checkQoSAndPublish(bc, 1, 1, false, "maximum/0", []byte("data"))
+	b.checkQoSAndPublish(bc, 1, 1, false, "maximum/1", []byte("data"))
+	expectFrame(t, peer, Publish, 1)
+	// the second one waits for PUBACK of the first one
+	conn.SetReadDeadline(time.Now().Add(100 * time.Millisecond))
+	if m, err := peer.ReadMessage(); err == nil {
+		t.Fatalf("got %v\nwant no message over Receive Maximum", m)
+	}
+	peer.SendMessage(NewPubackMessage(1))
+	expectFrame(t, peer, Publish, 2)
+}
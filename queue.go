@@ -0,0 +1,192 @@
+package MQTTg
+
+type QueuePolicy uint8
+
+const (
+	// DropOldest discards the oldest queued message to keep the new one
+	DropOldest QueuePolicy = iota
+	// DropNewest discards the new message
+	DropNewest
+)
+
+// OfflineQueueConfig limits the messages kept for an offline
+// CleanSession=false client, and the ones waiting for the packet IDs
+// of an online client. 0 means no limit.
+type OfflineQueueConfig struct {
+	MaxMessages int
+	// MaxBytes is the sum of the topic and payload length
+	MaxBytes int
+	Policy   QueuePolicy
+}
+
+func (self OfflineQueueConfig) fits(messages, bytes int) bool {
+	return (self.MaxMessages == 0 || messages <= self.MaxMessages) &&
+		(self.MaxBytes == 0 || bytes <= self.MaxBytes)
+}
+
+func queuedSize(m *PublishMessage) int {
+	return len(m.TopicName) + len(m.Payload)
+}
+
+// enqueue keeps pub while the CleanSession=false client is offline or the queue
+// is being drained, it returns false when pub can be sent now.
+// QoS 0 messages for offline clients are discarded.
+func (self *BrokerSideClient) enqueue(pub *PublishMessage) bool {
+	config := self.Broker.OfflineQueue
+	self.mu.Lock()
+	if next := self.replaced; next != nil {
+		self.mu.Unlock()
+		// the publisher got this client before the session was taken over
+		pub.PacketID = 0
+		self.Broker.publishTo(next, pub)
+		return true
+	}
+	online := self.IsConnecting
+	if online && !self.draining || !online && self.CleanSession {
+		self.mu.Unlock()
+		return false
+	}
+	if pub.QoS == 0 && !online {
+		self.mu.Unlock()
+		return true
+	}
+
+	size := queuedSize(pub)
+	dropped := false
+	removed := 0
+	for !config.fits(len(self.queue)+1, self.queueBytes+size) {
+		dropped = true
+		if config.Policy == DropNewest || len(self.queue) == 0 {
+			pub = nil
+			break
+		}
+		self.queueBytes -= queuedSize(self.queue[0])
+		self.queue[0] = nil
+		self.queue = self.queue[1:]
+		removed++
+	}
+	if pub != nil {
+		// the packet ID is given when the message is sent
+		pub.PacketID = 0
+		self.queue = append(self.queue, pub)
+		self.queueBytes += size
+	}
+	changed := removed > 0 || pub != nil
+	updater, ok := self.Broker.SessionStore.(QueueUpdater)
+	var err error
+	if !online && changed && ok && !self.CleanSession {
+		// only the change is stored, under mu to keep the order of the queue
+		err = updater.UpdateQueue(self.ID, removed, pub)
+	}
+	self.mu.Unlock()
+	self.emitError(err)
+
+	if dropped && online {
+		// the queue is full of the messages waiting for the packet IDs
+		self.Broker.stats.droppedInflight.Add(1)
+		self.emitError(OFFLINE_QUEUE_IS_FULL)
+	} else if dropped {
+		self.Broker.stats.droppedQueueFull.Add(1)
+		self.emitError(OFFLINE_QUEUE_IS_FULL)
+	}
+	if !online && changed && !ok {
+		self.saveSession()
+	}
+	return true
+}
+
+// queueForPacketID queues pub of the online client while its packet IDs are exhausted,
+// it is sent in the order by drainQueue when an identifier is released.
+// It returns false when the client has gone.
+func (self *BrokerSideClient) queueForPacketID(pub *PublishMessage) bool {
+	self.mu.Lock()
+	if !self.IsConnecting {
+		self.mu.Unlock()
+		return false
+	}
+	self.draining = true
+	self.mu.Unlock()
+	if !self.enqueue(pub) {
+		return false
+	}
+	// the identifiers may have been released before draining was set
+	self.drainQueue()
+	return true
+}
+
+// Redelivery resends the in-flight messages, then sends the messages
+// queued while the client was offline in the order they came.
+func (self *BrokerSideClient) Redelivery() {
+	self.ClientInfo.Redelivery()
+	self.mu.Lock()
+	self.draining = true
+	self.mu.Unlock()
+	self.drainQueue()
+}
+
+// drainQueue sends the queued messages while the packet IDs are usable.
+// When they are exhausted, draining is kept and the rest is sent by releasePacketID.
+func (self *BrokerSideClient) drainQueue() {
+	self.mu.Lock()
+	if self.drainBusy {
+		self.drainAgain = true
+		self.mu.Unlock()
+		return
+	}
+	self.drainBusy = true
+	for {
+		self.drainAgain = false
+		exhausted := false
+		for len(self.queue) > 0 && self.IsConnecting && !exhausted {
+			queue := self.queue
+			self.queue, self.queueBytes = make([]*PublishMessage, 0), 0
+			messages := make([]*PublishMessage, 0, len(queue))
+			for i, pub := range queue {
+				var id uint16
+				if pub.QoS > 0 {
+					var err error
+					if id, err = self.usablePacketID(); err != nil {
+						// the rest waits for the acknowledgements in the order
+						exhausted = true
+						for _, rest := range queue[i:] {
+							self.queue = append(self.queue, rest)
+							self.queueBytes += queuedSize(rest)
+						}
+						break
+					}
+				}
+				// the queued one can be being saved to the SessionStore
+				m := NewPublishMessage(false, pub.QoS, pub.Retain, pub.TopicName, id, pub.Payload)
+				if id > 0 {
+					// the message is redelivered if the client disconnects again
+					self.PacketIDMap[id] = m
+				}
+				messages = append(messages, m)
+			}
+			self.mu.Unlock()
+			for _, m := range messages {
+				self.emitError(self.Send(m))
+			}
+			self.mu.Lock()
+		}
+		if !self.drainAgain {
+			break
+		}
+	}
+	if len(self.queue) == 0 || !self.IsConnecting {
+		self.draining = false
+	}
+	self.drainBusy = false
+	self.mu.Unlock()
+}
+
+// releasePacketID resumes drainQueue stopped by the exhausted packet IDs.
+func (self *BrokerSideClient) releasePacketID(id uint16) {
+	self.ClientInfo.releasePacketID(id)
+	self.mu.Lock()
+	resume := self.draining
+	self.mu.Unlock()
+	if resume {
+		self.drainQueue()
+	}
+}
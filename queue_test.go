@@ -0,0 +1,242 @@
+package MQTTg
+
+import (
+	"net"
+	"reflect"
+	"strconv"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestOfflineQueueLimit(t *testing.T) {
+	tests := []struct {
+		config   OfflineQueueConfig
+		qos      uint8
+		expected []string
+	}{
+		{OfflineQueueConfig{}, 1, []string{"q/0", "q/1", "q/2", "q/3"}},
+		{OfflineQueueConfig{MaxMessages: 2, Policy: DropOldest}, 1, []string{"q/2", "q/3"}},
+		{OfflineQueueConfig{MaxMessages: 2, Policy: DropNewest}, 1, []string{"q/0", "q/1"}},
+		// each message is 3 bytes of topic and 2 bytes of payload
+		{OfflineQueueConfig{MaxBytes: 15, Policy: DropOldest}, 2, []string{"q/1", "q/2", "q/3"}},
+		{OfflineQueueConfig{MaxBytes: 4}, 1, []string{}},
+		{OfflineQueueConfig{}, 0, []string{}},
+	}
+	for i, test := range tests {
+		bc := NewBrokerSideClient(nil, &Broker{OfflineQueue: test.config})
+		for j := 0; j < 4; j++ {
+			pub := NewPublishMessage(false, test.qos, false, "q/"+strconv.Itoa(j), 0, []uint8("ab"))
+			if !bc.enqueue(pub) {
+				t.Fatalf("%d: message for the offline client was not queued", i)
+			}
+		}
+		actual := []string{}
+		for _, pub := range bc.queue {
+			actual = append(actual, pub.TopicName)
+		}
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%d: got %v\nwant %v", i, actual, test.expected)
+		}
+	}
+}
+
+func TestBrokerOfflineQueue(t *testing.T) {
+	b, addr := startTestBroker(t)
+	sub := NewClient("offline-sub", nil, 0, nil)
+	if err := sub.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(sub.isConnecting)
+	sub.Subscribe([]*SubscribeTopic{NewSubscribeTopic("offline/#", 1)})
+	waitFor(func() bool { return len(b.TopicRoot.GetSubscribers("offline/a")) == 1 })
+	sub.Disconnect()
+	bc, _ := b.GetClient("offline-sub")
+	waitFor(func() bool { return !bc.isConnecting() })
+
+	pub := NewClient("offline-pub", nil, 0, nil)
+	if err := pub.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(pub.isConnecting)
+	for i := 0; i < 3; i++ {
+		pub.Publish("offline/"+strconv.Itoa(i), "data", 1, false)
+	}
+	queued := func() int {
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+		return len(bc.queue)
+	}
+	if !waitFor(func() bool { return queued() == 3 }) {
+		t.Fatalf("got %d queued messages\nwant 3", queued())
+	}
+
+	sub = NewClient("offline-sub", nil, 0, nil)
+	if err := sub.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	// the queued messages are sent and acknowledged by the client
+	ok := waitFor(func() bool {
+		bc, _ := b.GetClient("offline-sub")
+		bc.mu.Lock()
+		defer bc.mu.Unlock()
+		return bc.IsConnecting && len(bc.queue) == 0 && len(bc.PacketIDMap) == 0
+	})
+	if !ok {
+		t.Error("the queued messages were not delivered")
+	}
+	sub.Disconnect()
+	pub.Disconnect()
+}
+
+func TestBrokerOfflineQueueWindow(t *testing.T) {
+	b, addr := startTestBroker(t, func(b *Broker) { b.MaxInflight = 2 })
+
+	sub := NewClient("window-sub", nil, 0, nil)
+	if err := sub.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(sub.isConnecting)
+	sub.Subscribe([]*SubscribeTopic{NewSubscribeTopic("window/#", 1)}).Wait()
+	sub.Disconnect()
+	bc, _ := b.GetClient("window-sub")
+	waitFor(func() bool { return !bc.isConnecting() })
+
+	pub := NewClient("window-pub", nil, 0, nil)
+	if err := pub.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(pub.isConnecting)
+	for i := 0; i < 5; i++ {
+		pub.Publish("window/"+strconv.Itoa(i), "data", 1, false).Wait()
+	}
+
+	var mu sync.Mutex
+	received := []string{}
+	sub = NewClient("window-sub", nil, 0, nil)
+	sub.OnMessage = func(c *Client, m *PublishMessage) {
+		mu.Lock()
+		received = append(received, m.TopicName)
+		mu.Unlock()
+	}
+	if err := sub.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(sub.isConnecting)
+	// the message published while the queue is drained comes after the queued ones
+	pub.Publish("window/5", "data", 1, false).Wait()
+
+	expected := []string{"window/0", "window/1", "window/2", "window/3", "window/4", "window/5"}
+	ok := waitFor(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == len(expected)
+	})
+	mu.Lock()
+	if !ok || !reflect.DeepEqual(received, expected) {
+		t.Errorf("got %v\nwant %v", received, expected)
+	}
+	mu.Unlock()
+	sub.Disconnect()
+	pub.Disconnect()
+}
+
+func TestBrokerInflightBackPressure(t *testing.T) {
+	b, addr := startTestBroker(t, func(b *Broker) {
+		b.MaxInflight = 2
+		b.OfflineQueue = OfflineQueueConfig{MaxMessages: 2}
+	})
+	for _, cleanSession := range []bool{true, false} {
+		id := "slow-sub-" + strconv.FormatBool(cleanSession)
+		conn, err := net.Dial("tcp4", addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer conn.Close()
+		peer := &Transport{conn: conn}
+		peer.SendMessage(NewConnectMessage(0, id, cleanSession, nil, nil))
+		expectFrame(t, peer, Connack, 0)
+		peer.SendMessage(NewSubscribeMessage(1, []*SubscribeTopic{NewSubscribeTopic("slow/#", 1)}))
+		expectFrame(t, peer, Suback, 1)
+
+		bc, _ := b.GetClient(id)
+		dropped := b.stats.droppedInflight.Load()
+		for i := 0; i < 5; i++ {
+			b.checkQoSAndPublish(bc, 1, 1, false, "slow/"+strconv.Itoa(i), []byte("data"))
+		}
+		// two are in flight, two wait for the packet IDs and the oldest waiting one is dropped
+		if actual := b.stats.droppedInflight.Load() - dropped; actual != 1 {
+			t.Errorf("%s: got %v\nwant %v", id, actual, 1)
+		}
+		actual := []string{}
+		for i := uint16(1); i <= 4; i++ {
+			m := expectFrame(t, peer, Publish, i)
+			actual = append(actual, m.(*PublishMessage).TopicName)
+			if i >= 2 {
+				peer.SendMessage(NewPubackMessage(i - 1))
+			}
+		}
+		peer.SendMessage(NewPubackMessage(4))
+		expected := []string{"slow/0", "slow/1", "slow/3", "slow/4"}
+		if !reflect.DeepEqual(actual, expected) {
+			t.Errorf("%s: got %v\nwant %v", id, actual, expected)
+		}
+		ok := waitFor(func() bool {
+			bc.mu.Lock()
+			defer bc.mu.Unlock()
+			return len(bc.queue) == 0 && len(bc.PacketIDMap) == 0 && !bc.draining
+		})
+		if !ok {
+			t.Errorf("%s: the queue is not drained", id)
+		}
+	}
+}
+
+func TestBrokerPublishWhileReconnecting(t *testing.T) {
+	b, addr := startTestBroker(t)
+	var mu sync.Mutex
+	received := make(map[string]bool)
+	onMessage := func(c *Client, m *PublishMessage) {
+		mu.Lock()
+		received[m.TopicName] = true
+		mu.Unlock()
+	}
+	sub := NewClient("reconnecting-sub", nil, 0, nil)
+	if err := sub.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(sub.isConnecting)
+	sub.Subscribe([]*SubscribeTopic{NewSubscribeTopic("reconnecting/#", 1)}).Wait()
+	sub.Disconnect()
+	old, _ := b.GetClient("reconnecting-sub")
+	waitFor(func() bool { return !old.isConnecting() })
+
+	// the publisher which got the previous client keeps publishing to it
+	// while the client reconnects
+	n := 100
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		for i := 0; i < n; i++ {
+			b.checkQoSAndPublish(old, 1, 1, false, "reconnecting/"+strconv.Itoa(i), []byte("data"))
+			time.Sleep(time.Millisecond)
+		}
+	}()
+	sub = NewClient("reconnecting-sub", nil, 0, nil)
+	sub.OnMessage = onMessage
+	if err := sub.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	defer sub.disconnectProcessing()
+	<-done
+	ok := waitFor(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		return len(received) == n
+	})
+	if !ok {
+		mu.Lock()
+		t.Errorf("got %d messages\nwant %d", len(received), n)
+		mu.Unlock()
+	}
+}
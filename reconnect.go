@@ -0,0 +1,116 @@
+package MQTTg
+
+import (
+	"math/rand"
+	"time"
+)
+
+const (
+	DefaultMinReconnectDelay = 1 * time.Second
+	DefaultMaxReconnectDelay = 2 * time.Minute
+	// ResubscribeTimeout is the time to wait SUBACK of the subscriptions sent again
+	ResubscribeTimeout = 30 * time.Second
+)
+
+// reconnectDelay doubles the delay for every attempt up to MaxReconnectDelay,
+// and takes a random value from the upper half of it.
+func (self *Client) reconnectDelay(attempt int) time.Duration {
+	min, max := self.MinReconnectDelay, self.MaxReconnectDelay
+	if min <= 0 {
+		min = DefaultMinReconnectDelay
+	}
+	if max < min {
+		max = DefaultMaxReconnectDelay
+		if max < min {
+			max = min
+		}
+	}
+	delay := min
+	for i := 0; i < attempt && delay < max; i++ {
+		delay *= 2
+	}
+	if delay > max {
+		delay = max
+	}
+	half := delay / 2
+	return half + time.Duration(rand.Int63n(int64(delay-half)+1))
+}
+
+// willReconnect reports whether the lost connection is dialed again.
+func (self *Client) willReconnect() bool {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.AutoReconnect && self.established && !self.closing && self.dial != nil
+}
+
+func (self *Client) scheduleReconnect() {
+	self.mu.Lock()
+	attempt := self.reconnectAttempt
+	self.reconnectAttempt++
+	self.mu.Unlock()
+	go self.reconnect(attempt)
+}
+
+// reconnect dials the broker after the delay. The failure of the attempt
+// schedules the next one through disconnectProcessing.
+func (self *Client) reconnect(attempt int) {
+	// the loops of the lost connection use the fields replaced by start
+	self.loops.Wait()
+	time.Sleep(self.reconnectDelay(attempt))
+	if !self.willReconnect() {
+		return
+	}
+	t, err := self.dial()
+	if err != nil {
+		self.emitError(err)
+		self.scheduleReconnect()
+		return
+	}
+	self.mu.Lock()
+	self.reconnecting = true
+	self.mu.Unlock()
+	self.emitError(self.start(t, self.CleanSession))
+}
+
+// reconnected is called by CONNACK of the reconnection. The subscriptions
+// are sent again when the broker does not have the session.
+func (self *Client) reconnected(sessionPresent bool) {
+	self.mu.Lock()
+	self.reconnectAttempt = 0
+	wasReconnecting := self.reconnecting
+	self.reconnecting = false
+	topics := make([]*SubscribeTopic, 0, len(self.subscriptions))
+	for _, topic := range self.subscriptions {
+		topics = append(topics, topic)
+	}
+	self.mu.Unlock()
+	if !wasReconnecting {
+		return
+	}
+	if !sessionPresent && len(topics) > 0 {
+		id, err := self.getUsablePacketID()
+		if err != nil {
+			self.emitError(err)
+		} else {
+			// SUBACK is read by ReadLoop which calls this
+			go self.waitResubscribe(self.sendWithToken(NewSubscribeMessage(id, topics)), topics)
+		}
+	}
+	if self.OnReconnect != nil {
+		go self.OnReconnect(self)
+	}
+}
+
+// waitResubscribe reports the failure of SUBSCRIBE sent by reconnected and
+// the topics refused by the broker.
+func (self *Client) waitResubscribe(token *Token, topics []*SubscribeTopic) {
+	if err := token.WaitTimeout(ResubscribeTimeout); err != nil {
+		self.emitError(err)
+		return
+	}
+	for i, code := range token.ReturnCodes() {
+		if code >= SubscribeFailure && i < len(topics) {
+			self.logger().Error("resubscription is refused", "topic", topics[i].Topic, "code", uint8(code))
+		}
+	}
+}
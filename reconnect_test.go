@@ -0,0 +1,113 @@
+package MQTTg
+
+import (
+	"log/slog"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestReconnectDelay(t *testing.T) {
+	c := NewClient("delay-client", nil, 0, nil)
+	c.MinReconnectDelay = 100 * time.Millisecond
+	c.MaxReconnectDelay = time.Second
+	tests := []struct {
+		attempt int
+		max     time.Duration
+	}{
+		{0, 100 * time.Millisecond},
+		{1, 200 * time.Millisecond},
+		{3, 800 * time.Millisecond},
+		{10, time.Second},
+	}
+	for _, test := range tests {
+		for i := 0; i < 10; i++ {
+			delay := c.reconnectDelay(test.attempt)
+			if delay < test.max/2 || delay > test.max {
+				t.Errorf("attempt %d: got %v\nwant between %v and %v", test.attempt, delay, test.max/2, test.max)
+			}
+		}
+	}
+}
+
+func TestClientAutoReconnect(t *testing.T) {
+	b, addr := startTestBroker(t)
+	for _, cleanSession := range []bool{false, true} {
+		id := "reconnect-persistent"
+		if cleanSession {
+			id = "reconnect-clean"
+		}
+		c := NewClient(id, nil, 0, nil)
+		c.AutoReconnect = true
+		c.MinReconnectDelay = 10 * time.Millisecond
+		c.MaxReconnectDelay = 50 * time.Millisecond
+		lost := make(chan bool, 1)
+		reconnected := make(chan bool, 1)
+		c.OnConnectionLost = func(*Client) { lost <- true }
+		c.OnReconnect = func(*Client) { reconnected <- true }
+		if err := c.Connect(addr, cleanSession); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(c.isConnecting) {
+			t.Fatal("could not connect")
+		}
+		if err := c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("reconnect/#", 1)}).WaitTimeout(2 * time.Second); err != nil {
+			t.Fatal(err)
+		}
+
+		// the broker drops the connection
+		bc, _ := b.GetClient(id)
+		bc.disconnectProcessing()
+		for _, ch := range []chan bool{lost, reconnected} {
+			select {
+			case <-ch:
+			case <-time.After(2 * time.Second):
+				t.Fatalf("%s: the hook was not called", id)
+			}
+		}
+		// the subscription is sent again when the session is not present
+		ok := waitFor(func() bool {
+			bc, ok := b.GetClient(id)
+			return ok && len(bc.session().Subscriptions) == 1
+		})
+		if !ok {
+			t.Errorf("%s: the subscription is not in the session", id)
+		}
+		if err := c.Publish("reconnect/a", "data", 1, false).WaitTimeout(2 * time.Second); err != nil {
+			t.Errorf("%s: got %v\nwant nil", id, err)
+		}
+
+		// Disconnect stops the reconnection
+		c.Disconnect()
+		c.disconnectProcessing()
+		time.Sleep(100 * time.Millisecond)
+		if c.isConnecting() {
+			t.Errorf("%s: reconnected after Disconnect", id)
+		}
+	}
+}
+
+func TestClientWaitResubscribe(t *testing.T) {
+	out := &lockedBuffer{}
+	SetLogger(slog.New(slog.NewJSONHandler(out, nil)))
+	defer SetLogger(nil)
+
+	c := NewClient("resubscribe-client", nil, 0, nil)
+	topics := []*SubscribeTopic{NewSubscribeTopic("granted", 1), NewSubscribeTopic("refused", 1)}
+	token := newToken()
+	token.resolve(nil, []SubscribeReturnCode{AckMaxQoS1, SubscribeFailure})
+	c.waitResubscribe(token, topics)
+	token = newToken()
+	token.resolve(NOT_CONNECTED, nil)
+	c.waitResubscribe(token, topics)
+
+	logs := out.String()
+	for _, expected := range []string{`"topic":"refused","code":128`, `"msg":"NOT_CONNECTED"`} {
+		if !strings.Contains(logs, expected) {
+			t.Errorf("got %s\nwant %s", logs, expected)
+		}
+	}
+	if strings.Contains(logs, `"topic":"granted"`) {
+		t.Errorf("got %s\nwant no log of the granted topic", logs)
+	}
+}
@@ -0,0 +1,193 @@
+package MQTTg
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// RetainedMessage is the last retained PUBLISH of a topic.
+type RetainedMessage struct {
+	Topic   string
+	Payload []byte
+	QoS     uint8
+	// Time is when the broker received the message
+	Time time.Time
+}
+
+func NewRetainedMessage(topic string, qos uint8, payload []byte) *RetainedMessage {
+	return &RetainedMessage{
+		Topic:   topic,
+		Payload: payload,
+		QoS:     qos,
+		Time:    time.Now(),
+	}
+}
+
+// RetainStore keeps a retained message for each topic.
+// Set and Delete are called for every retained PUBLISH while Match is called
+// for every SUBSCRIBE, so implementations must be safe for concurrent use.
+type RetainStore interface {
+	// Set replaces the retained message of m.Topic
+	Set(m *RetainedMessage) error
+	Delete(topic string) error
+	// Get returns nil when the topic has no retained message
+	Get(topic string) (*RetainedMessage, error)
+	// Match returns the retained messages of every topic matched by filter
+	Match(filter string) ([]*RetainedMessage, error)
+}
+
+// retainMap is the index used by the RetainStore implementations.
+// The filter is matched against every topic, so Match is proportional
+// to the number of the retained messages.
+type retainMap map[string]*RetainedMessage
+
+func (self retainMap) match(filter string) ([]*RetainedMessage, error) {
+	if err := ValidateFilter(filter); err != nil {
+		return nil, err
+	}
+	out := make([]*RetainedMessage, 0)
+	for topic, m := range self {
+		if FilterCovers(filter, topic) {
+			out = append(out, m)
+		}
+	}
+	return out, nil
+}
+
+type MemoryRetainStore struct {
+	messages retainMap
+	mu       sync.RWMutex
+}
+
+func NewMemoryRetainStore() *MemoryRetainStore {
+	return &MemoryRetainStore{
+		messages: make(retainMap),
+	}
+}
+
+func (self *MemoryRetainStore) Set(m *RetainedMessage) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.messages[m.Topic] = m
+	return nil
+}
+
+func (self *MemoryRetainStore) Delete(topic string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.messages, topic)
+	return nil
+}
+
+func (self *MemoryRetainStore) Get(topic string) (*RetainedMessage, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.messages[topic], nil
+}
+
+func (self *MemoryRetainStore) Match(filter string) ([]*RetainedMessage, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.messages.match(filter)
+}
+
+// retainRecord is a line of the FileRetainStore log.
+type retainRecord struct {
+	*RetainedMessage
+	Deleted bool `json:",omitempty"`
+}
+
+// FileRetainStore keeps the retained messages in an append-only log,
+// every Set and Delete appends a JSON line.
+type FileRetainStore struct {
+	log      *fileLog
+	messages retainMap
+	mu       sync.RWMutex
+}
+
+func NewFileRetainStore(path string) (*FileRetainStore, error) {
+	self := &FileRetainStore{
+		messages: make(retainMap),
+	}
+	var err error
+	self.log, err = openFileLog(path, func(line []byte) error {
+		record := &retainRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return err
+		}
+		if record.RetainedMessage == nil {
+			return PROTOCOL_VIOLATION
+		}
+		if record.Deleted {
+			delete(self.messages, record.Topic)
+		} else {
+			self.messages[record.Topic] = record.RetainedMessage
+		}
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := self.compact(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *FileRetainStore) compact() error {
+	records := make([]interface{}, 0, len(self.messages))
+	for _, m := range self.messages {
+		records = append(records, &retainRecord{RetainedMessage: m})
+	}
+	return self.log.compact(records)
+}
+
+func (self *FileRetainStore) compactIfNeeded() error {
+	if !self.log.needsCompaction(len(self.messages)) {
+		return nil
+	}
+	return self.compact()
+}
+
+func (self *FileRetainStore) Set(m *RetainedMessage) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if err := self.log.append(&retainRecord{RetainedMessage: m}); err != nil {
+		return err
+	}
+	self.messages[m.Topic] = m
+	return self.compactIfNeeded()
+}
+
+func (self *FileRetainStore) Delete(topic string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.messages[topic]; !ok {
+		return nil
+	}
+	record := &retainRecord{RetainedMessage: &RetainedMessage{Topic: topic}, Deleted: true}
+	if err := self.log.append(record); err != nil {
+		return err
+	}
+	delete(self.messages, topic)
+	return self.compactIfNeeded()
+}
+
+func (self *FileRetainStore) Get(topic string) (*RetainedMessage, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.messages[topic], nil
+}
+
+func (self *FileRetainStore) Match(filter string) ([]*RetainedMessage, error) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	return self.messages.match(filter)
+}
+
+func (self *FileRetainStore) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.log.Close()
+}
@@ -0,0 +1,104 @@
+package MQTTg
+
+import (
+	"bytes"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func testRetainStore(t *testing.T, name string, store RetainStore) {
+	for _, topic := range []string{"a", "a/b", "a/b/c", "a/c", "b/c", "$SYS/a"} {
+		if err := store.Set(NewRetainedMessage(topic, 1, []byte(topic))); err != nil {
+			t.Fatal(err)
+		}
+	}
+	store.Delete("b/c")
+
+	tests := []struct {
+		filter   string
+		expected []string
+	}{
+		{"a/#", []string{"a", "a/b", "a/b/c", "a/c"}},
+		{"a/+", []string{"a/b", "a/c"}},
+		{"+/c", []string{"a/c"}},
+		{"#", []string{"a", "a/b", "a/b/c", "a/c"}},
+		{"$SYS/#", []string{"$SYS/a"}},
+		{"b/c", []string{}},
+	}
+	for _, test := range tests {
+		retained, err := store.Match(test.filter)
+		if err != nil {
+			t.Fatal(err)
+		}
+		actual := []string{}
+		for _, m := range retained {
+			actual = append(actual, m.Topic)
+		}
+		sort.Strings(actual)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s %s: got %v\nwant %v", name, test.filter, actual, test.expected)
+		}
+	}
+	if _, err := store.Match("a/#/b"); err == nil {
+		t.Errorf("%s: got nil\nwant error for invalid filter", name)
+	}
+}
+
+func TestMemoryRetainStore(t *testing.T) {
+	testRetainStore(t, "memory", NewMemoryRetainStore())
+}
+
+func TestFileRetainStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "retain.log")
+	store, err := NewFileRetainStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	testRetainStore(t, "file", store)
+	binary := []byte{0x00, 0xff, '\n', 0x80}
+	store.Set(NewRetainedMessage("binary", 2, binary))
+	store.Close()
+
+	store, err = NewFileRetainStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	m, _ := store.Get("binary")
+	if m == nil || !bytes.Equal(m.Payload, binary) || m.QoS != 2 || m.Time.IsZero() {
+		t.Errorf("got %v\nwant %v", m, binary)
+	}
+	if m, _ := store.Get("b/c"); m != nil {
+		t.Errorf("got %v\nwant nil", m)
+	}
+	retained, _ := store.Match("a/#")
+	if len(retained) != 4 {
+		t.Errorf("got %d messages\nwant 4", len(retained))
+	}
+}
+
+func TestBrokerRetain(t *testing.T) {
+	b, addr := startTestBroker(t)
+	c := NewClient("retain-client", nil, 0, nil)
+	if err := c.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(c.isConnecting)
+	stored := func(topic string) bool {
+		m, _ := b.RetainStore.Get(topic)
+		return m != nil
+	}
+
+	c.Publish("retain/qos0", "data", 0, true)
+	if !waitFor(func() bool { return stored("retain/qos0") }) {
+		t.Errorf("QoS 0 retained message is not stored")
+	}
+	// an empty payload removes the retained message
+	c.Publish("retain/qos0", "", 0, true)
+	if !waitFor(func() bool { return !stored("retain/qos0") }) {
+		t.Errorf("retained message is not removed")
+	}
+	c.disconnectProcessing()
+}
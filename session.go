@@ -0,0 +1,344 @@
+package MQTTg
+
+import (
+	"bytes"
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// SessionNeverExpires is Session Expiry Interval of MQTT 5.0 which keeps the session
+// forever, the sessions of MQTT 3.1.1 have it.
+const SessionNeverExpires uint32 = 0xFFFFFFFF
+
+// Session is the state of a CleanSession=false client which has to be kept
+// while the client is offline.
+type Session struct {
+	ClientID      string
+	Subscriptions []*SubscribeTopic
+	// Inflight are the messages waiting for the acknowledgement, map[packetID]Message
+	Inflight map[uint16]Message
+	// Queue are the messages came while the client is offline
+	Queue []*PublishMessage
+	// ExpiryInterval is Session Expiry Interval in seconds,
+	// 0 and SessionNeverExpires keep the session forever
+	ExpiryInterval uint32
+	// ExpiresAt is set when the client disconnects, it is zero while the client is online
+	ExpiresAt time.Time
+}
+
+// sessionExpiresAt returns when the session expires after the client goes offline
+// at now, it is zero for the session which never expires.
+func sessionExpiresAt(interval uint32, now time.Time) time.Time {
+	if interval == 0 || interval == SessionNeverExpires {
+		return time.Time{}
+	}
+	return now.Add(time.Duration(interval) * time.Second)
+}
+
+// SessionStore keeps the sessions over broker restarts.
+// Save and Delete are called by the connections which close or take over a session
+// concurrently, and Delete may be called under the lock of the Broker,
+// so implementations must be safe for concurrent use and must not call the Broker.
+type SessionStore interface {
+	Save(session *Session) error
+	Delete(clientID string) error
+	// LoadAll returns every stored session, it is called when the broker starts serving
+	LoadAll() ([]*Session, error)
+}
+
+// QueueUpdater is implemented by the SessionStore which can update the queue
+// of the stored session without saving the whole session.
+type QueueUpdater interface {
+	// UpdateQueue removes dropped messages from the head of the queue and appends m
+	// unless it is nil. The session is created when it is not stored.
+	UpdateQueue(clientID string, dropped int, m *PublishMessage) error
+}
+
+func copySession(s *Session) *Session {
+	c := &Session{
+		ClientID:       s.ClientID,
+		Subscriptions:  make([]*SubscribeTopic, len(s.Subscriptions)),
+		Inflight:       make(map[uint16]Message, len(s.Inflight)),
+		Queue:          make([]*PublishMessage, len(s.Queue)),
+		ExpiryInterval: s.ExpiryInterval,
+		ExpiresAt:      s.ExpiresAt,
+	}
+	copy(c.Subscriptions, s.Subscriptions)
+	copy(c.Queue, s.Queue)
+	for id, m := range s.Inflight {
+		c.Inflight[id] = m
+	}
+	return c
+}
+
+// MemorySessionStore keeps the sessions only while the process is alive,
+// it is useful when the Broker is restarted in the same process and for tests.
+type MemorySessionStore struct {
+	sessions map[string]*Session
+	mu       sync.Mutex
+}
+
+func NewMemorySessionStore() *MemorySessionStore {
+	return &MemorySessionStore{
+		sessions: make(map[string]*Session),
+	}
+}
+
+func (self *MemorySessionStore) Save(session *Session) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	self.sessions[session.ClientID] = copySession(session)
+	return nil
+}
+
+func (self *MemorySessionStore) UpdateQueue(clientID string, dropped int, m *PublishMessage) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	s, ok := self.sessions[clientID]
+	if !ok {
+		s = copySession(&Session{ClientID: clientID})
+		self.sessions[clientID] = s
+	}
+	if dropped >= len(s.Queue) {
+		s.Queue = s.Queue[:0]
+	} else {
+		s.Queue = s.Queue[dropped:]
+	}
+	if m != nil {
+		s.Queue = append(s.Queue, m)
+	}
+	return nil
+}
+
+func (self *MemorySessionStore) Delete(clientID string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	delete(self.sessions, clientID)
+	return nil
+}
+
+func (self *MemorySessionStore) LoadAll() ([]*Session, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	sessions := make([]*Session, 0, len(self.sessions))
+	for _, s := range self.sessions {
+		sessions = append(sessions, copySession(s))
+	}
+	return sessions, nil
+}
+
+// sessionRecord is a line of the FileSessionStore log.
+// The messages are kept as the encoded MQTT packets.
+type sessionRecord struct {
+	ClientID string
+	Deleted  bool `json:",omitempty"`
+	// Update records UpdateQueue, Dequeued messages are removed
+	// from the stored queue and Queue is appended to it
+	Update        bool              `json:",omitempty"`
+	Dequeued      int               `json:",omitempty"`
+	Subscriptions []*SubscribeTopic `json:",omitempty"`
+	Inflight      [][]byte          `json:",omitempty"`
+	Queue         [][]byte          `json:",omitempty"`
+
+	ExpiryInterval uint32 `json:",omitempty"`
+	// ExpiresAt is the Unix time in milliseconds
+	ExpiresAt int64 `json:",omitempty"`
+}
+
+// encodeMessage prepends the protocol level to the frame,
+// the frames of MQTT 5.0 cannot be read without it.
+func encodeMessage(m Message) []byte {
+	var buf bytes.Buffer
+	buf.WriteByte(m.GetLevel())
+	m.Write(&buf)
+	return buf.Bytes()
+}
+
+func decodeMessage(b []byte) (Message, error) {
+	if len(b) == 0 {
+		return nil, INVALID_MESSAGE_CAME
+	}
+	return ReadFrameWithLevel(bytes.NewReader(b[1:]), b[0])
+}
+
+func newSessionRecord(s *Session) *sessionRecord {
+	r := &sessionRecord{
+		ClientID:       s.ClientID,
+		Subscriptions:  s.Subscriptions,
+		Inflight:       make([][]byte, 0, len(s.Inflight)),
+		Queue:          make([][]byte, 0, len(s.Queue)),
+		ExpiryInterval: s.ExpiryInterval,
+	}
+	if !s.ExpiresAt.IsZero() {
+		r.ExpiresAt = s.ExpiresAt.UnixMilli()
+	}
+	for _, m := range s.Inflight {
+		r.Inflight = append(r.Inflight, encodeMessage(m))
+	}
+	for _, m := range s.Queue {
+		r.Queue = append(r.Queue, encodeMessage(m))
+	}
+	return r
+}
+
+func (self *sessionRecord) session() (*Session, error) {
+	s := &Session{
+		ClientID:       self.ClientID,
+		Subscriptions:  self.Subscriptions,
+		Inflight:       make(map[uint16]Message, len(self.Inflight)),
+		Queue:          make([]*PublishMessage, 0, len(self.Queue)),
+		ExpiryInterval: self.ExpiryInterval,
+	}
+	if self.ExpiresAt != 0 {
+		s.ExpiresAt = time.UnixMilli(self.ExpiresAt)
+	}
+	if s.Subscriptions == nil {
+		s.Subscriptions = make([]*SubscribeTopic, 0)
+	}
+	for _, b := range self.Inflight {
+		m, err := decodeMessage(b)
+		if err != nil {
+			return nil, err
+		}
+		s.Inflight[m.GetPacketID()] = m
+	}
+	for _, b := range self.Queue {
+		m, err := decodeMessage(b)
+		if err != nil {
+			return nil, err
+		}
+		pub, ok := m.(*PublishMessage)
+		if !ok {
+			return nil, INVALID_MESSAGE_CAME
+		}
+		s.Queue = append(s.Queue, pub)
+	}
+	return s, nil
+}
+
+// FileSessionStore keeps the sessions in an append-only log,
+// every Save and Delete appends a JSON line.
+type FileSessionStore struct {
+	log      *fileLog
+	sessions map[string]*sessionRecord
+	mu       sync.Mutex
+}
+
+func NewFileSessionStore(path string) (*FileSessionStore, error) {
+	self := &FileSessionStore{
+		sessions: make(map[string]*sessionRecord),
+	}
+	var err error
+	self.log, err = openFileLog(path, func(line []byte) error {
+		record := &sessionRecord{}
+		if err := json.Unmarshal(line, record); err != nil {
+			return err
+		}
+		self.apply(record)
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+	if err := self.compact(); err != nil {
+		return nil, err
+	}
+	return self, nil
+}
+
+func (self *FileSessionStore) apply(record *sessionRecord) {
+	switch {
+	case record.Deleted:
+		delete(self.sessions, record.ClientID)
+	case record.Update:
+		stored, ok := self.sessions[record.ClientID]
+		if !ok {
+			stored = &sessionRecord{ClientID: record.ClientID}
+			self.sessions[record.ClientID] = stored
+		}
+		if record.Dequeued >= len(stored.Queue) {
+			stored.Queue = nil
+		} else {
+			stored.Queue = stored.Queue[record.Dequeued:]
+		}
+		stored.Queue = append(stored.Queue, record.Queue...)
+	default:
+		self.sessions[record.ClientID] = record
+	}
+}
+
+func (self *FileSessionStore) compact() error {
+	records := make([]interface{}, 0, len(self.sessions))
+	for _, record := range self.sessions {
+		records = append(records, record)
+	}
+	return self.log.compact(records)
+}
+
+func (self *FileSessionStore) compactIfNeeded() error {
+	if !self.log.needsCompaction(len(self.sessions)) {
+		return nil
+	}
+	return self.compact()
+}
+
+func (self *FileSessionStore) Save(session *Session) error {
+	record := newSessionRecord(session)
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if err := self.log.append(record); err != nil {
+		return err
+	}
+	self.apply(record)
+	return self.compactIfNeeded()
+}
+
+// UpdateQueue appends only the change of the queue to the log.
+func (self *FileSessionStore) UpdateQueue(clientID string, dropped int, m *PublishMessage) error {
+	record := &sessionRecord{ClientID: clientID, Update: true, Dequeued: dropped}
+	if m != nil {
+		record.Queue = [][]byte{encodeMessage(m)}
+	}
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if err := self.log.append(record); err != nil {
+		return err
+	}
+	self.apply(record)
+	return self.compactIfNeeded()
+}
+
+func (self *FileSessionStore) Delete(clientID string) error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	if _, ok := self.sessions[clientID]; !ok {
+		return nil
+	}
+	record := &sessionRecord{ClientID: clientID, Deleted: true}
+	if err := self.log.append(record); err != nil {
+		return err
+	}
+	self.apply(record)
+	return self.compactIfNeeded()
+}
+
+func (self *FileSessionStore) LoadAll() ([]*Session, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	sessions := make([]*Session, 0, len(self.sessions))
+	for _, record := range self.sessions {
+		s, err := record.session()
+		if err != nil {
+			return nil, err
+		}
+		sessions = append(sessions, s)
+	}
+	return sessions, nil
+}
+
+func (self *FileSessionStore) Close() error {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	return self.log.Close()
+}
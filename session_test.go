@@ -0,0 +1,238 @@
+package MQTTg
+
+import (
+	"context"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestFileSessionStore(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	store, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := &Session{
+		ClientID:      "daiki",
+		Subscriptions: []*SubscribeTopic{{State: SubscribeAck, Topic: "a/#", QoS: 1}, {State: SubscribeAck, Topic: "b/+", QoS: 2}},
+		Inflight: map[uint16]Message{
+			3: NewPublishMessage(true, 1, false, "a/b", 3, []uint8("data")),
+			4: NewPubrelMessage(4),
+		},
+		Queue:          []*PublishMessage{NewPublishMessage(false, 2, false, "a/c", 0, []uint8("queued"))},
+		ExpiryInterval: 60,
+		ExpiresAt:      time.UnixMilli(time.Now().UnixMilli()),
+	}
+	store.Save(&Session{ClientID: "daiki", Subscriptions: []*SubscribeTopic{}})
+	store.Save(expected)
+	store.Save(&Session{ClientID: "deleted"})
+	store.Delete("deleted")
+	store.Close()
+
+	// a record torn by a crash is ignored
+	f, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.Write([]byte(`{"ClientID":"torn","Subscr`))
+	f.Close()
+
+	store, err = NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	sessions, err := store.LoadAll()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(sessions) != 1 {
+		t.Fatalf("got %d sessions\nwant 1", len(sessions))
+	}
+	actual := sessions[0]
+	if actual.ClientID != expected.ClientID || !reflect.DeepEqual(actual.Subscriptions, expected.Subscriptions) {
+		t.Errorf("got %v\nwant %v", actual, expected)
+	}
+	if len(actual.Inflight) != len(expected.Inflight) {
+		t.Fatalf("got %d in-flight messages\nwant %d", len(actual.Inflight), len(expected.Inflight))
+	}
+	for id, m := range expected.Inflight {
+		if actual.Inflight[id] == nil || actual.Inflight[id].String() != m.String() {
+			t.Errorf("got %v\nwant %v", actual.Inflight[id], m)
+		}
+	}
+	if len(actual.Queue) != 1 || actual.Queue[0].String() != expected.Queue[0].String() {
+		t.Errorf("got %v\nwant %v", actual.Queue, expected.Queue)
+	}
+	if actual.ExpiryInterval != expected.ExpiryInterval || !actual.ExpiresAt.Equal(expected.ExpiresAt) {
+		t.Errorf("got %v %v\nwant %v %v", actual.ExpiryInterval, actual.ExpiresAt, expected.ExpiryInterval, expected.ExpiresAt)
+	}
+}
+
+func TestSessionStoreUpdateQueue(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	file, err := NewFileSessionStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer func() { file.Close() }()
+	for _, store := range []SessionStore{NewMemorySessionStore(), file} {
+		store.Save(&Session{ClientID: "queue", Subscriptions: []*SubscribeTopic{{Topic: "a/#", QoS: 1}}})
+		updater := store.(QueueUpdater)
+		for i := 0; i < 4; i++ {
+			updater.UpdateQueue("queue", 0, NewPublishMessage(false, 1, false, "a/"+strconv.Itoa(i), 0, []uint8("data")))
+		}
+		updater.UpdateQueue("queue", 2, nil)
+		updater.UpdateQueue("queue", 1, NewPublishMessage(false, 1, false, "a/4", 0, []uint8("data")))
+		if store == file {
+			// the changes are replayed
+			file.Close()
+			if file, err = NewFileSessionStore(path); err != nil {
+				t.Fatal(err)
+			}
+			store = file
+		}
+		sessions, err := store.LoadAll()
+		if err != nil || len(sessions) != 1 {
+			t.Fatalf("got %v, %v\nwant 1 session", sessions, err)
+		}
+		actual := []string{}
+		for _, pub := range sessions[0].Queue {
+			actual = append(actual, pub.TopicName)
+		}
+		if expected := []string{"a/3", "a/4"}; !reflect.DeepEqual(actual, expected) {
+			t.Errorf("got %v\nwant %v", actual, expected)
+		}
+		if len(sessions[0].Subscriptions) != 1 {
+			t.Errorf("got %v\nwant %v subscriptions", len(sessions[0].Subscriptions), 1)
+		}
+	}
+}
+
+func TestBrokerRestoreSession(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "sessions.log")
+	startBroker := func() (*Broker, *FileSessionStore, string) {
+		store, err := NewFileSessionStore(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		// the store is closed after the broker is shut down
+		t.Cleanup(func() { store.Close() })
+		b, addr := startTestBroker(t, func(b *Broker) { b.SessionStore = store })
+		return b, store, addr
+	}
+
+	b, store, addr := startBroker()
+	c := NewClient("persistent", nil, 0, nil)
+	if err := c.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	waitFor(c.isConnecting)
+	c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("a/#", 1)})
+	waitFor(func() bool { return len(b.TopicRoot.GetSubscribers("a/b")) == 1 })
+	c.Disconnect()
+	waitFor(func() bool {
+		bc, ok := b.GetClient("persistent")
+		return ok && !bc.isConnecting()
+	})
+	if err := b.Shutdown(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// the restarted broker knows the subscription before the client reconnects
+	b, _, addr = startBroker()
+	expected := map[string]uint8{"persistent": 1}
+	ok := waitFor(func() bool {
+		return reflect.DeepEqual(b.TopicRoot.GetSubscribers("a/b"), expected)
+	})
+	if !ok {
+		t.Errorf("got %v\nwant %v", b.TopicRoot.GetSubscribers("a/b"), expected)
+	}
+
+	c = NewClient("persistent", nil, 0, nil)
+	if err := c.Connect(addr, false); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not resume the session")
+	}
+	bc, _ := b.GetClient("persistent")
+	if subs := bc.session().Subscriptions; len(subs) != 1 || subs[0].Topic != "a/#" {
+		t.Errorf("got %v\nwant [a/#]", subs)
+	}
+	c.Disconnect()
+}
+
+func TestBrokerSessionExpiry(t *testing.T) {
+	store := NewMemorySessionStore()
+	b, addr := startTestBroker(t, func(b *Broker) { b.SessionStore = store })
+	stored := func(id string) bool {
+		sessions, _ := store.LoadAll()
+		for _, s := range sessions {
+			if s.ClientID == id {
+				return true
+			}
+		}
+		return false
+	}
+	connect := func(id string, expiry uint32) *Client {
+		c := NewClient(id, nil, 0, nil)
+		c.Protocol = MQTT_5_0
+		if expiry != 0 {
+			c.Properties = Properties{NewProperty(SessionExpiryInterval, expiry)}
+		}
+		if err := c.Connect(addr, false); err != nil {
+			t.Fatal(err)
+		}
+		if !waitFor(c.isConnecting) {
+			t.Fatal("could not connect")
+		}
+		c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("expiry/"+id, 1)}).Wait()
+		return c
+	}
+	offline := func(id string) func() bool {
+		return func() bool {
+			bc, ok := b.GetClient(id)
+			return ok && !bc.isConnecting()
+		}
+	}
+	gone := func(id string) func() bool {
+		return func() bool {
+			_, ok := b.GetClient(id)
+			return !ok && !stored(id) && len(b.TopicRoot.GetSubscribers("expiry/"+id)) == 0
+		}
+	}
+
+	// the session is deleted after the interval
+	connect("expiring", 1).Disconnect()
+	if !waitFor(offline("expiring")) || !stored("expiring") {
+		t.Error("the session is not kept while the interval")
+	}
+	if !waitFor(gone("expiring")) {
+		t.Error("the session is not deleted after the interval")
+	}
+
+	// the interval 0 with Clean Start 0 resumes the session and ends it at the disconnection
+	connect("ending", 60).Disconnect()
+	waitFor(offline("ending"))
+	connect("ending", 0).Disconnect()
+	if !waitFor(gone("ending")) {
+		t.Error("the session of the interval 0 is kept")
+	}
+
+	// the session expired while the broker was stopped is not restored
+	store.Save(&Session{ClientID: "expired", ExpiryInterval: 60, ExpiresAt: time.Now().Add(-time.Second)})
+	store.Save(&Session{ClientID: "restored", ExpiryInterval: 60, ExpiresAt: time.Now().Add(time.Minute)})
+	b, _ = startTestBroker(t, func(b *Broker) { b.SessionStore = store })
+	if !waitFor(offline("restored")) {
+		t.Error("the session is not restored")
+	}
+	if _, ok := b.GetClient("expired"); ok || stored("expired") {
+		t.Error("the expired session is restored")
+	}
+}
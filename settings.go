@@ -6,18 +6,21 @@ import (
 	"time"
 )
 
-// This is for frame send/recv string debug
+// This is for frame send/recv string debug, the frames are logged at slog.LevelDebug.
+// It is copied to the Transport of the Client, Broker.FrameDebug is used by the Broker
 var FrameDebug bool = true
 
-var ClSend, ClRecv, ClError *soac.Changer
+// These are used by ConsoleHandler
+var ClSend, ClRecv, ClWarn, ClError *soac.Changer
 var ClFrames []*soac.Changer
 
 func init() {
-	// This avoids packet ID from being same between client and broker
+	// This makes the jitter of the reconnection delay differ between the clients
 	rand.Seed(time.Now().UnixNano())
-	ClSend, ClRecv, ClError = soac.NewChanger(), soac.NewChanger(), soac.NewChanger()
+	ClSend, ClRecv, ClWarn, ClError = soac.NewChanger(), soac.NewChanger(), soac.NewChanger(), soac.NewChanger()
 	ClSend.Cyan().Underline()
 	ClRecv.Magenda().Underline()
+	ClWarn.Set256(208).Underline()
 	ClError.Red().Underline()
 
 	ClFrames = make([]*soac.Changer, 16)
@@ -38,4 +41,5 @@ func init() {
 	ClFrames[Pingreq].Set256(243)
 	ClFrames[Pingresp].Set256(237)
 	ClFrames[Disconnect].Set256(160)
+	ClFrames[Auth].Set256(214)
 }
@@ -0,0 +1,147 @@
+package MQTTg
+
+import (
+	"net"
+	"strconv"
+	"sync/atomic"
+	"time"
+)
+
+const SYS_PREFIX = "$SYS/broker/"
+
+// brokerStats are the counters published under $SYS and by the metrics endpoint.
+type brokerStats struct {
+	started time.Time
+	// received and sent are indexed by MessageType
+	received      [16]atomic.Int64
+	sent          [16]atomic.Int64
+	bytesReceived atomic.Int64
+	bytesSent     atomic.Int64
+	// the messages dropped because the offline queue or the in-flight window is full
+	droppedQueueFull atomic.Int64
+	droppedInflight  atomic.Int64
+	// the connections closed by the packets larger than MaxPacketSize
+	tooLarge atomic.Int64
+	// the requests rejected by Authenticator or Authorizer
+	connectDenied   atomic.Int64
+	publishDenied   atomic.Int64
+	subscribeDenied atomic.Int64
+	// maxConnected is updated when the statistics are published
+	maxConnected int
+}
+
+func (self *brokerStats) countMessage(m Message, sent bool) {
+	counters := &self.received
+	if sent {
+		counters = &self.sent
+	}
+	if t := m.GetType(); int(t) < len(counters) {
+		counters[t].Add(1)
+	}
+}
+
+func sumCounters(counters *[16]atomic.Int64) (sum int64) {
+	for i := range counters {
+		sum += counters[i].Load()
+	}
+	return sum
+}
+
+// statsConn counts the bytes of the connection.
+type statsConn struct {
+	net.Conn
+	stats *brokerStats
+}
+
+func (self *statsConn) Read(b []byte) (int, error) {
+	n, err := self.Conn.Read(b)
+	self.stats.bytesReceived.Add(int64(n))
+	return n, err
+}
+
+func (self *statsConn) Write(b []byte) (int, error) {
+	n, err := self.Conn.Write(b)
+	self.stats.bytesSent.Add(int64(n))
+	return n, err
+}
+
+// sysLoop publishes the statistics every SysInterval until Shutdown.
+func (self *Broker) sysLoop(quit chan struct{}) {
+	t := time.NewTicker(self.SysInterval)
+	defer t.Stop()
+	self.publishSys()
+	for {
+		select {
+		case <-t.C:
+			self.publishSys()
+		case <-quit:
+			return
+		}
+	}
+}
+
+// clientStats counts the registered clients including the offline sessions,
+// and their subscriptions and in-flight messages.
+func (self *Broker) clientStats() (connected, total, subscriptions, inflight int) {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	for _, c := range self.Clients {
+		total++
+		c.mu.Lock()
+		if c.IsConnecting {
+			connected++
+		}
+		subscriptions += len(c.SubTopics)
+		inflight += len(c.PacketIDMap)
+		c.mu.Unlock()
+	}
+	return connected, total, subscriptions, inflight
+}
+
+func (self *Broker) retainedCount() int {
+	retained, err := self.RetainStore.Match("#")
+	self.emitError(err)
+	return len(retained)
+}
+
+// sysMessages returns the payloads of the $SYS topics.
+func (self *Broker) sysMessages() map[string]string {
+	connected, total, subscriptions, _ := self.clientStats()
+	if connected > self.stats.maxConnected {
+		self.stats.maxConnected = connected
+	}
+
+	itoa := func(n int64) string { return strconv.FormatInt(n, 10) }
+	uptime := int64(time.Since(self.stats.started) / time.Second)
+	return map[string]string{
+		"uptime":                    itoa(uptime) + " seconds",
+		"clients/connected":         itoa(int64(connected)),
+		"clients/disconnected":      itoa(int64(total - connected)),
+		"clients/total":             itoa(int64(total)),
+		"clients/maximum":           itoa(int64(self.stats.maxConnected)),
+		"messages/received":         itoa(sumCounters(&self.stats.received)),
+		"messages/sent":             itoa(sumCounters(&self.stats.sent)),
+		"publish/messages/received": itoa(self.stats.received[Publish].Load()),
+		"publish/messages/sent":     itoa(self.stats.sent[Publish].Load()),
+		"bytes/received":            itoa(self.stats.bytesReceived.Load()),
+		"bytes/sent":                itoa(self.stats.bytesSent.Load()),
+		"subscriptions/count":       itoa(int64(subscriptions)),
+		"retained messages/count":   itoa(int64(self.retainedCount())),
+	}
+}
+
+// publishSys retains the statistics in sysRetain, which is not persisted,
+// and sends them to the current subscribers.
+func (self *Broker) publishSys() {
+	for name, payload := range self.sysMessages() {
+		topic := SYS_PREFIX + name
+		self.emitError(self.sysRetain.Set(NewRetainedMessage(topic, 0, []byte(payload))))
+		for subscriberID, reqQoS := range self.TopicRoot.GetSubscribers(topic) {
+			subscriber, ok := self.GetClient(subscriberID)
+			if !ok {
+				continue
+			}
+			self.checkQoSAndPublish(subscriber, 0, reqQoS, false, topic, []byte(payload))
+		}
+	}
+}
@@ -0,0 +1,85 @@
+package MQTTg
+
+import (
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestBrokerSys(t *testing.T) {
+	_, addr := startTestBroker(t, func(b *Broker) { b.SysInterval = 20 * time.Millisecond })
+
+	var mu sync.Mutex
+	received := make(map[string]string)
+	c := NewClient("sys-client", nil, 0, nil)
+	c.OnMessage = func(c *Client, m *PublishMessage) {
+		mu.Lock()
+		received[m.TopicName] = string(m.Payload)
+		mu.Unlock()
+	}
+	if err := c.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	// wildcards on the first level do not match $SYS
+	c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("#", 0)})
+	c.Publish("sys/retained", "data", 0, true)
+	time.Sleep(50 * time.Millisecond)
+	mu.Lock()
+	for topic := range received {
+		if topic != "sys/retained" {
+			t.Errorf("got %s\nwant only sys/retained", topic)
+		}
+	}
+	mu.Unlock()
+
+	c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("$SYS/broker/#", 0)})
+	expected := map[string]string{
+		"$SYS/broker/clients/connected":       "1",
+		"$SYS/broker/clients/total":           "1",
+		"$SYS/broker/subscriptions/count":     "2",
+		"$SYS/broker/retained messages/count": "1",
+	}
+	ok := waitFor(func() bool {
+		mu.Lock()
+		defer mu.Unlock()
+		for topic, payload := range expected {
+			if received[topic] != payload {
+				return false
+			}
+		}
+		return received["$SYS/broker/publish/messages/received"] != "" &&
+			received["$SYS/broker/bytes/sent"] != "0"
+	})
+	if !ok {
+		mu.Lock()
+		t.Errorf("got %v\nwant %v", received, expected)
+		mu.Unlock()
+	}
+
+	// the new subscriber gets the retained statistics
+	late := NewClient("sys-late", nil, 0, nil)
+	retained := make(chan bool, 1)
+	late.OnMessage = func(c *Client, m *PublishMessage) {
+		if m.Retain {
+			select {
+			case retained <- true:
+			default:
+			}
+		}
+	}
+	if err := late.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(late.isConnecting) {
+		t.Fatal("could not connect")
+	}
+	late.Subscribe([]*SubscribeTopic{NewSubscribeTopic("$SYS/broker/uptime", 0)})
+	select {
+	case <-retained:
+	case <-time.After(2 * time.Second):
+		t.Error("$SYS/broker/uptime is not retained")
+	}
+}
@@ -0,0 +1,130 @@
+package MQTTg
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// Token is returned by Publish, Subscribe and Unsubscribe, and it is
+// resolved when the acknowledgement comes back or the client is disconnected.
+type Token struct {
+	done chan struct{}
+	once sync.Once
+	err  error
+	// returnCodes are the codes granted by SUBACK
+	returnCodes []SubscribeReturnCode
+}
+
+func newToken() *Token {
+	return &Token{
+		done: make(chan struct{}),
+	}
+}
+
+// resolve is effective only for the first call.
+func (self *Token) resolve(err error, codes []SubscribeReturnCode) {
+	self.once.Do(func() {
+		self.err = err
+		self.returnCodes = codes
+		close(self.done)
+	})
+}
+
+// Done is closed when the token is resolved.
+func (self *Token) Done() <-chan struct{} {
+	return self.done
+}
+
+// Wait blocks until the token is resolved and returns its error.
+func (self *Token) Wait() error {
+	<-self.done
+	return self.err
+}
+
+// WaitTimeout returns ACK_TIMED_OUT when the token is not resolved in d.
+func (self *Token) WaitTimeout(d time.Duration) error {
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-self.done:
+		return self.err
+	case <-timer.C:
+		return ACK_TIMED_OUT
+	}
+}
+
+// WaitContext returns the error of ctx when it is done before the token.
+func (self *Token) WaitContext(ctx context.Context) error {
+	select {
+	case <-self.done:
+		return self.err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// Err returns nil while the token is not resolved.
+func (self *Token) Err() error {
+	select {
+	case <-self.done:
+		return self.err
+	default:
+		return nil
+	}
+}
+
+// ReturnCodes returns the codes of SUBACK, it is nil for the other tokens.
+func (self *Token) ReturnCodes() []SubscribeReturnCode {
+	select {
+	case <-self.done:
+		return self.returnCodes
+	default:
+		return nil
+	}
+}
+
+// addToken registers the token waiting for the acknowledgement of id.
+func (self *Client) addToken(id uint16) *Token {
+	t := newToken()
+	self.mu.Lock()
+	self.tokens[id] = t
+	self.mu.Unlock()
+	return t
+}
+
+func (self *Client) resolveToken(id uint16, err error, codes []SubscribeReturnCode) {
+	self.mu.Lock()
+	t, ok := self.tokens[id]
+	delete(self.tokens, id)
+	self.mu.Unlock()
+	if ok {
+		t.resolve(err, codes)
+	}
+}
+
+// resolveAllTokens fails the tokens which are waiting when the client is disconnected.
+func (self *Client) resolveAllTokens(err error) {
+	self.mu.Lock()
+	tokens := self.tokens
+	self.tokens = make(map[uint16]*Token)
+	self.mu.Unlock()
+	for _, t := range tokens {
+		t.resolve(err, nil)
+	}
+}
+
+// reasonError returns the reason code of MQTT 5.0 when it tells the failure.
+func reasonError(code ReasonCode) error {
+	if code >= 0x80 {
+		return code
+	}
+	return nil
+}
+
+// resolvedToken is returned when the request fails before it is sent.
+func resolvedToken(err error) *Token {
+	t := newToken()
+	t.resolve(err, nil)
+	return t
+}
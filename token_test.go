@@ -0,0 +1,78 @@
+package MQTTg
+
+import (
+	"context"
+	"io/ioutil"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestToken(t *testing.T) {
+	token := newToken()
+	if err := token.WaitTimeout(10 * time.Millisecond); err != ACK_TIMED_OUT {
+		t.Errorf("got %v\nwant %v", err, ACK_TIMED_OUT)
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if err := token.WaitContext(ctx); err != context.Canceled {
+		t.Errorf("got %v\nwant %v", err, context.Canceled)
+	}
+
+	token.resolve(NOT_CONNECTED, nil)
+	// the first result is kept
+	token.resolve(nil, []SubscribeReturnCode{SubscribeFailure})
+	if err := token.Wait(); err != NOT_CONNECTED {
+		t.Errorf("got %v\nwant %v", err, NOT_CONNECTED)
+	}
+	if codes := token.ReturnCodes(); codes != nil {
+		t.Errorf("got %v\nwant nil", codes)
+	}
+}
+
+func TestClientToken(t *testing.T) {
+	b, addr := startTestBroker(t)
+	path := filepath.Join(t.TempDir(), "acl")
+	ioutil.WriteFile(path, []byte("topic readwrite allowed/#\n"), 0600)
+	acl, err := NewACLAuthorizer(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Authorizer = acl
+	c := NewClient("token-client", nil, 0, nil)
+	if err := c.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(c.isConnecting) {
+		t.Fatal("could not connect")
+	}
+
+	token := c.Subscribe([]*SubscribeTopic{NewSubscribeTopic("allowed/#", 2), NewSubscribeTopic("denied/#", 1)})
+	if err := token.WaitTimeout(2 * time.Second); err != nil {
+		t.Fatal(err)
+	}
+	expected := []SubscribeReturnCode{AckMaxQoS2, SubscribeFailure}
+	if codes := token.ReturnCodes(); !reflect.DeepEqual(codes, expected) {
+		t.Errorf("got %v\nwant %v", codes, expected)
+	}
+
+	for qos := uint8(0); qos < 3; qos++ {
+		if err := c.Publish("allowed/a", "data", qos, false).WaitTimeout(2 * time.Second); err != nil {
+			t.Errorf("QoS %d: got %v\nwant nil", qos, err)
+		}
+	}
+	if err := c.Publish("allowed/#", "data", 1, false).Wait(); err != WILDCARD_CHARACTERS_IN_PUBLISH {
+		t.Errorf("got %v\nwant %v", err, WILDCARD_CHARACTERS_IN_PUBLISH)
+	}
+	if err := c.Unsubscribe([]string{"allowed/#"}).WaitTimeout(2 * time.Second); err != nil {
+		t.Errorf("got %v\nwant nil", err)
+	}
+
+	// the waiting token fails when the client is disconnected
+	token = c.addToken(100)
+	c.disconnectProcessing()
+	if err := token.WaitTimeout(2 * time.Second); err != NOT_CONNECTED {
+		t.Errorf("got %v\nwant %v", err, NOT_CONNECTED)
+	}
+}
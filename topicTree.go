@@ -2,27 +2,56 @@ package MQTTg
 
 import (
 	"strings"
+	"sync"
 )
 
+// TopicNode is safe for concurrent use. Each node guards its own
+// Nodes and Subscribers, so that publishers walking
+// different branches of the tree do not block each other.
 type TopicNode struct {
-	Nodes         map[string]*TopicNode
-	Name          string
-	FullPath      string
-	RetainMessage string
-	RetainQoS     uint8
-	Subscribers   map[string]uint8 // map[clientID]QoS
+	Nodes       map[string]*TopicNode
+	Name        string
+	FullPath    string
+	Subscribers map[string]uint8 // map[clientID]QoS
+	mu          sync.RWMutex
+}
+
+func NewTopicNode(name, fullPath string) *TopicNode {
+	return &TopicNode{
+		Nodes:       make(map[string]*TopicNode),
+		Name:        name,
+		FullPath:    fullPath,
+		Subscribers: make(map[string]uint8),
+	}
+}
+
+func (self *TopicNode) getChild(name, fullPath string, addNewNode bool) *TopicNode {
+	self.mu.RLock()
+	node, ok := self.Nodes[name]
+	self.mu.RUnlock()
+	if ok || !addNewNode {
+		return node
+	}
+	return self.ApplyNewTopic(name, fullPath)
+}
+
+func (self *TopicNode) getChildren() map[string]*TopicNode {
+	self.mu.RLock()
+	defer self.mu.RUnlock()
+	out := make(map[string]*TopicNode, len(self.Nodes))
+	for key, node := range self.Nodes {
+		out[key] = node
+	}
+	return out
 }
 
 func (self *TopicNode) GetNodesByNumberSign() (out []*TopicNode) {
-	self.FullPath = strings.TrimSuffix(self.FullPath, "/")
 	out = []*TopicNode{self}
-	if len(self.Nodes) > 0 {
-		for key, node := range self.Nodes {
-			if strings.HasPrefix(key, "$") {
-				continue
-			}
-			out = append(out, node.GetNodesByNumberSign()...)
+	for key, node := range self.getChildren() {
+		if strings.HasPrefix(key, "$") || isWildcard(key) {
+			continue
 		}
+		out = append(out, node.GetNodesByNumberSign()...)
 	}
 	return out
 }
@@ -31,15 +60,16 @@ func (self *TopicNode) GetTopicNodes(topic string, addNewNodes bool) (out []*Top
 	// this topic may have wildcard +*
 	parts := strings.Split(topic, "/")
 	nxt := self
-	ok := false
-	currentPath := ""
 	for i, part := range parts {
 		bef := nxt
+		if bef == nil {
+			break
+		}
 		switch part {
 		case "+":
 			// e.g.) A/+/C/D
-			for key, _ := range bef.Nodes {
-				if strings.HasPrefix(key, "$") {
+			for key, _ := range bef.getChildren() {
+				if strings.HasPrefix(key, "$") || isWildcard(key) {
 					continue
 				}
 				tmp, err := self.GetTopicNodes(strings.Replace(topic, "+", key, 1), addNewNodes)
@@ -58,15 +88,7 @@ func (self *TopicNode) GetTopicNodes(topic string, addNewNodes bool) (out []*Top
 			if strings.HasSuffix(part, "#") || strings.HasSuffix(part, "+") {
 				return nil, WILDCARD_MUST_NOT_BE_ADJACENT_TO_NAME
 			}
-			currentPath += part
-			if i != len(parts)-1 {
-				currentPath += "/"
-			}
-			nxt, ok = bef.Nodes[part]
-			if !ok && addNewNodes {
-				bef.ApplyNewTopic(part, currentPath)
-				nxt, _ = bef.Nodes[part]
-			}
+			nxt = bef.getChild(part, strings.Join(parts[:i+1], "/"), addNewNodes)
 			if len(parts)-1 == i && nxt != nil {
 				out = append(out, nxt)
 			}
@@ -75,63 +97,129 @@ func (self *TopicNode) GetTopicNodes(topic string, addNewNodes bool) (out []*Top
 	return out, nil
 }
 
-func (self *TopicNode) ApplySubscriber(clientID, topic string, qos uint8) ([]*TopicNode, []SubscribeReturnCode, error) {
-	// find topic edge and apply the clientID
-	edges, err := self.GetTopicNodes(topic, true)
-	if err != nil {
-		return nil, []SubscribeReturnCode{SubscribeFailure}, err
+// GetFilterNode returns the node which stores subscriptions for the filter.
+// Wildcards are kept as node names, so "a/+/c" lives at a -> + -> c.
+func (self *TopicNode) GetFilterNode(filter string, addNewNodes bool) (*TopicNode, error) {
+	if err := ValidateFilter(filter); err != nil {
+		return nil, err
 	}
-	codes := make([]SubscribeReturnCode, len(edges))
-	for i, edge := range edges {
-		// TODO: the return code should be managed by broker
-		edge.Subscribers[clientID] = qos
-		codes[i] = SubscribeReturnCode(qos)
+	parts := strings.Split(filter, "/")
+	nxt := self
+	for i, part := range parts {
+		nxt = nxt.getChild(part, strings.Join(parts[:i+1], "/"), addNewNodes)
+		if nxt == nil {
+			return nil, nil
+		}
 	}
-	return edges, codes, nil
+	return nxt, nil
 }
 
-func (self *TopicNode) DeleteSubscriber(clientID, topic string) error {
-	edges, err := self.GetTopicNodes(topic, false)
-	if err != nil {
-		return err
+// MatchTopicNodes returns every filter node whose filter matches the topic name.
+// This is done at publish time, so the topics created after SUBSCRIBE are also matched.
+func (self *TopicNode) MatchTopicNodes(topic string) []*TopicNode {
+	return self.matchTopicNodes(strings.Split(topic, "/"), 0)
+}
+
+// GetSubscribers collects the subscriptions matching the topic name per client.
+// When a client has overlapping subscriptions, the highest QoS is used
+// so that the message is delivered only once (MQTT 3.1.1, 3.3.5).
+func (self *TopicNode) GetSubscribers(topic string) map[string]uint8 {
+	out := make(map[string]uint8)
+	for _, node := range self.MatchTopicNodes(topic) {
+		node.mu.RLock()
+		for clientID, qos := range node.Subscribers {
+			if maxQoS, ok := out[clientID]; !ok || maxQoS < qos {
+				out[clientID] = qos
+			}
+		}
+		node.mu.RUnlock()
 	}
-	for _, edge := range edges {
-		delete(edge.Subscribers, clientID)
+	return out
+}
+
+// matchFilter reports whether the topic name matches the filter, in the same
+// way as MatchTopicNodes.
+func matchFilter(filter, topic string) bool {
+	filters, names := strings.Split(filter, "/"), strings.Split(topic, "/")
+	if strings.HasPrefix(topic, "$") && isWildcard(filters[0]) {
+		return false
 	}
-	return nil
+	for i, part := range filters {
+		if part == "#" {
+			return true
+		}
+		if i == len(names) || part != "+" && part != names[i] {
+			return false
+		}
+	}
+	return len(filters) == len(names)
+}
+
+func (self *TopicNode) matchTopicNodes(parts []string, depth int) (out []*TopicNode) {
+	// wildcards on the first level must not match topics beginning with '$'
+	wildcardOK := !(depth == 0 && strings.HasPrefix(parts[0], "$"))
+	if node := self.getChild("#", "", false); node != nil && wildcardOK {
+		// "a/#" matches "a" as well
+		out = append(out, node)
+	}
+	if depth == len(parts) {
+		return append(out, self)
+	}
+	if node := self.getChild("+", "", false); node != nil && wildcardOK {
+		out = append(out, node.matchTopicNodes(parts, depth+1)...)
+	}
+	if node := self.getChild(parts[depth], "", false); node != nil && !isWildcard(parts[depth]) {
+		out = append(out, node.matchTopicNodes(parts, depth+1)...)
+	}
+	return out
+}
+
+func (self *TopicNode) ApplySubscriber(clientID, filter string, qos uint8) (*TopicNode, SubscribeReturnCode, error) {
+	// find filter node and apply the clientID
+	edge, err := self.GetFilterNode(filter, true)
+	if err != nil {
+		return nil, SubscribeFailure, err
+	}
+	// TODO: the return code should be managed by broker
+	edge.mu.Lock()
+	edge.Subscribers[clientID] = qos
+	edge.mu.Unlock()
+	return edge, SubscribeReturnCode(qos), nil
 }
 
-func (self *TopicNode) ApplyRetain(topic string, qos uint8, retain string) error {
-	edges, err := self.GetTopicNodes(topic, true)
+func (self *TopicNode) DeleteSubscriber(clientID, filter string) error {
+	edge, err := self.GetFilterNode(filter, false)
 	if err != nil {
 		return err
 	}
-	for _, edge := range edges {
-		// for debug to store all retain mesage
-		// edge.RetainMessage = append(edge.RetainMessage, retain)
-		edge.RetainMessage = retain
-		edge.RetainQoS = qos
+	if edge == nil {
+		return UNSUBSCRIBE_TO_NON_SUBSCRIBE_TOPIC
 	}
-
+	edge.mu.Lock()
+	delete(edge.Subscribers, clientID)
+	edge.mu.Unlock()
 	return nil
 }
 
-func (self *TopicNode) ApplyNewTopic(topic, fullPath string) {
-	self.Nodes[topic] = &TopicNode{
-		Nodes:         make(map[string]*TopicNode),
-		Name:          topic,
-		FullPath:      fullPath,
-		RetainMessage: "",
-		RetainQoS:     0,
-		Subscribers:   make(map[string]uint8),
+// ApplyNewTopic returns the child node named topic, creating it when it does not exist yet.
+func (self *TopicNode) ApplyNewTopic(topic, fullPath string) *TopicNode {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	// another goroutine may have created it
+	if node, ok := self.Nodes[topic]; ok {
+		return node
 	}
+	node := NewTopicNode(topic, fullPath)
+	self.Nodes[topic] = node
+	return node
 }
 
 func (self *TopicNode) DumpTree() (str []string) {
-	if len(self.Nodes) == 0 {
+	nodes := self.getChildren()
+	if len(nodes) == 0 {
 		return []string{self.Name}
 	}
-	for _, node := range self.Nodes {
+	for _, node := range nodes {
 		deepStrs := node.DumpTree()
 		currentPath := ""
 		if self.Name != "" {
@@ -143,3 +231,22 @@ func (self *TopicNode) DumpTree() (str []string) {
 	}
 	return str
 }
+
+func ValidateFilter(filter string) error {
+	if len(filter) == 0 {
+		return TOPIC_FILTER_IS_EMPTY
+	}
+	parts := strings.Split(filter, "/")
+	for i, part := range parts {
+		if part == "#" && i != len(parts)-1 {
+			return MULTI_LEVEL_WILDCARD_MUST_BE_ON_TAIL
+		} else if !isWildcard(part) && (strings.HasSuffix(part, "#") || strings.HasSuffix(part, "+")) {
+			return WILDCARD_MUST_NOT_BE_ADJACENT_TO_NAME
+		}
+	}
+	return nil
+}
+
+func isWildcard(part string) bool {
+	return part == "#" || part == "+"
+}
@@ -1,6 +1,7 @@
 package MQTTg
 
 import (
+	"reflect"
 	"testing"
 )
 
@@ -16,14 +17,7 @@ var Topics []string = []string{
 
 func TestGetTopicNodes(t *testing.T) {
 	// This might include ApplyNewTopic, GetNodeByNumberSign
-	root := TopicNode{
-		make(map[string]*TopicNode),
-		"",
-		"",
-		"",
-		0,
-		make(map[string]uint8),
-	}
+	root := NewTopicNode("", "")
 	for _, topic := range Topics {
 		// set topics
 		root.GetTopicNodes(topic, true)
@@ -91,23 +85,30 @@ func TestGetTopicNodes(t *testing.T) {
 	}
 
 	e_Subscribers := [][]string{
-		[]string{"a/b/c/d/e", "client-1", "client-2"},
+		[]string{"a/b/c/d/e", "client-1", "client-2", "client-3"},
 		[]string{"a/b/cc/d/e", "client-2", "client-3"},
-		[]string{"a/+/c/+/e", "client-3"},
-		[]string{"a/b/+/d/#", "client-3"},
+		[]string{"a/bb/c/dd/e", "client-3"},
+		[]string{"a/b/c/d", "client-3"},
+		// topics which did not exist when subscribed
+		[]string{"a/new/c/new/e", "client-3"},
+		[]string{"a/b/new/d/new/topic", "client-3"},
 	}
 
 	for _, e_Subscriber := range e_Subscribers {
-		topicNodes, _ := root.GetTopicNodes(e_Subscriber[0], false)
-		for _, node := range topicNodes {
-			for j := 1; j < len(e_Subscriber); j++ {
-				_, ok := node.Subscribers[e_Subscriber[j]]
-				if !ok {
-					t.Errorf("%v is not in %v", e_Subscriber[j], e_Subscriber[0])
-				}
+		subscribers := map[string]bool{}
+		for _, node := range root.MatchTopicNodes(e_Subscriber[0]) {
+			for id, _ := range node.Subscribers {
+				subscribers[id] = true
+			}
+		}
+		if len(subscribers) != len(e_Subscriber)-1 {
+			t.Errorf("got %v\nwant %v", subscribers, e_Subscriber[1:])
+		}
+		for j := 1; j < len(e_Subscriber); j++ {
+			if !subscribers[e_Subscriber[j]] {
+				t.Errorf("%v is not in %v", e_Subscriber[j], e_Subscriber[0])
 			}
 		}
-
 	}
 
 	a_topicStrings := root.DumpTree()
@@ -124,3 +125,84 @@ func TestGetTopicNodes(t *testing.T) {
 	}
 
 }
+
+func TestGetSubscribers(t *testing.T) {
+	root := NewTopicNode("", "")
+	subscriptions := []struct {
+		clientID string
+		filter   string
+		qos      uint8
+	}{
+		{"client-1", "a/+", 0},
+		{"client-1", "a/#", 2},
+		{"client-2", "a/b", 1},
+		{"client-2", "+/b", 0},
+		{"client-3", "#", 1},
+		{"client-4", "$SYS/#", 0},
+		{"client-5", "+/+/c", 2},
+	}
+	for _, s := range subscriptions {
+		root.ApplySubscriber(s.clientID, s.filter, s.qos)
+	}
+
+	tests := []struct {
+		topic    string
+		expected map[string]uint8
+	}{
+		{"a/b", map[string]uint8{"client-1": 2, "client-2": 1, "client-3": 1}},
+		{"a", map[string]uint8{"client-1": 2, "client-3": 1}},
+		{"a/b/c", map[string]uint8{"client-1": 2, "client-3": 1, "client-5": 2}},
+		{"x/b", map[string]uint8{"client-2": 0, "client-3": 1}},
+		{"x/y/c", map[string]uint8{"client-3": 1, "client-5": 2}},
+		{"$SYS/uptime", map[string]uint8{"client-4": 0}},
+		{"$SYS", map[string]uint8{"client-4": 0}},
+	}
+	for _, test := range tests {
+		actual := root.GetSubscribers(test.topic)
+		if !reflect.DeepEqual(actual, test.expected) {
+			t.Errorf("%s: got %v\nwant %v", test.topic, actual, test.expected)
+		}
+	}
+}
+
+func TestMatchFilter(t *testing.T) {
+	tests := []struct {
+		filter, topic string
+		expected      bool
+	}{
+		{"a/b", "a/b", true},
+		{"a/b", "a/c", false},
+		{"a/+", "a/b", true},
+		{"a/+", "a/b/c", false},
+		{"a/#", "a", true},
+		{"a/#", "a/b/c", true},
+		{"+/b", "a/b", true},
+		{"#", "$SYS/broker", false},
+		{"$SYS/#", "$SYS/broker", true},
+		{"a/b/c", "a/b", false},
+	}
+	for _, test := range tests {
+		if actual := matchFilter(test.filter, test.topic); actual != test.expected {
+			t.Errorf("%s %s: got %v\nwant %v", test.filter, test.topic, actual, test.expected)
+		}
+	}
+}
+
+func TestValidateFilter(t *testing.T) {
+	tests := []struct {
+		filter   string
+		expected error
+	}{
+		{"a/b", nil},
+		{"/", nil},
+		{"+/#", nil},
+		{"", TOPIC_FILTER_IS_EMPTY},
+		{"a/b#", WILDCARD_MUST_NOT_BE_ADJACENT_TO_NAME},
+		{"#/a", MULTI_LEVEL_WILDCARD_MUST_BE_ON_TAIL},
+	}
+	for _, test := range tests {
+		if actual := ValidateFilter(test.filter); actual != test.expected {
+			t.Errorf("%q: got %v\nwant %v", test.filter, actual, test.expected)
+		}
+	}
+}
@@ -1,17 +1,31 @@
 package MQTTg
 
 import (
-	"fmt"
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"io/ioutil"
+	"log/slog"
 	"net"
 )
 
 type Transport struct {
-	conn *net.TCPConn
+	conn net.Conn
+	// FrameDebug logs the frames at slog.LevelDebug
+	FrameDebug bool
+	// logger is the one of the Broker, the logger of the package is used when this is nil
+	logger *slog.Logger
+	// Level is the protocol level of the connection, which is decided by CONNECT
+	Level uint8
+	// MaxPacketSize is the largest packet read from the connection, 0 means no limit
+	MaxPacketSize uint32
+	// stats counts the messages of the broker side connection
+	stats *brokerStats
 }
 
-func NewTransport() (*Transport) {
+func NewTransport() *Transport {
 	// TODO: do some certification, authentication
-	return &Transport{}
+	return &Transport{FrameDebug: FrameDebug}
 }
 
 func (self *Transport) Connect(url string) error {
@@ -27,23 +41,109 @@ func (self *Transport) Connect(url string) error {
 	return nil
 }
 
+func (self *Transport) ConnectTLS(url string, config *tls.Config) error {
+	conn, err := tls.Dial("tcp4", url, config)
+	if err != nil {
+		return err
+	}
+	self.conn = conn
+	return nil
+}
+
+// NewServerTLSConfig loads the broker certificate. When clientCAFile is given,
+// the clients have to present a certificate which is verified by the CA.
+func NewServerTLSConfig(certFile, keyFile, clientCAFile string) (*tls.Config, error) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
+	}
+	config := &tls.Config{
+		Certificates: []tls.Certificate{cert},
+		MinVersion:   tls.VersionTLS12,
+	}
+	if len(clientCAFile) > 0 {
+		config.ClientCAs, err = loadCertPool(clientCAFile)
+		if err != nil {
+			return nil, err
+		}
+		config.ClientAuth = tls.RequireAndVerifyClientCert
+	}
+	return config, nil
+}
+
+// NewClientTLSConfig trusts the broker certificate signed by caFile.
+// certFile and keyFile are used as the client certificate when they are given.
+func NewClientTLSConfig(caFile, certFile, keyFile string) (*tls.Config, error) {
+	config := &tls.Config{
+		MinVersion: tls.VersionTLS12,
+	}
+	var err error
+	if len(caFile) > 0 {
+		config.RootCAs, err = loadCertPool(caFile)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(certFile) > 0 {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, err
+		}
+		config.Certificates = []tls.Certificate{cert}
+	}
+	return config, nil
+}
+
+func loadCertPool(caFile string) (*x509.CertPool, error) {
+	pem, err := ioutil.ReadFile(caFile)
+	if err != nil {
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, errors.New("no certificate in " + caFile)
+	}
+	return pool, nil
+}
+
+// SendMessage returns the error of the connection, such as the peer has gone away.
 func (self *Transport) SendMessage(m Message) error {
-	m.Write(self.conn)
-	if FrameDebug {
-		fmt.Println(ClSend.Apply("Send")+":"+self.conn.LocalAddr().String()+" ---> "+self.conn.RemoteAddr().String(), m.String())
+	return self.SendMessages(m)
+}
+
+// SendMessages encodes the messages into a buffer and writes them by a single Write.
+func (self *Transport) SendMessages(ms ...Message) error {
+	buf := getBuffer()
+	defer putBuffer(buf)
+	for _, m := range ms {
+		// the message can be stored in a session of the other level
+		m.SetLevel(self.Level)
+		*buf = AppendMessage(*buf, m)
+	}
+	if _, err := self.conn.Write(*buf); err != nil {
+		return err
+	}
+	for _, m := range ms {
+		if self.stats != nil {
+			self.stats.countMessage(m, true)
+		}
+		self.logFrame("send", m)
 	}
 	return nil
 }
 
 func (self *Transport) ReadMessage() (Message, error) {
-	m, err := ReadFrame(self.conn)
+	m, err := readFrame(self.conn, self.Level, self.MaxPacketSize)
 	if err != nil {
+		if err == PACKET_IS_TOO_LARGE && self.stats != nil {
+			self.stats.tooLarge.Add(1)
+		}
 		return nil, err
 	}
-
-	if FrameDebug {
-		fmt.Println(ClRecv.Apply("Recv")+":"+self.conn.LocalAddr().String()+" <--- "+self.conn.RemoteAddr().String(), m.String())
+	if self.stats != nil {
+		self.stats.countMessage(m, false)
 	}
+	self.logFrame("recv", m)
 
 	return m, nil
 }
@@ -0,0 +1,172 @@
+package MQTTg
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+type testCert struct {
+	cert     *x509.Certificate
+	key      *ecdsa.PrivateKey
+	certFile string
+	keyFile  string
+}
+
+func newTestCert(t *testing.T, dir, name string, parent *testCert, isCA bool) *testCert {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(time.Now().UnixNano()),
+		Subject:               pkix.Name{CommonName: name},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  isCA,
+		BasicConstraintsValid: true,
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth, x509.ExtKeyUsageClientAuth},
+	}
+	signer, signerKey := template, key
+	if parent != nil {
+		signer, signerKey = parent.cert, parent.key
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	cert, _ := x509.ParseCertificate(der)
+	keyDer, _ := x509.MarshalECPrivateKey(key)
+	c := &testCert{
+		cert:     cert,
+		key:      key,
+		certFile: filepath.Join(dir, name+".crt"),
+		keyFile:  filepath.Join(dir, name+".key"),
+	}
+	ioutil.WriteFile(c.certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600)
+	ioutil.WriteFile(c.keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600)
+	return c
+}
+
+func startTestTLSBroker(t *testing.T, config *tls.Config) (*Broker, string) {
+	listener, err := tls.Listen("tcp4", "127.0.0.1:0", config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return serveTestBroker(t, listener), listener.Addr().String()
+}
+
+func TestTLSConnect(t *testing.T) {
+	dir := t.TempDir()
+	ca := newTestCert(t, dir, "ca", nil, true)
+	server := newTestCert(t, dir, "server", ca, false)
+	client := newTestCert(t, dir, "client", ca, false)
+
+	tests := []struct {
+		clientCAFile string
+		certFile     string
+		keyFile      string
+		connected    bool
+	}{
+		{"", "", "", true},
+		{"", client.certFile, client.keyFile, true},
+		{ca.certFile, client.certFile, client.keyFile, true},
+		// client certificate is required
+		{ca.certFile, "", "", false},
+	}
+	for i, test := range tests {
+		serverConfig, err := NewServerTLSConfig(server.certFile, server.keyFile, test.clientCAFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		clientConfig, err := NewClientTLSConfig(ca.certFile, test.certFile, test.keyFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, addr := startTestTLSBroker(t, serverConfig)
+		c := NewClient("tls-client", nil, 0, nil)
+		err = c.ConnectTLS(addr, true, clientConfig)
+		if err != nil {
+			if test.connected {
+				t.Errorf("%d: got %v\nwant connected", i, err)
+			}
+			continue
+		}
+		// wait for CONNACK, or the handshake failure found by ReadLoop
+		waitFor(func() bool {
+			c.mu.Lock()
+			defer c.mu.Unlock()
+			return c.IsConnecting || c.disconnected
+		})
+		connected := c.isConnecting()
+		if connected != test.connected {
+			t.Errorf("%d: got %v\nwant %v", i, connected, test.connected)
+		}
+		c.disconnectProcessing()
+	}
+}
+
+// recordConn records the Write calls instead of sending them.
+type recordConn struct {
+	net.Conn
+	writes [][]byte
+}
+
+func (self *recordConn) Write(b []byte) (int, error) {
+	self.writes = append(self.writes, append([]byte{}, b...))
+	return len(b), nil
+}
+
+func TestSendMessages(t *testing.T) {
+	conn := &recordConn{}
+	tr := &Transport{conn: conn}
+	ms := []Message{
+		NewPublishMessage(false, 1, false, "a/b", 1, []byte("data")),
+		NewPubackMessage(2),
+		NewPingreqMessage(),
+	}
+	if err := tr.SendMessages(ms...); err != nil {
+		t.Fatal(err)
+	}
+	if len(conn.writes) != 1 {
+		t.Fatalf("got %v\nwant %v writes", len(conn.writes), 1)
+	}
+	r := bytes.NewReader(conn.writes[0])
+	for _, e_m := range ms {
+		a_m, err := ReadFrame(r)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if a_m.GetType() != e_m.GetType() {
+			t.Errorf("got %v\nwant %v", a_m.GetType(), e_m.GetType())
+		}
+	}
+
+	var buf bytes.Buffer
+	n, err := ms[0].Write(&buf)
+	if err != nil || n != buf.Len() {
+		t.Errorf("got %v, %v\nwant %v, nil", n, err, buf.Len())
+	}
+}
+
+func TestSendMessageClosed(t *testing.T) {
+	local, remote := net.Pipe()
+	remote.Close()
+	tr := &Transport{conn: local}
+	if err := tr.SendMessage(NewPingreqMessage()); err == nil {
+		t.Errorf("got nil\nwant error")
+	}
+}
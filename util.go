@@ -1,10 +1,12 @@
 package MQTTg
 
 import (
+	"bytes"
 	"encoding/binary"
-	"fmt"
 	"io"
 	"net"
+	"strconv"
+	"unicode/utf8"
 )
 
 func UTF8_encode(w io.Writer, s string) int {
@@ -13,13 +15,45 @@ func UTF8_encode(w io.Writer, s string) int {
 	return 2 + len(s)
 }
 
-func UTF8_decode(r io.Reader, str *string) (len uint16) {
-	binary.Read(r, binary.BigEndian, &len)
-	data := make([]byte, len)
-	binary.Read(r, binary.BigEndian, &data)
+// UTF8_decode returns INVALID_UTF8_STRING when the string is not well-formed UTF-8
+// or has U+0000, and io.ErrUnexpectedEOF or io.EOF when it is truncated.
+func UTF8_decode(r io.Reader, str *string) (uint16, error) {
+	data, err := readBinary(r)
+	if err != nil {
+		return 0, err
+	}
+	if !utf8.Valid(data) || bytes.IndexByte(data, 0) >= 0 {
+		return 0, INVALID_UTF8_STRING
+	}
 	*str = string(data)
-	len += 2
-	return len
+	return uint16(2 + len(data)), nil
+}
+
+// readBinary reads the two bytes length and the data, which is used
+// for the password and the will message.
+func readBinary(r io.Reader) ([]byte, error) {
+	var length uint16
+	if err := binary.Read(r, binary.BigEndian, &length); err != nil {
+		return nil, err
+	}
+	if err := checkRemaining(r, uint64(length)); err != nil {
+		return nil, err
+	}
+	data := make([]byte, length)
+	if _, err := io.ReadFull(r, data); err != nil {
+		return nil, err
+	}
+	return data, nil
+}
+
+// checkRemaining returns PACKET_IS_TRUNCATED when r is bounded like the body of
+// readFrame and has less than n bytes, so that a length from the wire
+// is checked before it is allocated.
+func checkRemaining(r io.Reader, n uint64) error {
+	if br, ok := r.(interface{ Len() int }); ok && n > uint64(br.Len()) {
+		return PACKET_IS_TRUNCATED
+	}
+	return nil
 }
 
 func RemainEncode(w io.Writer, length uint32) int {
@@ -45,7 +79,10 @@ func RemainDecode(r io.Reader, remLen *uint32) (int, error) {
 	i := 0
 	var tmp byte
 	for ; ; i++ {
-		binary.Read(r, binary.BigEndian, &tmp)
+		err := binary.Read(r, binary.BigEndian, &tmp)
+		if err != nil {
+			return 0, err
+		}
 		*remLen += uint32(tmp&0x7f) * m
 		m *= 0x80
 
@@ -60,13 +97,20 @@ func RemainDecode(r io.Reader, remLen *uint32) (int, error) {
 	return i + 1, nil
 }
 
-func GetLocalAddr() (*net.TCPAddr, error) {
+const (
+	MQTT_PORT           = 1883
+	MQTT_TLS_PORT       = 8883
+	MQTT_WEBSOCKET_PORT = 8080
+	MQTT_METRICS_PORT   = 9883
+)
+
+func GetLocalAddr(port int) (*net.TCPAddr, error) {
 	addrs, err := net.InterfaceAddrs()
 	for _, a := range addrs {
 		if ipnet, ok := a.(*net.IPNet); ok && !ipnet.IP.IsLoopback() {
 			if ipnet.IP.To4() != nil {
-				// MQTT default, TODO: set by config file
-				return net.ResolveTCPAddr("tcp4", ipnet.IP.String()+":8883")
+				// TODO: set by config file
+				return net.ResolveTCPAddr("tcp4", ipnet.IP.String()+":"+strconv.Itoa(port))
 			}
 		}
 	}
@@ -101,18 +145,55 @@ const (
 	WILDCARD_CHARACTERS_IN_PUBLISH
 	FAIL_TO_SET_PACKET_ID
 	UNSUBSCRIBE_TO_NON_SUBSCRIBE_TOPIC
+	WEBSOCKET_FRAME_MUST_BE_BINARY
+	OFFLINE_QUEUE_IS_FULL
+	MALFORMED_PROPERTY
+	INVALID_CLIENT_ID_LENGTH
+	NOT_AUTHORIZED_TO_SUBSCRIBE
+	ACK_TIMED_OUT
+	PACKET_ID_IS_EXHAUSTED
+	BROKER_CLOSED
+	PACKET_IS_TRUNCATED
+	PACKET_HAS_EXTRA_BYTES
+	INVALID_UTF8_STRING
+	PACKET_IS_TOO_LARGE
+	TOPIC_FILTER_IS_EMPTY
+	NO_TOPIC_FILTER_IN_PAYLOAD
 )
 
+// MalformedPacketError is returned by ReadFrame when the packet cannot be parsed,
+// the connection has to be closed because the following packets cannot be found.
+// Err is PACKET_IS_TRUNCATED, PACKET_HAS_EXTRA_BYTES, INVALID_UTF8_STRING
+// or the error of the parser.
+type MalformedPacketError struct {
+	Type MessageType
+	Err  error
+}
+
+func newMalformedPacketError(t MessageType, err error) *MalformedPacketError {
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		// the fields are longer than the remaining length
+		err = PACKET_IS_TRUNCATED
+	}
+	return &MalformedPacketError{
+		Type: t,
+		Err:  err,
+	}
+}
+
+func (self *MalformedPacketError) Error() string {
+	return "malformed " + self.Type.String() + ": " + self.Err.Error()
+}
+
+func (self *MalformedPacketError) Unwrap() error {
+	return self.Err
+}
+
+// EmitError logs the error at slog.LevelError, the methods of the connection
+// use emitError to add the client ID and the remote address.
 func EmitError(e error) {
-	// TODO: added logging here
 	if e != nil {
-		str := ""
-		if _, t := e.(MQTT_ERROR); t {
-			str += "MQTT_ERROR"
-		} else {
-			str += "NORMAL_ERROR"
-		}
-		fmt.Printf("[%s] %s\n", ClError.Apply(str), e.Error())
+		logError(currentLogger(), e)
 	}
 }
 
@@ -143,5 +224,19 @@ func (e MQTT_ERROR) Error() string {
 		"WILDCARD_CHARACTERS_IN_PUBLISH",
 		"FAIL_TO_SET_PACKET_ID",
 		"UNSUBSCRIBE_TO_NON_SUBSCRIBE_TOPIC",
+		"WEBSOCKET_FRAME_MUST_BE_BINARY",
+		"OFFLINE_QUEUE_IS_FULL",
+		"MALFORMED_PROPERTY",
+		"INVALID_CLIENT_ID_LENGTH",
+		"NOT_AUTHORIZED_TO_SUBSCRIBE",
+		"ACK_TIMED_OUT",
+		"PACKET_ID_IS_EXHAUSTED",
+		"BROKER_CLOSED",
+		"PACKET_IS_TRUNCATED",
+		"PACKET_HAS_EXTRA_BYTES",
+		"INVALID_UTF8_STRING",
+		"PACKET_IS_TOO_LARGE",
+		"TOPIC_FILTER_IS_EMPTY",
+		"NO_TOPIC_FILTER_IN_PAYLOAD",
 	}[e]
 }
@@ -31,7 +31,10 @@ func TestUTF8_decode(t *testing.T) {
 	e_b := wire.Bytes()
 	r := bytes.NewReader(e_b)
 	var a_data string
-	a_len := UTF8_decode(r, &a_data)
+	a_len, err := UTF8_decode(r, &a_data)
+	if err != nil {
+		t.Fatal(err)
+	}
 	if a_data != e_data {
 		t.Errorf("got %v\nwant %v", a_data, e_data)
 	}
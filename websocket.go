@@ -0,0 +1,138 @@
+package MQTTg
+
+import (
+	"crypto/tls"
+	"github.com/gorilla/websocket"
+	"io"
+	"net"
+	"net/http"
+	"time"
+)
+
+const WEBSOCKET_SUBPROTOCOL = "mqtt"
+
+// wsConn makes a WebSocket connection look like a stream, so that the
+// MQTT packets go through the same ReadFrame and Message.Write path as TCP.
+// A packet may be split into or share binary frames with other packets.
+type wsConn struct {
+	*websocket.Conn
+	reader io.Reader
+}
+
+func newWsConn(conn *websocket.Conn) *wsConn {
+	return &wsConn{Conn: conn}
+}
+
+func (self *wsConn) Read(b []byte) (int, error) {
+	for {
+		if self.reader == nil {
+			mType, r, err := self.NextReader()
+			if err != nil {
+				if websocket.IsCloseError(err, websocket.CloseNormalClosure, websocket.CloseGoingAway) {
+					return 0, io.EOF
+				}
+				return 0, err
+			}
+			if mType != websocket.BinaryMessage {
+				return 0, WEBSOCKET_FRAME_MUST_BE_BINARY
+			}
+			self.reader = r
+		}
+		n, err := self.reader.Read(b)
+		if err == io.EOF {
+			// go to the next frame
+			self.reader = nil
+			if n == 0 {
+				continue
+			}
+			err = nil
+		}
+		return n, err
+	}
+}
+
+func (self *wsConn) Write(b []byte) (int, error) {
+	err := self.WriteMessage(websocket.BinaryMessage, b)
+	if err != nil {
+		return 0, err
+	}
+	return len(b), nil
+}
+
+func (self *wsConn) SetDeadline(t time.Time) error {
+	if err := self.SetReadDeadline(t); err != nil {
+		return err
+	}
+	return self.SetWriteDeadline(t)
+}
+
+var wsUpgrader = websocket.Upgrader{
+	Subprotocols: []string{WEBSOCKET_SUBPROTOCOL},
+	// browser dashboards are served from other origins,
+	// clients are authenticated by CONNECT instead
+	CheckOrigin: func(r *http.Request) bool { return true },
+}
+
+// WebSocketHandler accepts MQTT over WebSocket. The clients join the same
+// TopicRoot as the TCP clients.
+func (self *Broker) WebSocketHandler() http.Handler {
+	self.emitError(self.initialize())
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		offered := false
+		for _, p := range websocket.Subprotocols(r) {
+			if p == WEBSOCKET_SUBPROTOCOL {
+				offered = true
+			}
+		}
+		if !offered {
+			http.Error(w, "subprotocol must be "+WEBSOCKET_SUBPROTOCOL, http.StatusBadRequest)
+			return
+		}
+		conn, err := wsUpgrader.Upgrade(w, r, nil)
+		if err != nil {
+			// Upgrade replies the error to the client
+			self.emitError(err)
+			return
+		}
+		self.serveConn(newWsConn(conn))
+	})
+}
+
+// StartWebSocket serves MQTT over WebSocket on the path.
+func (self *Broker) StartWebSocket(path string) error {
+	listener, err := self.listen(MQTT_WEBSOCKET_PORT)
+	if err != nil {
+		return err
+	}
+	return self.ServeWebSocket(listener, path)
+}
+
+func (self *Broker) ServeWebSocket(listener net.Listener, path string) error {
+	mux := http.NewServeMux()
+	mux.Handle(path, self.WebSocketHandler())
+	if !self.trackListener(listener) {
+		listener.Close()
+		return BROKER_CLOSED
+	}
+	defer self.untrackListener(listener)
+	err := http.Serve(listener, mux)
+	if self.isClosed() {
+		return BROKER_CLOSED
+	}
+	return err
+}
+
+// ConnectWebSocket dials url such as "ws://host:8080/mqtt" or "wss://...",
+// config is used for wss and can be nil.
+func (self *Transport) ConnectWebSocket(url string, config *tls.Config) error {
+	dialer := websocket.Dialer{
+		Subprotocols:    []string{WEBSOCKET_SUBPROTOCOL},
+		TLSClientConfig: config,
+	}
+	conn, _, err := dialer.Dial(url, nil)
+	if err != nil {
+		return err
+	}
+	self.conn = newWsConn(conn)
+	return nil
+}
@@ -0,0 +1,71 @@
+package MQTTg
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestWebSocketConnect(t *testing.T) {
+	b, addr := startTestBroker(t)
+	server := httptest.NewServer(b.WebSocketHandler())
+	defer server.Close()
+	url := "ws" + strings.TrimPrefix(server.URL, "http") + "/mqtt"
+
+	wsClient := NewClient("ws-client", nil, 0, nil)
+	if err := wsClient.ConnectWebSocket(url, true, nil); err != nil {
+		t.Fatal(err)
+	}
+	tcpClient := NewClient("tcp-client", nil, 0, nil)
+	if err := tcpClient.Connect(addr, true); err != nil {
+		t.Fatal(err)
+	}
+	if !waitFor(wsClient.isConnecting) || !waitFor(tcpClient.isConnecting) {
+		t.Fatal("could not connect")
+	}
+
+	wsClient.Subscribe([]*SubscribeTopic{NewSubscribeTopic("dashboard/#", 1)})
+	tcpClient.Subscribe([]*SubscribeTopic{NewSubscribeTopic("dashboard/+", 0)})
+	e_subscribers := map[string]uint8{"ws-client": 1, "tcp-client": 0}
+	ok := waitFor(func() bool {
+		return len(b.TopicRoot.GetSubscribers("dashboard/temp")) == len(e_subscribers)
+	})
+	if a_subscribers := b.TopicRoot.GetSubscribers("dashboard/temp"); !ok {
+		t.Errorf("got %v\nwant %v", a_subscribers, e_subscribers)
+	}
+
+	// the packet must pass over the WebSocket both ways
+	wsClient.Publish("dashboard/temp", "20", 1, false)
+	ok = waitFor(func() bool {
+		wsClient.mu.Lock()
+		defer wsClient.mu.Unlock()
+		return len(wsClient.PacketIDMap) == 0
+	})
+	if !ok {
+		t.Errorf("PUBACK did not come over WebSocket")
+	}
+	wsClient.disconnectProcessing()
+	tcpClient.disconnectProcessing()
+}
+
+func TestWebSocketSubprotocol(t *testing.T) {
+	b, _ := startTestBroker(t)
+	server := httptest.NewServer(b.WebSocketHandler())
+	defer server.Close()
+
+	req, _ := http.NewRequest("GET", server.URL+"/mqtt", nil)
+	req.Header.Set("Connection", "Upgrade")
+	req.Header.Set("Upgrade", "websocket")
+	req.Header.Set("Sec-WebSocket-Version", "13")
+	req.Header.Set("Sec-WebSocket-Key", "dGhlIHNhbXBsZSBub25jZQ==")
+	req.Header.Set("Sec-WebSocket-Protocol", "chat")
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("got %v\nwant %v", resp.StatusCode, http.StatusBadRequest)
+	}
+}